@@ -4,21 +4,34 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/adykaaa/k8s-netpol-ctrl/config"
 	"github.com/adykaaa/k8s-netpol-ctrl/handlers/attribute"
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/dependency"
 	"github.com/adykaaa/k8s-netpol-ctrl/handlers/event"
 	"github.com/adykaaa/k8s-netpol-ctrl/handlers/networkpolicy"
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/object"
 	"github.com/adykaaa/k8s-netpol-ctrl/watcher"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery/cached/memory"
 	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/restmapper"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 )
 
 type ResourceWatcher interface {
@@ -26,16 +39,33 @@ type ResourceWatcher interface {
 	NewEventHandlerFuncs() *cache.ResourceEventHandlerFuncs
 }
 
+// Reconciler processes the objects queued for reconciliation, e.g because a Service or Pod they depend on has changed
+type Reconciler interface {
+	Run(ctx context.Context)
+}
+
 type App struct {
 	clientSet       kubernetes.Interface
+	dynamicClient   dynamic.Interface
 	configProvider  config.Provider
 	informerFactory informers.SharedInformerFactory
-	gvrs            []schema.GroupVersionResource
-	resourceWatcher ResourceWatcher
+	// dynamicInformerFactory watches the custom workloads, which have no typed informers
+	dynamicInformerFactory dynamicinformer.DynamicSharedInformerFactory
+	gvrs                   []schema.GroupVersionResource
+	customGVRs             map[schema.GroupVersionResource]bool
+	resourceWatcher        ResourceWatcher
+	reconciler             Reconciler
+	// metricsAddr is the address the expvar metrics are served on, they are not served if it's empty
+	metricsAddr string
 }
 
 func New() (*App, error) {
 	cp := &config.DefaultProvider{}
+	opts, err := config.NewOptions(cp)
+	if err != nil {
+		return nil, fmt.Errorf("could not load controller options: %w", err)
+	}
+
 	config, err := config.New(cp)
 	if err != nil {
 		return nil, fmt.Errorf("could not initialize configuration: %w", err)
@@ -51,40 +81,250 @@ func New() (*App, error) {
 		return nil, fmt.Errorf("could not initialize dyamic client: %w", err)
 	}
 
-	rw := &watcher.ResourceWatcher{
-		Handler: &event.Handler{
-			Client:        clientSet,
-			DyanmicClient: dynamicClient,
-			NetworkPolicyHandler: &networkpolicy.Handler{
-				Client: clientSet,
-			},
-			AttributeHandler: &attribute.Handler{
-				Client: clientSet,
-			},
+	informerFactory := watcher.NewFactory(clientSet, 30*time.Second)
+	podInformer := informerFactory.Core().V1().Pods().Informer()
+	if err := podInformer.AddIndexers(cache.Indexers{attribute.PodIPIndex: attribute.PodIPIndexFunc}); err != nil {
+		return nil, fmt.Errorf("could not add pod ip index: %w", err)
+	}
+	svcInformer := informerFactory.Core().V1().Services().Informer()
+	if err := svcInformer.AddIndexers(cache.Indexers{attribute.ClusterIPIndex: attribute.ServiceClusterIPIndexFunc}); err != nil {
+		return nil, fmt.Errorf("could not add service clusterip index: %w", err)
+	}
+
+	// the scanned ConfigMaps and the template ConfigMap are read from an informer, whose changes queue the objects using them
+	var cmIndexer cache.Indexer
+	if opts.Detectors.ConfigMaps || opts.TemplateConfigMap != "" {
+		cmIndexer = informerFactory.Core().V1().ConfigMaps().Informer().GetIndexer()
+	}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientSet.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "netpol-ctrl"})
+
+	enabled := map[string]bool{
+		attribute.EnvVarDetectorName:    opts.Detectors.EnvVars == nil || *opts.Detectors.EnvVars,
+		attribute.ConfigMapDetectorName: opts.Detectors.ConfigMaps,
+	}
+	for name, on := range opts.Detectors.Custom {
+		enabled[name] = on
+	}
+	detectors, err := attribute.NewDetectors(enabled)
+	if err != nil {
+		return nil, fmt.Errorf("could not set up the dependency detectors: %w", err)
+	}
+
+	nph := &networkpolicy.Handler{
+		Client:           clientSet,
+		Profiles:         make(map[string]networkpolicy.Profile, len(opts.Profiles)),
+		DefaultProfile:   opts.DefaultProfile,
+		ConfigMapIndexer: cmIndexer,
+	}
+	// the options have made sure that it looks like <namespace>/<name>
+	nph.TemplateNamespace, nph.TemplateConfigMap, _ = strings.Cut(opts.TemplateConfigMap, "/")
+	for name, po := range opts.Profiles {
+		nph.Profiles[name] = networkpolicy.Profile{
+			IngressControllers: po.IngressControllers,
+			DNS:                po.DNS,
+			SameNamespace:      po.SameNamespace,
+			OpenEgress:         po.OpenEgress,
+		}
+	}
+	if _, _, err := nph.LookupProfile(opts.DefaultProfile); err != nil {
+		return nil, fmt.Errorf("could not set the default profile: %w", err)
+	}
+
+	identity := object.IdentityLabelPolicy{Allow: opts.IdentityLabels.Allow, Deny: opts.IdentityLabels.Deny}
+	if err := identity.Validate(); err != nil {
+		return nil, fmt.Errorf("could not set the identity labels: %w", err)
+	}
+
+	eh := &event.Handler{
+		Client:               clientSet,
+		DyanmicClient:        dynamicClient,
+		NetworkPolicyHandler: nph,
+		AttributeHandler: &attribute.Handler{
+			Client:            clientSet,
+			PodIndexer:        podInformer.GetIndexer(),
+			ServiceIndexer:    svcInformer.GetIndexer(),
+			ConfigMapIndexer:  cmIndexer,
+			ExternalNameCIDRs: opts.ExternalNameCIDRs,
+			Detectors:         detectors,
+			IdentityLabels:    identity,
 		},
+		Owners:            object.NewOwnerResolver(dynamicClient, restmapper.NewDeferredDiscoveryRESTMapper(memory.NewMemCacheClient(clientSet.Discovery()))),
+		Dependencies:      dependency.NewIndex(),
+		PodIndexer:        podInformer.GetIndexer(),
+		ServiceIndexer:    svcInformer.GetIndexer(),
+		Queue:             workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		Recorder:          recorder,
+		NonIntrusive:      opts.NonIntrusive,
+		Collisions:        event.CollisionMode(opts.SelectorCollisions),
+		NamespaceBaseline: opts.NamespaceBaseline,
+		IdentityLabels:    identity,
+		TemplateConfigMap: opts.TemplateConfigMap,
 	}
+	rw := &watcher.ResourceWatcher{Handler: eh}
 
-	gvrs := rw.NewDefaultGroupVersionResources()
-	informerFactory := watcher.NewFactory(clientSet, 30*time.Second)
+	// the namespaces pick profiles and opt into the baseline policy
+	gvrs := append(rw.NewDefaultGroupVersionResources(), schema.GroupVersionResource{Group: "", Version: "v1", Resource: "namespaces"})
+	if cmIndexer != nil {
+		gvrs = append(gvrs, schema.GroupVersionResource{Group: "", Version: "v1", Resource: "configmaps"})
+	}
+
+	customGVRs := make(map[schema.GroupVersionResource]bool, len(opts.CustomWorkloads))
+	for _, cw := range opts.CustomWorkloads {
+		gvr := schema.GroupVersionResource{Group: cw.Group, Version: cw.Version, Resource: cw.Resource}
+		err := object.RegisterWorkload(object.Workload{
+			GVR:             gvr,
+			Kind:            cw.Kind,
+			SelectorPath:    cw.SelectorPath,
+			PodTemplatePath: cw.PodTemplatePath,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not register custom workload %v: %w", gvr, err)
+		}
+		gvrs = append(gvrs, gvr)
+		customGVRs[gvr] = true
+	}
 
 	return &App{
-		clientSet:       clientSet,
-		configProvider:  cp,
-		informerFactory: informerFactory,
-		gvrs:            gvrs,
-		resourceWatcher: rw,
+		clientSet:              clientSet,
+		dynamicClient:          dynamicClient,
+		configProvider:         cp,
+		informerFactory:        informerFactory,
+		dynamicInformerFactory: dynamicinformer.NewDynamicSharedInformerFactory(dynamicClient, 30*time.Second),
+		gvrs:                   gvrs,
+		customGVRs:             customGVRs,
+		resourceWatcher:        rw,
+		reconciler:             eh,
+		metricsAddr:            opts.MetricsAddr,
 	}, nil
 }
 
+// informerFor returns the informer of the resource: a dynamic one for the custom workloads, and a typed one for everything else
+func (a *App) informerFor(gvr schema.GroupVersionResource) (informers.GenericInformer, error) {
+	if a.customGVRs[gvr] {
+		return a.dynamicInformerFactory.ForResource(gvr), nil
+	}
+	return a.informerFactory.ForResource(gvr)
+}
+
+/*
+Cleanup removes the label the controller has added to the Pods of the objects of interest, so that nothing is left behind once the
+controller is uninstalled. The namespaces are cleaned up one by one, and the objects without the label are left alone.
+*/
+func (a *App) Cleanup() error {
+	ctx := context.Background()
+	namespaces, err := a.clientSet.CoreV1().Namespaces().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("could not list namespaces: %w", err)
+	}
+
+	for _, ns := range namespaces.Items {
+		objs, err := a.labeledObjects(ctx, ns.Name)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			if err := object.NewHandler(a.dynamicClient, obj).RemoveLabel(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/*
+labeledObjects returns the objects of the namespace whose Pods the controller has labeled. Standalone Pods are listed by the ManagedLabel.
+The label of the workloads is on their Pod template, which the API can't select by, so they are filtered by HasManagedLabel. The Pods
+of the workloads are left to their owners, they lose the label once the unlabeled template is rolled out.
+*/
+func (a *App) labeledObjects(ctx context.Context, namespace string) ([]metav1.Object, error) {
+	var objs []metav1.Object
+
+	pods, err := a.clientSet.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{LabelSelector: object.ManagedLabel})
+	if err != nil {
+		return nil, fmt.Errorf("could not list pods in %s: %w", namespace, err)
+	}
+	for i := range pods.Items {
+		if len(pods.Items[i].OwnerReferences) == 0 {
+			objs = append(objs, &pods.Items[i])
+		}
+	}
+
+	deployments, err := a.clientSet.AppsV1().Deployments(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list deployments in %s: %w", namespace, err)
+	}
+	for i := range deployments.Items {
+		objs = append(objs, &deployments.Items[i])
+	}
+
+	statefulSets, err := a.clientSet.AppsV1().StatefulSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list statefulsets in %s: %w", namespace, err)
+	}
+	for i := range statefulSets.Items {
+		objs = append(objs, &statefulSets.Items[i])
+	}
+
+	daemonSets, err := a.clientSet.AppsV1().DaemonSets(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list daemonsets in %s: %w", namespace, err)
+	}
+	for i := range daemonSets.Items {
+		objs = append(objs, &daemonSets.Items[i])
+	}
+
+	cronJobs, err := a.clientSet.BatchV1().CronJobs(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list cronjobs in %s: %w", namespace, err)
+	}
+	for i := range cronJobs.Items {
+		objs = append(objs, &cronJobs.Items[i])
+	}
+
+	for _, gvr := range a.gvrs {
+		if !a.customGVRs[gvr] {
+			continue
+		}
+		workloads, err := a.dynamicClient.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("could not list %s in %s: %w", gvr.Resource, namespace, err)
+		}
+		for i := range workloads.Items {
+			objs = append(objs, &workloads.Items[i])
+		}
+	}
+
+	labeled := objs[:0]
+	for _, obj := range objs {
+		if object.HasManagedLabel(obj) {
+			labeled = append(labeled, obj)
+		}
+	}
+	return labeled, nil
+}
+
 func (a *App) Run() {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	errCh := make(chan watcher.Error, len(a.gvrs))
 	ehf := a.resourceWatcher.NewEventHandlerFuncs()
+	go a.reconciler.Run(ctx)
+
+	if a.metricsAddr != "" {
+		// the expvar package registers its /debug/vars handler on the default mux
+		go func() {
+			if err := http.ListenAndServe(a.metricsAddr, nil); err != nil {
+				log.Printf("could not serve the metrics: %v \n", err)
+			}
+		}()
+	}
 
 	for _, gvr := range a.gvrs {
 		go func(gvr schema.GroupVersionResource) {
-			inf, err := a.informerFactory.ForResource(gvr)
+			inf, err := a.informerFor(gvr)
 			if err != nil {
 				log.Fatalf("could not initialize informer for %v", gvr)
 			}
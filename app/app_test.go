@@ -0,0 +1,119 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/object"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+var _rolloutGVR = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}
+
+func labels(labeled bool) map[string]string {
+	if labeled {
+		return map[string]string{"app": "test", object.ManagedLabel: "test-testnamespace"}
+	}
+	return map[string]string{"app": "test"}
+}
+
+func podTemplate(labeled bool) corev1.PodTemplateSpec {
+	return corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: labels(labeled)}}
+}
+
+func testObjects(name string, labeled bool) []runtime.Object {
+	meta := metav1.ObjectMeta{Name: name, Namespace: "testnamespace"}
+	return []runtime.Object{
+		&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "testnamespace", Labels: labels(labeled)}},
+		&appsv1.Deployment{ObjectMeta: meta, Spec: appsv1.DeploymentSpec{Template: podTemplate(labeled)}},
+		&appsv1.StatefulSet{ObjectMeta: meta, Spec: appsv1.StatefulSetSpec{Template: podTemplate(labeled)}},
+		&appsv1.DaemonSet{ObjectMeta: meta, Spec: appsv1.DaemonSetSpec{Template: podTemplate(labeled)}},
+		&batchv1.CronJob{ObjectMeta: meta, Spec: batchv1.CronJobSpec{
+			JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: podTemplate(labeled)}},
+		}},
+	}
+}
+
+func testRollout(name string, labeled bool) *unstructured.Unstructured {
+	templateLabels := map[string]interface{}{}
+	for k, v := range labels(labeled) {
+		templateLabels[k] = v
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "argoproj.io/v1alpha1",
+		"kind":       "Rollout",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "testnamespace"},
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{"metadata": map[string]interface{}{"labels": templateLabels}},
+		},
+	}}
+}
+
+func TestCleanup(t *testing.T) {
+	err := object.RegisterWorkload(object.Workload{
+		GVR:             _rolloutGVR,
+		Kind:            "Rollout",
+		SelectorPath:    "{.spec.selector}",
+		PodTemplatePath: "{.spec.template}",
+	})
+	require.NoError(t, err)
+
+	ownedPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name:            "owned",
+		Namespace:       "testnamespace",
+		Labels:          labels(true),
+		OwnerReferences: []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "labeled", UID: "uid"}},
+	}}
+	objs := append(testObjects("labeled", true), testObjects("unlabeled", false)...)
+	objs = append(objs, ownedPod)
+
+	clientSet := fake.NewSimpleClientset(objs...)
+	_, err = clientSet.CoreV1().Namespaces().Create(context.Background(),
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "testnamespace"}}, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	// the labels are removed through the dynamic client, so the objects and the custom workloads are copied there
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(scheme.Scheme,
+		map[schema.GroupVersionResource]string{_rolloutGVR: "RolloutList"},
+		append(objs, testRollout("labeled", true), testRollout("unlabeled", false))...)
+
+	a := &App{
+		clientSet:     clientSet,
+		dynamicClient: dc,
+		gvrs:          []schema.GroupVersionResource{_rolloutGVR},
+		customGVRs:    map[schema.GroupVersionResource]bool{_rolloutGVR: true},
+	}
+	require.NoError(t, a.Cleanup())
+
+	patches := map[string]string{}
+	for _, action := range dc.Actions() {
+		patch, ok := action.(k8stesting.PatchAction)
+		if !ok {
+			continue
+		}
+		assert.Equal(t, "testnamespace", patch.GetNamespace())
+		patches[patch.GetResource().Resource+"/"+patch.GetName()] = string(patch.GetPatch())
+	}
+
+	template := `{"spec":{"template":{"metadata":{"labels":{"netpol-ctrl":null}}}}}`
+	assert.Equal(t, map[string]string{
+		"pods/labeled":         `{"metadata":{"labels":{"netpol-ctrl":null}}}`,
+		"deployments/labeled":  template,
+		"statefulsets/labeled": template,
+		"daemonsets/labeled":   template,
+		"cronjobs/labeled":     `{"spec":{"jobTemplate":{"spec":{"template":{"metadata":{"labels":{"netpol-ctrl":null}}}}}}}`,
+		"rollouts/labeled":     template,
+	}, patches)
+}
@@ -20,6 +20,7 @@ type Provider interface {
 	Stat(name string) (os.FileInfo, error)
 	BuildConfigFromFlags(masterUrl, kubeconfigPath string) (*rest.Config, error)
 	InClusterConfig() (*rest.Config, error)
+	ReadFile(name string) ([]byte, error)
 }
 
 type DefaultProvider struct{}
@@ -40,6 +41,10 @@ func (dp *DefaultProvider) InClusterConfig() (*rest.Config, error) {
 	return rest.InClusterConfig()
 }
 
+func (dp *DefaultProvider) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+
 func New(p Provider) (*rest.Config, error) {
 	if kubeconfig := p.GetEnv("KUBECONFIG"); kubeconfig != "" {
 		config, err := p.BuildConfigFromFlags("", kubeconfig)
@@ -13,6 +13,7 @@ type MockConfigProvider struct {
 	fileExists         bool
 	buildConfigError   bool
 	inClusterConfigErr bool
+	files              map[string][]byte
 }
 
 func (mcp *MockConfigProvider) GetEnv(key string) string {
@@ -40,6 +41,14 @@ func (mcp *MockConfigProvider) InClusterConfig() (*rest.Config, error) {
 	return &rest.Config{}, nil
 }
 
+func (mcp *MockConfigProvider) ReadFile(name string) ([]byte, error) {
+	data, ok := mcp.files[name]
+	if !ok {
+		return nil, errors.New("file not found")
+	}
+	return data, nil
+}
+
 func TestNewConfig(t *testing.T) {
 	tests := []struct {
 		name               string
@@ -0,0 +1,149 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+var ErrInvalidOptions = errors.New("could not parse the controller options")
+
+// Options holds the settings of the controller itself. They are read from the YAML file the NETPOL_CTRL_CONFIG env. var points to.
+type Options struct {
+	Detectors DetectorOptions `json:"detectors"`
+	// ExternalNameCIDRs maps the hostnames of ExternalName Services to the CIDRs they resolve to, e.g "*.rds.amazonaws.com": ["10.20.0.0/16"].
+	// There is no DNS resolution at reconcile time, so unmapped hostnames are not part of the policies.
+	ExternalNameCIDRs map[string][]string `json:"externalNameCIDRs"`
+	// NonIntrusive keeps the controller from ever writing to the workloads. The policies only use the labels the workloads already have.
+	NonIntrusive bool `json:"nonIntrusive"`
+	// CustomWorkloads are the custom resources which run Pods, and get policies like the built-in workloads, e.g Argo Rollouts
+	CustomWorkloads []CustomWorkload `json:"customWorkloads"`
+	// IdentityLabels picks the label keys which identify the Pods, only these are used in the policy selectors and peers
+	IdentityLabels IdentityLabelOptions `json:"identityLabels"`
+	// SelectorCollisions is what happens to the workloads selecting the same Pods: "flag" reports them, "merge" gives them one shared policy.
+	// It defaults to "flag".
+	SelectorCollisions string `json:"selectorCollisions"`
+	// MetricsAddr is the address the metrics are served on at /debug/vars, e.g ":9090". They are not served if it's empty.
+	MetricsAddr string `json:"metricsAddr"`
+	// NamespaceBaseline gives the namespaces labeled "netpol-ctrl.io/baseline: deny" a default-deny policy
+	NamespaceBaseline bool `json:"namespaceBaseline"`
+	// Profiles are the policy profiles the workloads and namespaces can pick with the "netpol-ctrl.io/profile" annotation. They replace
+	// the built-in strict, baseline and open-egress profiles with the same name.
+	Profiles map[string]ProfileOptions `json:"profiles"`
+	// DefaultProfile is the profile of the workloads which don't pick one. The policies let the ingress controllers in and DNS out if it's empty.
+	DefaultProfile string `json:"defaultProfile"`
+	// TemplateConfigMap is the <namespace>/<name> of the ConfigMap holding the policy templates, which the workloads pick with the
+	// "netpol-ctrl.io/template" label. There are no templates if it's empty.
+	TemplateConfigMap string `json:"templateConfigMap"`
+}
+
+// ProfileOptions lists the general peers the policies of a profile let through, next to the workload's own Pods and its dependencies
+type ProfileOptions struct {
+	// IngressControllers lets the supported ingress controllers in
+	IngressControllers bool `json:"ingressControllers"`
+	// DNS lets traffic out to the supported DNS Pods
+	DNS bool `json:"dns"`
+	// SameNamespace lets every Pod of the workload's namespace in and out
+	SameNamespace bool `json:"sameNamespace"`
+	// OpenEgress leaves the egress of the workload unrestricted
+	OpenEgress bool `json:"openEgress"`
+}
+
+// IdentityLabelOptions lists the label keys to keep and to drop. A key is either a full key or a prefix ending with "*", e.g "helm.sh/*"
+type IdentityLabelOptions struct {
+	// Allow lists the keys to keep. If it's empty, every key is kept unless it's denied.
+	Allow []string `json:"allow"`
+	// Deny lists the keys to drop, even if they are allowed
+	Deny []string `json:"deny"`
+}
+
+// CustomWorkload describes a custom resource which runs Pods, and where its Pod selector and Pod template can be found
+type CustomWorkload struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+	Kind     string `json:"kind"`
+	// SelectorPath is the JSONPath of the LabelSelector selecting the Pods, e.g {.spec.selector}
+	SelectorPath string `json:"selectorPath"`
+	// PodTemplatePath is the JSONPath of the Pod template, e.g {.spec.template}
+	PodTemplatePath string `json:"podTemplatePath"`
+}
+
+// DetectorOptions switches the dependency detectors on or off
+type DetectorOptions struct {
+	// EnvVars enables scanning the env. vars of the workload's containers for cluster.local addresses. It's on unless it's set to false.
+	EnvVars *bool `json:"envVars"`
+	// ConfigMaps enables scanning the ConfigMaps mounted into the workload's Pods for cluster.local addresses
+	ConfigMaps bool `json:"configMaps"`
+	// Custom switches the custom detectors on or off by their names. They have to be registered before the controller starts.
+	Custom map[string]bool `json:"custom"`
+}
+
+/*
+NewOptions loads the controller options from the file set in the NETPOL_CTRL_CONFIG env. var. If the env. var is not set,
+the default options are returned.
+*/
+func NewOptions(p Provider) (*Options, error) {
+	opts := &Options{}
+
+	path := p.GetEnv("NETPOL_CTRL_CONFIG")
+	if path == "" {
+		return opts, nil
+	}
+
+	data, err := p.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read options file %s: %w", path, err)
+	}
+
+	if err := yaml.UnmarshalStrict(data, opts); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOptions, err)
+	}
+
+	switch opts.SelectorCollisions {
+	case "", "flag", "merge":
+	default:
+		return nil, fmt.Errorf("%w: selectorCollisions should be flag or merge, not %q", ErrInvalidOptions, opts.SelectorCollisions)
+	}
+
+	cidrs, err := normalizeExternalNameCIDRs(opts.ExternalNameCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	opts.ExternalNameCIDRs = cidrs
+
+	if opts.TemplateConfigMap != "" {
+		namespace, name, found := strings.Cut(opts.TemplateConfigMap, "/")
+		if !found || namespace == "" || name == "" || strings.Contains(name, "/") {
+			return nil, fmt.Errorf("%w: templateConfigMap should look like <namespace>/<name>, not %q", ErrInvalidOptions, opts.TemplateConfigMap)
+		}
+	}
+
+	fmt.Printf("using the controller options from %s\n", path)
+	return opts, nil
+}
+
+/*
+normalizeExternalNameCIDRs checks that every value of the ExternalNameCIDRs is a CIDR, and lowercases the hostnames, since the
+external names are matched against them in lowercase. A bad CIDR would fail every policy depending on the Service when it's applied.
+*/
+func normalizeExternalNameCIDRs(m map[string][]string) (map[string][]string, error) {
+	if m == nil {
+		return nil, nil
+	}
+
+	normalized := make(map[string][]string, len(m))
+	for host, cidrs := range m {
+		for _, cidr := range cidrs {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				return nil, fmt.Errorf("%w: externalNameCIDRs of %q: %q is not a CIDR", ErrInvalidOptions, host, cidr)
+			}
+		}
+		key := strings.TrimSuffix(strings.ToLower(host), ".")
+		normalized[key] = append(normalized[key], cidrs...)
+	}
+	return normalized, nil
+}
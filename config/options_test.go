@@ -0,0 +1,215 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewOptions(t *testing.T) {
+	tests := []struct {
+		name               string
+		mockConfigProvider *MockConfigProvider
+		expected           *Options
+		testErr            func(t *testing.T, err error)
+	}{
+		{
+			name: "OK - defaults without NETPOL_CTRL_CONFIG",
+			mockConfigProvider: &MockConfigProvider{
+				env: map[string]string{},
+			},
+			expected: &Options{},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "OK - options read from file",
+			mockConfigProvider: &MockConfigProvider{
+				env: map[string]string{"NETPOL_CTRL_CONFIG": "/etc/netpol-ctrl/config.yaml"},
+				files: map[string][]byte{"/etc/netpol-ctrl/config.yaml": []byte("detectors:\n  configMaps: true\nexternalNameCIDRs:\n  \"*.rds.amazonaws.com\": [\"10.20.0.0/16\"]\n" +
+					"nonIntrusive: true\n")},
+			},
+			expected: &Options{
+				Detectors:         DetectorOptions{ConfigMaps: true},
+				ExternalNameCIDRs: map[string][]string{"*.rds.amazonaws.com": {"10.20.0.0/16"}},
+				NonIntrusive:      true,
+			},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "OK - external name hostnames are lowercased",
+			mockConfigProvider: &MockConfigProvider{
+				env: map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("externalNameCIDRs:\n  \"DB.Example.COM.\": [\"203.0.113.10/32\"]\n" +
+					"  \"*.RDS.amazonaws.com\": [\"10.20.0.0/16\"]\n")},
+			},
+			expected: &Options{
+				ExternalNameCIDRs: map[string][]string{"db.example.com": {"203.0.113.10/32"}, "*.rds.amazonaws.com": {"10.20.0.0/16"}},
+			},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "fails - external name CIDR is not a CIDR",
+			mockConfigProvider: &MockConfigProvider{
+				env:   map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("externalNameCIDRs:\n  db.example.com: [\"203.0.113.10\"]\n")},
+			},
+			expected: nil,
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidOptions)
+			},
+		},
+		{
+			name: "OK - custom workloads",
+			mockConfigProvider: &MockConfigProvider{
+				env: map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("customWorkloads:\n- group: argoproj.io\n  version: v1alpha1\n  resource: rollouts\n" +
+					"  kind: Rollout\n  selectorPath: \"{.spec.selector}\"\n  podTemplatePath: \"{.spec.template}\"\n")},
+			},
+			expected: &Options{
+				CustomWorkloads: []CustomWorkload{{
+					Group:           "argoproj.io",
+					Version:         "v1alpha1",
+					Resource:        "rollouts",
+					Kind:            "Rollout",
+					SelectorPath:    "{.spec.selector}",
+					PodTemplatePath: "{.spec.template}",
+				}},
+			},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "OK - identity labels",
+			mockConfigProvider: &MockConfigProvider{
+				env:   map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("identityLabels:\n  allow: [\"app\", \"app.kubernetes.io/*\"]\n  deny: [\"app.kubernetes.io/version\"]\n")},
+			},
+			expected: &Options{
+				IdentityLabels: IdentityLabelOptions{
+					Allow: []string{"app", "app.kubernetes.io/*"},
+					Deny:  []string{"app.kubernetes.io/version"},
+				},
+			},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "OK - selector collisions and metrics",
+			mockConfigProvider: &MockConfigProvider{
+				env:   map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("selectorCollisions: merge\nmetricsAddr: \":9090\"\n")},
+			},
+			expected: &Options{SelectorCollisions: "merge", MetricsAddr: ":9090"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "OK - namespace baseline",
+			mockConfigProvider: &MockConfigProvider{
+				env:   map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("namespaceBaseline: true\n")},
+			},
+			expected: &Options{NamespaceBaseline: true},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "OK - profiles",
+			mockConfigProvider: &MockConfigProvider{
+				env: map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("defaultProfile: internal\nprofiles:\n  internal:\n    dns: true\n" +
+					"    sameNamespace: true\n")},
+			},
+			expected: &Options{
+				DefaultProfile: "internal",
+				Profiles:       map[string]ProfileOptions{"internal": {DNS: true, SameNamespace: true}},
+			},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "fails - unknown selector collision mode",
+			mockConfigProvider: &MockConfigProvider{
+				env:   map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("selectorCollisions: ignore\n")},
+			},
+			expected: nil,
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidOptions)
+			},
+		},
+		{
+			name: "OK - template ConfigMap",
+			mockConfigProvider: &MockConfigProvider{
+				env:   map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("templateConfigMap: kube-system/netpol-ctrl-templates\n")},
+			},
+			expected: &Options{TemplateConfigMap: "kube-system/netpol-ctrl-templates"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "fails - template ConfigMap without a namespace",
+			mockConfigProvider: &MockConfigProvider{
+				env:   map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("templateConfigMap: netpol-ctrl-templates\n")},
+			},
+			expected: nil,
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidOptions)
+			},
+		},
+		{
+			name: "OK - detectors",
+			mockConfigProvider: &MockConfigProvider{
+				env:   map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("detectors:\n  envVars: false\n  custom:\n    catalog: true\n")},
+			},
+			expected: &Options{Detectors: DetectorOptions{EnvVars: new(bool), Custom: map[string]bool{"catalog": true}}},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "fails - file does not exist",
+			mockConfigProvider: &MockConfigProvider{
+				env: map[string]string{"NETPOL_CTRL_CONFIG": "/nonexistent.yaml"},
+			},
+			expected: nil,
+			testErr: func(t *testing.T, err error) {
+				assert.Error(t, err)
+			},
+		},
+		{
+			name: "fails - unknown field",
+			mockConfigProvider: &MockConfigProvider{
+				env:   map[string]string{"NETPOL_CTRL_CONFIG": "config.yaml"},
+				files: map[string][]byte{"config.yaml": []byte("detectors:\n  unknown: true\n")},
+			},
+			expected: nil,
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidOptions)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts, err := NewOptions(tt.mockConfigProvider)
+			tt.testErr(t, err)
+			assert.Equal(t, tt.expected, opts)
+		})
+	}
+}
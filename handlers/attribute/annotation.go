@@ -0,0 +1,201 @@
+package attribute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// EgressToAnnotation declares the dependencies of a workload which can't be detected, e.g "svc/api.default, deploy/worker.jobs"
+	EgressToAnnotation = "netpol-ctrl.io/egress-to"
+	// IngressFromAnnotation declares who can reach the workload, e.g "ns/monitoring, deploy/gateway.edge"
+	IngressFromAnnotation = "netpol-ctrl.io/ingress-from"
+)
+
+var (
+	ErrMalformedEntry  = errors.New("malformed annotation entry")
+	ErrAmbiguousTarget = errors.New("the target pods have different labels")
+)
+
+// the kinds which can be used in the EgressToAnnotation and IngressFromAnnotation entries, with their aliases
+var _declaredKinds = map[string]string{
+	"svc":         "svc",
+	"service":     "svc",
+	"pod":         "pod",
+	"deploy":      "deploy",
+	"deployment":  "deploy",
+	"sts":         "sts",
+	"statefulset": "sts",
+	"ds":          "ds",
+	"daemonset":   "ds",
+	"ns":          "ns",
+	"namespace":   "ns",
+}
+
+// DeclaredRef is a parsed <kind>/<name>.<namespace> or ns/<namespace> annotation entry
+type DeclaredRef struct {
+	Kind      string
+	Name      string
+	Namespace string
+}
+
+// DeclaredTarget is a resolved annotation entry
+type DeclaredTarget struct {
+	Namespace string
+	// Labels are the labels of the target Pods. They are empty for namespace entries, which mean every Pod of the namespace
+	Labels map[string]string
+	// Expressions are the matchExpressions of the target workload's selector, which select the target Pods together with the Labels
+	Expressions []metav1.LabelSelectorRequirement
+}
+
+/*
+ParseDeclaredRef parses an annotation entry. The namespace of the entry is optional, if it's missing the namespace of the
+annotated object (defaultNamespace) is used. The accepted forms are:
+
+	svc/<name>.<namespace>
+	pod/<name>.<namespace>
+	deploy/<name>.<namespace>
+	sts/<name>.<namespace>
+	ds/<name>.<namespace>
+	ns/<namespace>
+*/
+func ParseDeclaredRef(entry string, defaultNamespace string) (DeclaredRef, error) {
+	kind, rest, found := strings.Cut(strings.TrimSpace(entry), "/")
+	if !found || rest == "" {
+		return DeclaredRef{}, fmt.Errorf("%w: %q should look like <kind>/<name>.<namespace>", ErrMalformedEntry, entry)
+	}
+
+	ref := DeclaredRef{Kind: _declaredKinds[strings.ToLower(kind)]}
+	if ref.Kind == "" {
+		return DeclaredRef{}, fmt.Errorf("%w: %q has an unknown kind %q", ErrMalformedEntry, entry, kind)
+	}
+
+	if ref.Kind == "ns" {
+		ref.Namespace = rest
+	} else {
+		ref.Name, ref.Namespace = rest, defaultNamespace
+		// namespaces can't contain dots, but some object names can
+		if i := strings.LastIndex(rest, "."); i != -1 {
+			ref.Name, ref.Namespace = rest[:i], rest[i+1:]
+		}
+		if errs := validation.IsDNS1123Subdomain(ref.Name); len(errs) > 0 {
+			return DeclaredRef{}, fmt.Errorf("%w: %q has an invalid name: %s", ErrMalformedEntry, entry, strings.Join(errs, ", "))
+		}
+	}
+
+	if errs := validation.IsDNS1123Label(ref.Namespace); len(errs) > 0 {
+		return DeclaredRef{}, fmt.Errorf("%w: %q has an invalid namespace: %s", ErrMalformedEntry, entry, strings.Join(errs, ", "))
+	}
+	return ref, nil
+}
+
+// getWorkloadSelector returns the selector of a Deployment, StatefulSet or DaemonSet
+func (h *Handler) getWorkloadSelector(ref DeclaredRef) (*metav1.LabelSelector, error) {
+	var selector *metav1.LabelSelector
+	var err error
+	ctx := context.Background()
+
+	switch ref.Kind {
+	case "deploy":
+		obj, getErr := h.Client.AppsV1().Deployments(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if getErr == nil {
+			selector = obj.Spec.Selector
+		}
+		err = getErr
+	case "sts":
+		obj, getErr := h.Client.AppsV1().StatefulSets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if getErr == nil {
+			selector = obj.Spec.Selector
+		}
+		err = getErr
+	case "ds":
+		obj, getErr := h.Client.AppsV1().DaemonSets(ref.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if getErr == nil {
+			selector = obj.Spec.Selector
+		}
+		err = getErr
+	default:
+		return nil, ErrTypeNotSupported
+	}
+
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, ErrResourceNotFound
+		}
+		return nil, fmt.Errorf("could not fetch %s %s. %w", ref.Kind, ref.Name, err)
+	}
+	if selector == nil || (len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0) {
+		return nil, ErrResourceNotFound
+	}
+	return h.IdentityLabels.Selector(selector), nil
+}
+
+// resolveDeclaredRef returns the labels of the Pods an annotation entry points at, the same way cluster.local addresses are resolved
+func (h *Handler) resolveDeclaredRef(ref DeclaredRef) (DeclaredTarget, error) {
+	target := DeclaredTarget{Namespace: ref.Namespace, Labels: map[string]string{}}
+
+	switch ref.Kind {
+	case "ns":
+		return target, nil
+	case "svc", "pod":
+		labels, err := h.resolveLocalRef(LocalRef{Kind: ref.Kind, Name: ref.Name, Namespace: ref.Namespace})
+		if err != nil {
+			return DeclaredTarget{}, err
+		}
+		if len(labels) == 0 {
+			return DeclaredTarget{}, ErrResourceNotFound
+		}
+		for k, v := range labels {
+			if len(v) > 1 {
+				return DeclaredTarget{}, fmt.Errorf("%w: %s", ErrAmbiguousTarget, k)
+			}
+			target.Labels[k] = v[0]
+		}
+	default:
+		selector, err := h.getWorkloadSelector(ref)
+		if err != nil {
+			return DeclaredTarget{}, err
+		}
+		target.Labels, target.Expressions = selector.MatchLabels, selector.MatchExpressions
+	}
+	return target, nil
+}
+
+/*
+GetDeclaredTargets parses and resolves the entries of the given annotation (EgressToAnnotation or IngressFromAnnotation) of the object.
+The entries pointing at objects that don't exist yet are returned as pending, so that they can be added once they show up. Malformed
+entries and entries pointing at Pods with different labels are skipped, and returned as warnings so that they can be reported.
+*/
+func (h *Handler) GetDeclaredTargets(obj metav1.Object, annotation string) ([]DeclaredTarget, []string, []string, error) {
+	var targets []DeclaredTarget
+	var pending, warnings []string
+
+	for _, entry := range splitAnnotation(obj.GetAnnotations()[annotation]) {
+		ref, err := ParseDeclaredRef(entry, obj.GetNamespace())
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", annotation, err))
+			continue
+		}
+
+		target, err := h.resolveDeclaredRef(ref)
+		switch {
+		case errors.Is(err, ErrResourceNotFound):
+			pending = append(pending, entry)
+			continue
+		case errors.Is(err, ErrAmbiguousTarget):
+			warnings = append(warnings, fmt.Sprintf("%s: %q can't be resolved: %v", annotation, entry, err))
+			continue
+		case err != nil:
+			return nil, nil, nil, err
+		}
+		targets = append(targets, target)
+	}
+
+	return targets, pending, warnings, nil
+}
@@ -0,0 +1,82 @@
+package attribute
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParseDeclaredRef(t *testing.T) {
+	cases := []struct {
+		entry    string
+		expected DeclaredRef
+		wantErr  bool
+	}{
+		{"svc/api.default", DeclaredRef{Kind: "svc", Name: "api", Namespace: "default"}, false},
+		{" deploy/worker.jobs ", DeclaredRef{Kind: "deploy", Name: "worker", Namespace: "jobs"}, false},
+		{"Deployment/my.app.jobs", DeclaredRef{Kind: "deploy", Name: "my.app", Namespace: "jobs"}, false},
+		{"sts/db", DeclaredRef{Kind: "sts", Name: "db", Namespace: "current"}, false},
+		{"ns/monitoring", DeclaredRef{Kind: "ns", Namespace: "monitoring"}, false},
+		{"api.default", DeclaredRef{}, true},
+		{"cm/config.default", DeclaredRef{}, true},
+		{"svc/", DeclaredRef{}, true},
+		{"svc/API.default", DeclaredRef{}, true},
+		{"ns/Monitoring", DeclaredRef{}, true},
+	}
+
+	for _, c := range cases {
+		got, err := ParseDeclaredRef(c.entry, "current")
+		if c.wantErr {
+			assert.ErrorIs(t, err, ErrMalformedEntry, c.entry)
+		} else {
+			assert.NoError(t, err, c.entry)
+		}
+		assert.Equal(t, c.expected, got)
+	}
+}
+
+func TestGetDeclaredTargets(t *testing.T) {
+	c := fake.NewSimpleClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "api"}},
+		},
+		&appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "gateway", Namespace: "edge"},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "gateway"}},
+			},
+		},
+	)
+	h := &Handler{Client: c}
+
+	obj := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "backend",
+			Namespace: "default",
+			Annotations: map[string]string{
+				EgressToAnnotation:    "svc/api.default, svc/missing, bad-entry",
+				IngressFromAnnotation: "ns/monitoring, deploy/gateway.edge",
+			},
+		},
+	}
+
+	egress, pending, warnings, err := h.GetDeclaredTargets(obj, EgressToAnnotation)
+	assert.NoError(t, err)
+	assert.Equal(t, []DeclaredTarget{{Namespace: "default", Labels: map[string]string{"app": "api"}}}, egress)
+	assert.Equal(t, []string{"svc/missing"}, pending)
+	assert.Len(t, warnings, 1)
+
+	ingress, pending, warnings, err := h.GetDeclaredTargets(obj, IngressFromAnnotation)
+	assert.NoError(t, err)
+	assert.Equal(t, []DeclaredTarget{
+		{Namespace: "monitoring", Labels: map[string]string{}},
+		{Namespace: "edge", Labels: map[string]string{"app": "gateway"}},
+	}, ingress)
+	assert.Empty(t, pending)
+	assert.Empty(t, warnings)
+}
@@ -5,14 +5,24 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log"
+	"net"
+	"net/url"
 	"regexp"
+	"sort"
 	"strings"
 
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/object"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
 )
 
 var (
@@ -22,8 +32,58 @@ var (
 	ErrTypeNotSupported = errors.New("this type is not supported")
 )
 
+const (
+	// PodIPIndex is the name of the Pod informer index which maps Pod IPs to Pods
+	PodIPIndex = "podIP"
+	// ClusterIPIndex is the name of the Service informer index which maps ClusterIPs to Services
+	ClusterIPIndex = "clusterIP"
+)
+
+// the possible kinds of a LocalRef
+const (
+	RefKindSvc = "svc"
+	RefKindPod = "pod"
+	// RefKindIP is an IP literal (e.g 10.96.12.4:5432), which might be the ClusterIP of a Service
+	RefKindIP = "ip"
+)
+
+const (
+	// ConfigMapIncludeAnnotation lists extra ConfigMaps (comma separated) of the workload's namespace to scan for cluster.local addresses
+	ConfigMapIncludeAnnotation = "netpol-ctrl.io/configmaps-include"
+	// ConfigMapExcludeAnnotation lists the ConfigMaps (comma separated) which should never be scanned for cluster.local addresses
+	ConfigMapExcludeAnnotation = "netpol-ctrl.io/configmaps-exclude"
+)
+
+// LocalRef is a parsed <name>.<namespace>.svc/pod.cluster.local address, or an IP literal
+type LocalRef struct {
+	// Kind is either "svc", "pod" or "ip"
+	Kind      string
+	Namespace string
+	// Name is the Service name (or the subdomain if Hostname is set), the Pod name, or the dashed Pod IP
+	Name string
+	// Hostname is only set for <hostname>.<subdomain>.<namespace>.svc.cluster.local addresses
+	Hostname string
+	// IP is only set for IP literals
+	IP string
+	// Port is only set if the address ends with a port, e.g db.data.svc.cluster.local:5432
+	Port int32
+}
+
 type Handler struct {
 	Client kubernetes.Interface
+	// PodIndexer is the indexer of the Pod informer with the PodIPIndex. If it's nil, Pods are looked up by IP through the API
+	PodIndexer cache.Indexer
+	// ServiceIndexer is the indexer of the Service informer with the ClusterIPIndex. If it's nil, Services are looked up by ClusterIP through the API
+	ServiceIndexer cache.Indexer
+	// ConfigMapIndexer is the indexer of the ConfigMap informer. If it's nil, the scanned ConfigMaps are fetched through the API
+	ConfigMapIndexer cache.Indexer
+	// ExternalNameCIDRs maps the hostnames of ExternalName Services to CIDRs, since there is no DNS resolution at reconcile time.
+	// A key can be an exact hostname, or a wildcard like *.rds.amazonaws.com
+	ExternalNameCIDRs map[string][]string
+	// Detectors find the dependencies of the workloads, see NewDetectors. If it's nil, only the env. vars are detected
+	Detectors []DependencyDetector
+	// IdentityLabels picks the label keys of the targets which end up in the peers. The zero value keeps every key.
+	IdentityLabels object.IdentityLabelPolicy
 }
 
 // helper function to check if []T contains T
@@ -53,13 +113,147 @@ func MapsEqual[K comparable, V comparable](a, b map[K]V) bool {
 	return true
 }
 
-// regex helper function to check whether the environment variable is a valid cluster.local env var -> <name>.<namespace>.svc/pod.cluster.local
+/*
+regex helper function to check whether the environment variable is a valid cluster.local env var -> <name>.<namespace>.svc/pod.cluster.local,
+or <hostname>.<subdomain>.<namespace>.svc.cluster.local
+*/
 func isValidLocalEnvVar(s string) bool {
-	pattern := `^[a-zA-Z0-9-]+\.[a-zA-Z0-9-]+\.pod\.cluster\.local$|^[a-zA-Z0-9-]+\.[a-zA-Z0-9-]+\.svc\.cluster\.local$`
+	pattern := `^[a-zA-Z0-9-]+\.[a-zA-Z0-9-]+\.pod\.cluster\.local$|^([a-zA-Z0-9-]+\.)?[a-zA-Z0-9-]+\.[a-zA-Z0-9-]+\.svc\.cluster\.local$`
 	matched, _ := regexp.MatchString(pattern, s)
 	return matched
 }
 
+/*
+ParseLocalRef splits a valid cluster.local address into its parts. Each form can end with a :<port>. The possible forms are:
+
+	<service>.<namespace>.svc.cluster.local
+	<hostname>.<subdomain>.<namespace>.svc.cluster.local
+	<dashed-pod-ip>.<namespace>.pod.cluster.local
+	<pod>.<namespace>.pod.cluster.local
+	<ipv4 address>
+*/
+func ParseLocalRef(s string) (LocalRef, error) {
+	addr, port := splitPort(s)
+
+	if ip := net.ParseIP(addr); ip != nil && ip.To4() != nil {
+		return LocalRef{Kind: RefKindIP, IP: ip.String(), Port: port}, nil
+	}
+
+	if !isValidLocalEnvVar(addr) {
+		return LocalRef{}, fmt.Errorf("%s is not a valid cluster.local address", s)
+	}
+
+	parts := strings.Split(strings.TrimSuffix(addr, ".cluster.local"), ".")
+	ref := LocalRef{Kind: parts[len(parts)-1], Namespace: parts[len(parts)-2], Name: parts[len(parts)-3], Port: port}
+	if len(parts) == 4 {
+		ref.Hostname = parts[0]
+	}
+	return ref, nil
+}
+
+// PodIPFromDNSLabel converts the dashed IP form of pod A records (e.g 10-244-1-7) to an IP address. It returns an empty string if the label is not an IP
+func PodIPFromDNSLabel(label string) string {
+	ip := net.ParseIP(strings.ReplaceAll(label, "-", "."))
+	if ip == nil || ip.To4() == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// PodIPIndexFunc indexes Pods by their IP addresses, so that the dashed IP form of Pod DNS names can be resolved to Pods
+func PodIPIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, nil
+	}
+
+	var ips []string
+	for _, ip := range pod.Status.PodIPs {
+		ips = appendUnique(ips, []string{ip.IP})
+	}
+	if pod.Status.PodIP != "" {
+		ips = appendUnique(ips, []string{pod.Status.PodIP})
+	}
+	return ips, nil
+}
+
+// ServiceClusterIPIndexFunc indexes Services by their ClusterIPs, so that IP literals can be resolved to Services
+func ServiceClusterIPIndexFunc(obj interface{}) ([]string, error) {
+	svc, ok := obj.(*corev1.Service)
+	if !ok {
+		return nil, nil
+	}
+
+	var ips []string
+	for _, ip := range append([]string{svc.Spec.ClusterIP}, svc.Spec.ClusterIPs...) {
+		if ip != "" && ip != corev1.ClusterIPNone {
+			ips = appendUnique(ips, []string{ip})
+		}
+	}
+	return ips, nil
+}
+
+/*
+findIPLiteral returns the IPv4 address an env. var value points at, with its port if there is one. Only the host positions are looked
+at: a bare address (10.96.12.4 or 10.96.12.4:5432), the host of a URL (postgres://user@10.96.12.4:5432/db), or either of these in a
+comma separated list. Other values which merely contain an address, e.g myapp/1.2.3.4 or v1.2.3.4-rc1, are skipped.
+It returns an empty string if there is none.
+*/
+func findIPLiteral(value string) string {
+	for _, elem := range strings.Split(value, ",") {
+		host := strings.TrimSpace(elem)
+		if strings.Contains(host, "://") {
+			u, err := url.Parse(host)
+			if err != nil {
+				continue
+			}
+			host = u.Host
+		}
+
+		addr, port := splitPort(host)
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.To4() == nil {
+			continue
+		}
+		if port != 0 {
+			return fmt.Sprintf("%s:%d", ip, port)
+		}
+		return ip.String()
+	}
+	return ""
+}
+
+// isHostnameChar reports whether r can be part of a DNS name
+func isHostnameChar(r rune) bool {
+	return r == '.' || r == '-' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
+
+/*
+findLocalRefs returns every valid cluster.local address found in a free-form text (e.g a config file), in the order of appearance.
+The text is split into DNS name candidates which are then validated the same way as environment variables are.
+*/
+func findLocalRefs(text string) []string {
+	var refs []string
+	for _, field := range strings.FieldsFunc(text, func(r rune) bool { return !isHostnameChar(r) }) {
+		field = strings.TrimSuffix(field, ".")
+		if isValidLocalEnvVar(field) && !Contains(refs, field) {
+			refs = append(refs, field)
+		}
+	}
+	return refs
+}
+
+// splitAnnotation returns the trimmed, non-empty elements of a comma separated annotation value
+func splitAnnotation(value string) []string {
+	var elems []string
+	for _, e := range strings.Split(value, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			elems = append(elems, e)
+		}
+	}
+	return elems
+}
+
 // appendUnique appends only the unique items from src to dst.
 func appendUnique(dst, src []string) []string {
 	exists := make(map[string]bool)
@@ -75,23 +269,6 @@ func appendUnique(dst, src []string) []string {
 	return dst
 }
 
-// MergeLabels merges a variadic number of labels into one
-func (h *Handler) MergeLabels(targetLabels ...map[string][]string) (map[string][]string, error) {
-	if len(targetLabels) == 0 {
-		return nil, ErrEmptyParam
-	}
-
-	mergedLabels := make(map[string][]string)
-
-	for _, target := range targetLabels {
-		for k, v := range target {
-			mergedLabels[k] = appendUnique(mergedLabels[k], v)
-		}
-	}
-
-	return mergedLabels, nil
-}
-
 // ConvertMap converts K8s object labels (map[string]string) to map[string][]string. e.g {"label":"value"} -> label: {"value"}
 func (h *Handler) ConvertLabels(targetPodLabels map[string]string) map[string][]string {
 	newMap := make(map[string][]string)
@@ -101,28 +278,84 @@ func (h *Handler) ConvertLabels(targetPodLabels map[string]string) map[string][]
 	return newMap
 }
 
-// GetLocalEnvVars fetches all env. vars with the values of <name>.<namespace>.svc/pod.cluster.local
-func (h *Handler) GetLocalEnvVars(obj metav1.Object) (map[string]string, error) {
-	var containers []corev1.Container
-	envVars := make(map[string]string)
+// podSpecOf returns the PodSpec of a Pod, or the PodSpec of the Pod template of a workload
+func podSpecOf(obj metav1.Object) (*corev1.PodSpec, error) {
+	switch obj := obj.(type) {
+	case *corev1.Pod:
+		return &obj.Spec, nil
+	case *appsv1.Deployment:
+		return &obj.Spec.Template.Spec, nil
+	case *appsv1.StatefulSet:
+		return &obj.Spec.Template.Spec, nil
+	case *appsv1.DaemonSet:
+		return &obj.Spec.Template.Spec, nil
+	case *batchv1.Job:
+		return &obj.Spec.Template.Spec, nil
+	case *batchv1.CronJob:
+		return &obj.Spec.JobTemplate.Spec.Template.Spec, nil
+	case *object.OwnedPod:
+		return &obj.Spec, nil
+	case *unstructured.Unstructured:
+		template, err := object.PodTemplate(obj)
+		if err != nil {
+			return nil, err
+		}
+		return &template.Spec, nil
+	}
+	return nil, ErrTypeNotSupported
+}
 
+// PodTemplateLabels returns the labels the Pods of the object run with: the Pod's own labels, or the labels of the workload's Pod template
+func PodTemplateLabels(obj metav1.Object) map[string]string {
 	switch obj := obj.(type) {
 	case *corev1.Pod:
-		containers = obj.Spec.Containers
+		return obj.Labels
 	case *appsv1.Deployment:
-		containers = obj.Spec.Template.Spec.Containers
+		return obj.Spec.Template.Labels
 	case *appsv1.StatefulSet:
-		containers = obj.Spec.Template.Spec.Containers
+		return obj.Spec.Template.Labels
 	case *appsv1.DaemonSet:
-		containers = obj.Spec.Template.Spec.Containers
-	default:
-		return nil, ErrTypeNotSupported
+		return obj.Spec.Template.Labels
+	case *batchv1.Job:
+		return obj.Spec.Template.Labels
+	case *batchv1.CronJob:
+		return obj.Spec.JobTemplate.Spec.Template.Labels
+	case *object.OwnedPod:
+		return obj.Labels
+	case *unstructured.Unstructured:
+		template, err := object.PodTemplate(obj)
+		if err != nil {
+			return nil
+		}
+		return template.Labels
+	}
+	return nil
+}
+
+/*
+GetLocalEnvVars fetches all env. vars containing a <name>.<namespace>.svc/pod.cluster.local address (e.g in a URL), with the address
+and its port as their value. Env. vars containing an IP literal (e.g 10.96.12.4:5432) are collected as well, since they might point
+at the ClusterIP of a Service.
+*/
+func (h *Handler) GetLocalEnvVars(obj metav1.Object) (map[string]string, error) {
+	return localEnvVars(obj)
+}
+
+// localEnvVars does the work of GetLocalEnvVars, which doesn't depend on the Handler, so that the EnvVarDetector can use it too
+func localEnvVars(obj metav1.Object) (map[string]string, error) {
+	envVars := make(map[string]string)
+
+	spec, err := podSpecOf(obj)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, container := range containers {
+	for _, container := range spec.Containers {
 		for _, envVar := range container.Env {
-			if (strings.Contains(envVar.Value, ".svc.cluster.local") || strings.Contains(envVar.Value, ".pod.cluster.local")) && isValidLocalEnvVar(envVar.Value) {
-				envVars[envVar.Name] = envVar.Value
+			if addr := findLocalAddress(envVar.Value); addr != "" {
+				envVars[envVar.Name] = addr
+			} else if ip := findIPLiteral(envVar.Value); ip != "" {
+				envVars[envVar.Name] = ip
 			}
 		}
 	}
@@ -130,9 +363,149 @@ func (h *Handler) GetLocalEnvVars(obj metav1.Object) (map[string]string, error)
 	return envVars, nil
 }
 
+/*
+mountedConfigMaps returns the ConfigMaps mounted into the PodSpec through ConfigMap or projected volumes. The value belonging to each
+ConfigMap is the list of keys that are mounted - an empty list means that every key is.
+*/
+func mountedConfigMaps(spec *corev1.PodSpec) map[string][]string {
+	cms := make(map[string][]string)
+
+	add := func(name string, items []corev1.KeyToPath) {
+		keys, ok := cms[name]
+		if ok && len(keys) == 0 {
+			return
+		}
+		if len(items) == 0 {
+			cms[name] = []string{}
+			return
+		}
+		for _, item := range items {
+			keys = appendUnique(keys, []string{item.Key})
+		}
+		cms[name] = keys
+	}
+
+	for _, v := range spec.Volumes {
+		if v.ConfigMap != nil {
+			add(v.ConfigMap.Name, v.ConfigMap.Items)
+		}
+		if v.Projected != nil {
+			for _, src := range v.Projected.Sources {
+				if src.ConfigMap != nil {
+					add(src.ConfigMap.Name, src.ConfigMap.Items)
+				}
+			}
+		}
+	}
+	return cms
+}
+
+/*
+configMapRefs scans the ConfigMaps mounted into the object's Pods for <name>.<namespace>.svc/pod.cluster.local addresses, which is
+useful for apps that read their upstreams from a config file (nginx.conf, application.yaml...). The ConfigMaps listed in the
+ConfigMapIncludeAnnotation are scanned as well, while the ones in ConfigMapExcludeAnnotation are skipped.
+The keys of the returned map are in the form of configmap/<configmap name>/<key>#<index>.
+*/
+func configMapRefs(view ClusterView, obj metav1.Object) (map[string]string, error) {
+	refs := make(map[string]string)
+
+	spec, err := podSpecOf(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	for name, keys := range scannedConfigMaps(obj, spec) {
+		cm, err := getConfigMap(view, obj.GetNamespace(), name)
+		if err != nil {
+			if errors.Is(err, ErrResourceNotFound) {
+				continue
+			}
+			return nil, err
+		}
+
+		for key, data := range cm.Data {
+			if len(keys) > 0 && !Contains(keys, key) {
+				continue
+			}
+			for i, ref := range findLocalRefs(data) {
+				refs[fmt.Sprintf("configmap/%s/%s#%d", name, key, i)] = ref
+			}
+		}
+	}
+
+	return refs, nil
+}
+
+// scannedConfigMaps returns the ConfigMaps mounted into the PodSpec and the ones included by the annotations, without the excluded ones
+func scannedConfigMaps(obj metav1.Object, spec *corev1.PodSpec) map[string][]string {
+	cms := mountedConfigMaps(spec)
+	for _, name := range splitAnnotation(obj.GetAnnotations()[ConfigMapIncludeAnnotation]) {
+		cms[name] = []string{}
+	}
+	for _, name := range splitAnnotation(obj.GetAnnotations()[ConfigMapExcludeAnnotation]) {
+		delete(cms, name)
+	}
+	return cms
+}
+
+/*
+getConfigMap returns the ConfigMap from the ConfigMapIndexer of the view if there is one, otherwise it fetches it through the API.
+It returns ErrResourceNotFound if the ConfigMap does not exist.
+*/
+func getConfigMap(view ClusterView, namespace string, name string) (*corev1.ConfigMap, error) {
+	if view.ConfigMapIndexer != nil {
+		obj, exists, err := view.ConfigMapIndexer.GetByKey(namespace + "/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("could not look up configmap %s. %w", name, err)
+		}
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !exists || !ok {
+			return nil, ErrResourceNotFound
+		}
+		return cm, nil
+	}
+
+	cm, err := view.Client.CoreV1().ConfigMaps(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, ErrResourceNotFound
+		}
+		return nil, fmt.Errorf("could not fetch configmap %s. %w", name, err)
+	}
+	return cm, nil
+}
+
+/*
+WatchedConfigMaps returns the names of the ConfigMaps the dependencies of the object are read from, ordered by name, so that the
+changes of these ConfigMaps can be followed. It's empty if the ConfigMaps are not scanned.
+*/
+func (h *Handler) WatchedConfigMaps(obj metav1.Object) []string {
+	spec, err := podSpecOf(obj)
+	if err != nil {
+		return nil
+	}
+
+	scanned := false
+	for _, d := range h.detectors() {
+		scanned = scanned || d.Name() == ConfigMapDetectorName
+	}
+	if !scanned {
+		return nil
+	}
+
+	var names []string
+	for name := range scannedConfigMaps(obj, spec) {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 /*
 GetLabelsFromEnvVars takes in the environment variables containing "<name>.<namespace>.svc.cluster.local" and "<name>.<namespace>.pod.cluster.local". Then for PODs, it returns
 all the labels it has and for services it looks at the .spec.Selector (which are esentially the POD labels it targets) and returns those.
+Pod addresses in the dashed IP form (10-244-1-7.<namespace>.pod.cluster.local) are resolved through the Pod IPs, and
+<hostname>.<subdomain>.<namespace>.svc.cluster.local addresses through the headless Service to the Pod with that hostname.
 It returns a map[string][]string because it can happen that two pods have the same label keys with different values.
 
 	e.g	{
@@ -142,45 +515,303 @@ It returns a map[string][]string because it can happen that two pods have the sa
 		}
 */
 func (h *Handler) GetLabelsFromEnvVars(envVars map[string]string) (map[string][]string, error) {
+	targets, pending, err := h.ResolveEnvVarTargets(envVars)
+	if err != nil {
+		return nil, err
+	}
+	if len(pending) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrResourceNotFound, pending[0])
+	}
+
 	labels := make(map[string][]string)
+	for _, t := range targets {
+		for k, v := range t.Labels {
+			labels[k] = append(labels[k], v...)
+		}
+	}
+	return labels, nil
+}
+
+/*
+ResolveEnvVarTargets resolves every cluster.local address of the env. vars separately, together with the ports the Pods behind
+it can be reached on. The addresses pointing at objects which don't exist (yet) are returned sorted as pending.
+*/
+func (h *Handler) ResolveEnvVarTargets(envVars map[string]string) ([]Target, []string, error) {
+	var targets []Target
+	var pending []string
 
 	if len(envVars) == 0 {
-		return nil, ErrNoEnvVars
+		return nil, nil, ErrNoEnvVars
 	}
 
-	for _, v := range envVars {
-		name := strings.Split(v, ".")[0]
-		namespace := strings.Split(v, ".")[1]
+	keys := make([]string, 0, len(envVars))
+	for k := range envVars {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 
-		switch strings.Contains(v, ".pod.cluster.local") {
-		case true:
-			pod, err := h.Client.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
-			if err != nil {
-				if k8serrors.IsNotFound(err) {
-					return nil, ErrResourceNotFound
-				}
-				return nil, fmt.Errorf("could not fetch pod %s. %w", name, err)
+	for _, k := range keys {
+		v := envVars[k]
+		ref, err := ParseLocalRef(v)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		refLabels, err := h.resolveLocalRef(ref)
+		if err != nil {
+			if errors.Is(err, ErrResourceNotFound) {
+				pending = appendUnique(pending, []string{v})
+				continue
 			}
-			for k, v := range pod.ObjectMeta.Labels {
-				labels[k] = append(labels[k], v)
+			return nil, nil, err
+		}
+		if len(refLabels) == 0 {
+			continue
+		}
+
+		ports, err := h.resolvePorts(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		namespace, err := h.refNamespace(ref)
+		if err != nil {
+			return nil, nil, err
+		}
+		targets = append(targets, Target{Namespace: namespace, Labels: refLabels, Ports: ports})
+	}
+
+	sort.Strings(pending)
+	return targets, pending, nil
+}
+
+// refNamespace returns the namespace of the Pods a cluster.local address points to. IP literals are in the namespace of their Service.
+func (h *Handler) refNamespace(ref LocalRef) (string, error) {
+	if ref.Kind != RefKindIP {
+		return ref.Namespace, nil
+	}
+	svc, err := h.getSvcByClusterIP(ref.IP)
+	if err != nil {
+		return "", err
+	}
+	return svc.Namespace, nil
+}
+
+// identityLabels returns the identity labels of the target labels, by the same rule as object.IdentityLabelPolicy.Labels
+func (h *Handler) identityLabels(labels map[string][]string) map[string][]string {
+	identity := make(map[string][]string, len(labels))
+	for k, v := range labels {
+		if h.IdentityLabels.IsIdentityLabel(k) {
+			identity[k] = v
+		}
+	}
+	if len(identity) == 0 {
+		return labels
+	}
+	return identity
+}
+
+// resolveLocalRef returns the identity labels of the Pods a cluster.local address points to
+func (h *Handler) resolveLocalRef(ref LocalRef) (map[string][]string, error) {
+	labels, err := h.resolveLocalRefLabels(ref)
+	if err != nil {
+		return nil, err
+	}
+	return h.identityLabels(labels), nil
+}
+
+// resolveLocalRefLabels returns every label of the Pods a cluster.local address points to
+func (h *Handler) resolveLocalRefLabels(ref LocalRef) (map[string][]string, error) {
+	switch {
+	case ref.Kind == RefKindPod:
+		pod, err := h.getPodFromRef(ref)
+		if err != nil {
+			return nil, err
+		}
+		return h.ConvertLabels(pod.Labels), nil
+	case ref.Kind == RefKindIP:
+		svc, err := h.getSvcByClusterIP(ref.IP)
+		if err != nil {
+			// not every IP literal is a ClusterIP, these are simply not part of the policy
+			if errors.Is(err, ErrResourceNotFound) {
+				return map[string][]string{}, nil
 			}
-		default:
-			svcLabels, err := h.getLabelsFromSvc(name, namespace)
-			if err != nil {
-				return nil, err
+			return nil, err
+		}
+		return h.getLabelsFromSvc(svc.Name, svc.Namespace)
+	case ref.Hostname != "":
+		pod, err := h.getPodByHostname(ref.Hostname, ref.Name, ref.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		return h.ConvertLabels(pod.Labels), nil
+	default:
+		return h.getLabelsFromSvc(ref.Name, ref.Namespace)
+	}
+}
+
+/*
+getSvcByClusterIP returns the Service that has the given ClusterIP. It uses the ClusterIPIndex of the Service informer if
+there is one, otherwise it lists the Services of every namespace.
+*/
+func (h *Handler) getSvcByClusterIP(ip string) (*corev1.Service, error) {
+	if h.ServiceIndexer != nil {
+		objs, err := h.ServiceIndexer.ByIndex(ClusterIPIndex, ip)
+		if err != nil {
+			return nil, fmt.Errorf("could not look up svc by clusterip %s. %w", ip, err)
+		}
+		for _, obj := range objs {
+			if svc, ok := obj.(*corev1.Service); ok {
+				return svc, nil
 			}
-			for k, v := range svcLabels {
-				labels[k] = append(labels[k], v)
+		}
+		return nil, ErrResourceNotFound
+	}
+
+	svcs, err := h.Client.CoreV1().Services(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("could not list services. %w", err)
+	}
+	for i := range svcs.Items {
+		if ips, _ := ServiceClusterIPIndexFunc(&svcs.Items[i]); Contains(ips, ip) {
+			return &svcs.Items[i], nil
+		}
+	}
+	return nil, ErrResourceNotFound
+}
+
+// getPodFromRef returns the Pod of a <dashed-pod-ip>.<namespace>.pod.cluster.local or <pod>.<namespace>.pod.cluster.local address
+func (h *Handler) getPodFromRef(ref LocalRef) (*corev1.Pod, error) {
+	if ip := PodIPFromDNSLabel(ref.Name); ip != "" {
+		return h.getPodByIP(ip, ref.Namespace)
+	}
+
+	pod, err := h.Client.CoreV1().Pods(ref.Namespace).Get(context.Background(), ref.Name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, ErrResourceNotFound
+		}
+		return nil, fmt.Errorf("could not fetch pod %s. %w", ref.Name, err)
+	}
+	return pod, nil
+}
+
+/*
+getPod returns the Pod from the PodIndexer if there is one, otherwise it fetches it through the API. It returns ErrResourceNotFound
+if the Pod does not exist.
+*/
+func (h *Handler) getPod(namespace string, name string) (*corev1.Pod, error) {
+	if h.PodIndexer != nil {
+		obj, exists, err := h.PodIndexer.GetByKey(namespace + "/" + name)
+		if err != nil {
+			return nil, fmt.Errorf("could not look up pod %s. %w", name, err)
+		}
+		pod, ok := obj.(*corev1.Pod)
+		if !exists || !ok {
+			return nil, ErrResourceNotFound
+		}
+		return pod, nil
+	}
+
+	pod, err := h.Client.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, ErrResourceNotFound
+		}
+		return nil, fmt.Errorf("could not fetch pod %s. %w", name, err)
+	}
+	return pod, nil
+}
+
+/*
+getPodByIP returns the running Pod of the namespace which has the given IP. It uses the PodIPIndex of the Pod informer if
+there is one, otherwise it lists the Pods of the namespace.
+*/
+func (h *Handler) getPodByIP(ip string, namespace string) (*corev1.Pod, error) {
+	var candidates []*corev1.Pod
+
+	if h.PodIndexer != nil {
+		objs, err := h.PodIndexer.ByIndex(PodIPIndex, ip)
+		if err != nil {
+			return nil, fmt.Errorf("could not look up pod by ip %s. %w", ip, err)
+		}
+		for _, obj := range objs {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				candidates = append(candidates, pod)
+			}
+		}
+	} else {
+		pods, err := h.Client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("could not list pods in %s. %w", namespace, err)
+		}
+		for i := range pods.Items {
+			if ips, _ := PodIPIndexFunc(&pods.Items[i]); Contains(ips, ip) {
+				candidates = append(candidates, &pods.Items[i])
 			}
 		}
 	}
 
-	return labels, nil
+	for _, pod := range candidates {
+		// IPs of finished Pods can already be reused by other Pods
+		if pod.Namespace == namespace && pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			return pod, nil
+		}
+	}
+	return nil, ErrResourceNotFound
 }
 
-// GetLabelsFromSvc returns all the POD selectors a Service has
-func (h *Handler) getLabelsFromSvc(name string, namespace string) (map[string]string, error) {
-	labels := map[string]string{}
+/*
+getPodByHostname resolves a <hostname>.<subdomain>.<namespace>.svc.cluster.local address (e.g web-0.web-headless.default.svc.cluster.local)
+through the headless Service called <subdomain> to the Pod whose hostname and subdomain match, like StatefulSet Pods. The Pods of
+the Service are looked up in the PodIndexer if there is one, otherwise through the API. A Service without a selector has no Pods
+to look up.
+*/
+func (h *Handler) getPodByHostname(hostname string, subdomain string, namespace string) (*corev1.Pod, error) {
+	svc, err := h.getSvc(subdomain, namespace)
+	if err != nil {
+		return nil, err
+	}
+	if len(svc.Spec.Selector) == 0 {
+		return nil, ErrResourceNotFound
+	}
+	selector := labels.SelectorFromSet(svc.Spec.Selector)
+	matches := func(pod *corev1.Pod) bool {
+		return pod.Spec.Hostname == hostname && pod.Spec.Subdomain == subdomain
+	}
+
+	if h.PodIndexer != nil {
+		var found *corev1.Pod
+		err := cache.ListAllByNamespace(h.PodIndexer, namespace, selector, func(obj interface{}) {
+			if pod, ok := obj.(*corev1.Pod); ok && found == nil && matches(pod) {
+				found = pod
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not look up pods of svc %s. %w", subdomain, err)
+		}
+		if found == nil {
+			return nil, ErrResourceNotFound
+		}
+		return found, nil
+	}
+
+	pods, err := h.Client.CoreV1().Pods(namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: selector.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list pods of svc %s. %w", subdomain, err)
+	}
+
+	for i := range pods.Items {
+		if matches(&pods.Items[i]) {
+			return &pods.Items[i], nil
+		}
+	}
+	return nil, ErrResourceNotFound
+}
+
+// getSvc fetches a Service. It returns ErrResourceNotFound if the Service does not exist
+func (h *Handler) getSvc(name string, namespace string) (*corev1.Service, error) {
 	svc, err := h.Client.CoreV1().Services(namespace).Get(context.Background(), name, metav1.GetOptions{})
 	if err != nil {
 		if k8serrors.IsNotFound(err) {
@@ -188,13 +819,194 @@ func (h *Handler) getLabelsFromSvc(name string, namespace string) (map[string]st
 		}
 		return nil, fmt.Errorf("could not fetch svc %s. %w", name, err)
 	}
-	for k, v := range svc.Spec.Selector {
-		labels[k] = v
+	return svc, nil
+}
+
+/*
+GetLabelsFromSvc returns all the POD selectors a Service has. Services without a selector are resolved through their EndpointSlices
+to the labels of the Pods they point at. ExternalName Services have no Pods behind them, unless the external name is another
+cluster.local Service address.
+*/
+func (h *Handler) getLabelsFromSvc(name string, namespace string) (map[string][]string, error) {
+	svc, err := h.getSvc(name, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	if svc.Spec.Type == corev1.ServiceTypeExternalName {
+		return h.getLabelsFromExternalName(svc)
+	}
+
+	if len(svc.Spec.Selector) > 0 {
+		return h.ConvertLabels(svc.Spec.Selector), nil
+	}
+
+	labels, cidrs, err := h.getEndpointSliceTargets(svc)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(labels) == 0 {
+	if len(labels) == 0 && len(cidrs) == 0 {
 		return nil, ErrResourceNotFound
 	}
 
 	return labels, nil
 }
+
+// getLabelsFromExternalName returns the Pod labels behind an ExternalName Service which points at another cluster.local Service
+func (h *Handler) getLabelsFromExternalName(svc *corev1.Service) (map[string][]string, error) {
+	externalName := strings.TrimSuffix(svc.Spec.ExternalName, ".")
+	if !isValidLocalEnvVar(externalName) {
+		return map[string][]string{}, nil
+	}
+
+	ref, err := ParseLocalRef(externalName)
+	if err != nil {
+		return nil, err
+	}
+	// chains of ExternalName Services are not followed, so that they can't end up in a loop
+	if ref.Kind == RefKindSvc && ref.Hostname == "" {
+		target, err := h.getSvc(ref.Name, ref.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if target.Spec.Type == corev1.ServiceTypeExternalName {
+			return nil, fmt.Errorf("externalname svc %s points at another externalname svc %s", svc.Name, target.Name)
+		}
+	}
+	return h.resolveLocalRef(ref)
+}
+
+/*
+getExternalNameCIDRs returns the CIDRs an ExternalName Service points at. An IP external name becomes a single address CIDR,
+while hostnames are looked up in ExternalNameCIDRs - exact matches first, then the longest matching wildcard.
+*/
+func (h *Handler) getExternalNameCIDRs(svc *corev1.Service) []string {
+	externalName := strings.TrimSuffix(strings.ToLower(svc.Spec.ExternalName), ".")
+	if cidr := addressToCIDR(externalName); cidr != "" {
+		return []string{cidr}
+	}
+	if isValidLocalEnvVar(externalName) {
+		return nil
+	}
+
+	if cidrs, ok := h.ExternalNameCIDRs[externalName]; ok {
+		return cidrs
+	}
+
+	var match string
+	for pattern := range h.ExternalNameCIDRs {
+		suffix := strings.TrimPrefix(pattern, "*")
+		if strings.HasPrefix(pattern, "*.") && strings.HasSuffix(externalName, suffix) && len(pattern) > len(match) {
+			match = pattern
+		}
+	}
+	if match == "" {
+		log.Printf("no CIDR mapping for the external name %s of svc %s \n", externalName, svc.Name)
+		return nil
+	}
+	return h.ExternalNameCIDRs[match]
+}
+
+// addressToCIDR converts an endpoint IP address to a single address CIDR. It returns an empty string if the address is not an IP
+func addressToCIDR(address string) string {
+	ip := net.ParseIP(address)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return ip.String() + "/32"
+	default:
+		return ip.String() + "/128"
+	}
+}
+
+/*
+getEndpointSliceTargets goes through the EndpointSlices of a Service, and returns the labels of the Pods the endpoints refer to,
+and the CIDRs of the bare endpoint addresses which don't belong to a Pod (e.g external IPs)
+*/
+func (h *Handler) getEndpointSliceTargets(svc *corev1.Service) (map[string][]string, []string, error) {
+	labels := make(map[string][]string)
+	var cidrs []string
+
+	slices, err := h.Client.DiscoveryV1().EndpointSlices(svc.Namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: fmt.Sprintf("%s=%s", discoveryv1.LabelServiceName, svc.Name),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not list endpointslices of svc %s. %w", svc.Name, err)
+	}
+
+	for _, slice := range slices.Items {
+		for _, ep := range slice.Endpoints {
+			if ep.TargetRef != nil && ep.TargetRef.Kind == "Pod" {
+				namespace := ep.TargetRef.Namespace
+				if namespace == "" {
+					namespace = svc.Namespace
+				}
+
+				pod, err := h.getPod(namespace, ep.TargetRef.Name)
+				if err != nil {
+					if errors.Is(err, ErrResourceNotFound) {
+						continue
+					}
+					return nil, nil, err
+				}
+				for k, v := range pod.Labels {
+					labels[k] = appendUnique(labels[k], []string{v})
+				}
+				continue
+			}
+
+			for _, addr := range ep.Addresses {
+				if cidr := addressToCIDR(addr); cidr != "" {
+					cidrs = appendUnique(cidrs, []string{cidr})
+				}
+			}
+		}
+	}
+
+	return labels, cidrs, nil
+}
+
+/*
+GetIPBlocksFromEnvVars returns the CIDRs the cluster.local environment variables point at, which can't be selected by Pod labels.
+These are the bare addresses of the EndpointSlices belonging to Services without selectors, and the addresses of ExternalName Services.
+Services that don't exist are skipped.
+*/
+func (h *Handler) GetIPBlocksFromEnvVars(envVars map[string]string) ([]string, error) {
+	var cidrs []string
+
+	for _, v := range envVars {
+		ref, err := ParseLocalRef(v)
+		if err != nil {
+			return nil, err
+		}
+		if ref.Kind != RefKindSvc || ref.Hostname != "" {
+			continue
+		}
+
+		svc, err := h.getSvc(ref.Name, ref.Namespace)
+		if err != nil {
+			if errors.Is(err, ErrResourceNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		if svc.Spec.Type == corev1.ServiceTypeExternalName {
+			cidrs = appendUnique(cidrs, h.getExternalNameCIDRs(svc))
+			continue
+		}
+		if len(svc.Spec.Selector) > 0 {
+			continue
+		}
+
+		_, svcCIDRs, err := h.getEndpointSliceTargets(svc)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = appendUnique(cidrs, svcCIDRs)
+	}
+
+	sort.Strings(cidrs)
+	return cidrs, nil
+}
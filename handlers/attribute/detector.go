@@ -0,0 +1,209 @@
+package attribute
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// the names of the built-in detectors, which switch them on or off in the options
+const (
+	EnvVarDetectorName    = "envVars"
+	ConfigMapDetectorName = "configMaps"
+)
+
+var (
+	ErrUnknownDetector = errors.New("unknown dependency detector")
+	ErrInvalidDetector = errors.New("invalid dependency detector")
+)
+
+// _detectors holds the detectors which can be switched on by name, the built-in ones and the ones added with RegisterDetector
+var (
+	_detectorsMu sync.RWMutex
+	_detectors   = map[string]DependencyDetector{
+		EnvVarDetectorName:    EnvVarDetector{},
+		ConfigMapDetectorName: ConfigMapDetector{},
+	}
+)
+
+// Reference is a dependency of a workload found by a DependencyDetector, together with where it was found
+type Reference struct {
+	// Ref is the parsed address
+	Ref LocalRef
+	// Address is the cluster.local address or IP literal the workload sends traffic to, with its port if it's known
+	Address string
+	// Detector is the name of the detector which found the reference
+	Detector string
+	// Source is where the detector found the reference, e.g the name of an env. var. It's unique among the references of a detector.
+	Source string
+}
+
+// NewReference parses the address a detector found in the source
+func NewReference(detector string, source string, address string) (Reference, error) {
+	ref, err := ParseLocalRef(address)
+	if err != nil {
+		return Reference{}, err
+	}
+	return Reference{Ref: ref, Address: address, Detector: detector, Source: source}, nil
+}
+
+// Key returns the key of the reference among the references of a workload, e.g envVars/DATABASE_URL
+func (r Reference) Key() string {
+	return r.Detector + "/" + r.Source
+}
+
+// ClusterView is what the detectors can look up in the cluster
+type ClusterView struct {
+	Client kubernetes.Interface
+	// PodIndexer, ServiceIndexer and ConfigMapIndexer are the indexers of the informers, they might be nil
+	PodIndexer       cache.Indexer
+	ServiceIndexer   cache.Indexer
+	ConfigMapIndexer cache.Indexer
+}
+
+/*
+DependencyDetector finds the dependencies of a workload, e.g in its env. vars or in a service catalog. The detectors are switched
+on by their names in the options, the custom ones have to be added with RegisterDetector before the controller starts.
+*/
+type DependencyDetector interface {
+	// Name is the name of the detector in the options and in the references it returns
+	Name() string
+	// Detect returns the references of the workload. The workload is a Pod, a built-in workload or a custom one.
+	Detect(obj metav1.Object, view ClusterView) ([]Reference, error)
+}
+
+// EnvVarDetector finds the cluster.local addresses and IP literals in the env. vars of the workload's containers
+type EnvVarDetector struct{}
+
+func (EnvVarDetector) Name() string {
+	return EnvVarDetectorName
+}
+
+func (d EnvVarDetector) Detect(obj metav1.Object, _ ClusterView) ([]Reference, error) {
+	envVars, err := localEnvVars(obj)
+	if err != nil {
+		return nil, err
+	}
+	return newReferences(d.Name(), envVars), nil
+}
+
+// ConfigMapDetector finds the cluster.local addresses in the ConfigMaps mounted into the workload's Pods, see configMapRefs
+type ConfigMapDetector struct{}
+
+func (ConfigMapDetector) Name() string {
+	return ConfigMapDetectorName
+}
+
+func (d ConfigMapDetector) Detect(obj metav1.Object, view ClusterView) ([]Reference, error) {
+	refs, err := configMapRefs(view, obj)
+	if err != nil {
+		return nil, err
+	}
+	return newReferences(d.Name(), refs), nil
+}
+
+// newReferences turns the addresses found by a built-in detector, keyed by their sources, into references
+func newReferences(detector string, addresses map[string]string) []Reference {
+	refs := make([]Reference, 0, len(addresses))
+	for source, address := range addresses {
+		ref, err := NewReference(detector, source, address)
+		if err != nil {
+			continue
+		}
+		refs = append(refs, ref)
+	}
+	return refs
+}
+
+// RegisterDetector makes a custom detector available to be switched on in the options
+func RegisterDetector(d DependencyDetector) error {
+	if d == nil || d.Name() == "" {
+		return fmt.Errorf("%w: the detector needs a name", ErrInvalidDetector)
+	}
+
+	_detectorsMu.Lock()
+	defer _detectorsMu.Unlock()
+	if _, ok := _detectors[d.Name()]; ok {
+		return fmt.Errorf("%w: %q is registered already", ErrInvalidDetector, d.Name())
+	}
+	_detectors[d.Name()] = d
+	return nil
+}
+
+// NewDetectors returns the detectors switched on in enabled, ordered by their names
+func NewDetectors(enabled map[string]bool) ([]DependencyDetector, error) {
+	_detectorsMu.RLock()
+	defer _detectorsMu.RUnlock()
+
+	names := make([]string, 0, len(enabled))
+	for name, on := range enabled {
+		if _, ok := _detectors[name]; !ok {
+			return nil, fmt.Errorf("%w: %q", ErrUnknownDetector, name)
+		}
+		if on {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	detectors := make([]DependencyDetector, 0, len(names))
+	for _, name := range names {
+		detectors = append(detectors, _detectors[name])
+	}
+	return detectors, nil
+}
+
+// view returns what the detectors of the handler can look up in the cluster
+func (h *Handler) view() ClusterView {
+	return ClusterView{Client: h.Client, PodIndexer: h.PodIndexer, ServiceIndexer: h.ServiceIndexer, ConfigMapIndexer: h.ConfigMapIndexer}
+}
+
+// detectors returns the detectors of the handler. Without any, only the env. var detector is built by NewDetectors.
+func (h *Handler) detectors() []DependencyDetector {
+	if h.Detectors != nil {
+		return h.Detectors
+	}
+	// the env. var detector is built in, so it's never unknown
+	detectors, _ := NewDetectors(map[string]bool{EnvVarDetectorName: true})
+	return detectors
+}
+
+/*
+DetectReferences runs every detector of the handler on the object, and returns the references they found ordered by their keys.
+The references with an address that can't be parsed are skipped, so that a faulty detector can't block the policies.
+*/
+func (h *Handler) DetectReferences(obj metav1.Object) ([]Reference, error) {
+	if _, err := podSpecOf(obj); err != nil {
+		return nil, err
+	}
+	view := h.view()
+
+	var refs []Reference
+	for _, d := range h.detectors() {
+		found, err := d.Detect(obj, view)
+		if err != nil {
+			return nil, fmt.Errorf("detector %s failed on %s. %w", d.Name(), obj.GetName(), err)
+		}
+
+		for _, ref := range found {
+			parsed, err := NewReference(d.Name(), ref.Source, ref.Address)
+			if err != nil {
+				log.Printf("detector %s found an invalid reference in %s of %s: %v \n", d.Name(), ref.Source, obj.GetName(), err)
+				continue
+			}
+			if parsed.Source == "" {
+				parsed.Source = parsed.Address
+			}
+			refs = append(refs, parsed)
+		}
+	}
+
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Key() < refs[j].Key() })
+	return refs, nil
+}
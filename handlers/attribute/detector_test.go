@@ -0,0 +1,200 @@
+package attribute
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// catalogDetector stands in for a custom detector, e.g one reading a service catalog
+type catalogDetector struct {
+	refs []Reference
+	err  error
+}
+
+func (catalogDetector) Name() string {
+	return "catalog"
+}
+
+func (d catalogDetector) Detect(_ metav1.Object, _ ClusterView) ([]Reference, error) {
+	return d.refs, d.err
+}
+
+func TestDetectReferences(t *testing.T) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Env: []corev1.EnvVar{{Name: "DB_URL", Value: "postgres://db.data.svc.cluster.local:5432/app"}}}},
+			Volumes: []corev1.Volume{{VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: "app-config"},
+			}}}},
+		},
+	}
+	c := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "app-config", Namespace: "default"},
+		Data:       map[string]string{"upstreams": "cache.data.svc.cluster.local"},
+	})
+
+	testCases := []struct {
+		name     string
+		handler  *Handler
+		obj      metav1.Object
+		expected []string
+		testErr  func(t *testing.T, err error)
+	}{
+		{
+			name:     "OK - env. vars by default",
+			handler:  &Handler{Client: c},
+			obj:      pod,
+			expected: []string{"envVars/DB_URL"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:     "OK - ConfigMaps with the ConfigMap detector",
+			handler:  &Handler{Client: c, Detectors: []DependencyDetector{ConfigMapDetector{}, EnvVarDetector{}}},
+			obj:      pod,
+			expected: []string{"configMaps/configmap/app-config/upstreams#0", "envVars/DB_URL"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "OK - custom detector only, the invalid references are skipped",
+			handler: &Handler{Client: c, Detectors: []DependencyDetector{catalogDetector{refs: []Reference{
+				{Address: "payments.billing.svc.cluster.local:8080", Source: "payments"},
+				{Address: "not an address", Source: "broken"},
+			}}}},
+			obj:      pod,
+			expected: []string{"catalog/payments"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:     "OK - no detectors",
+			handler:  &Handler{Client: c, Detectors: []DependencyDetector{}},
+			obj:      pod,
+			expected: []string{},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:    "fails - detector error",
+			handler: &Handler{Client: c, Detectors: []DependencyDetector{catalogDetector{err: errors.New("catalog is down")}}},
+			obj:     pod,
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorContains(t, err, "catalog is down")
+			},
+		},
+		{
+			name:    "fails - not a workload",
+			handler: &Handler{Client: c},
+			obj:     &corev1.Service{},
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrTypeNotSupported)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			refs, err := tc.handler.DetectReferences(tc.obj)
+			tc.testErr(t, err)
+			if err != nil {
+				return
+			}
+			keys := []string{}
+			for _, ref := range refs {
+				keys = append(keys, ref.Key())
+			}
+			assert.Equal(t, tc.expected, keys)
+		})
+	}
+}
+
+func TestDetectReferencesProvenance(t *testing.T) {
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"}}
+	// the detector can't claim the references of another one
+	h := &Handler{Detectors: []DependencyDetector{catalogDetector{refs: []Reference{
+		{Address: "payments.billing.svc.cluster.local:8080", Detector: "envVars"},
+	}}}}
+
+	refs, err := h.DetectReferences(pod)
+	assert.NoError(t, err)
+	assert.Len(t, refs, 1)
+	assert.Equal(t, "catalog", refs[0].Detector)
+	assert.Equal(t, "payments.billing.svc.cluster.local:8080", refs[0].Source)
+	assert.Equal(t, LocalRef{Kind: RefKindSvc, Name: "payments", Namespace: "billing", Port: 8080}, refs[0].Ref)
+}
+
+func TestNewDetectors(t *testing.T) {
+	testCases := []struct {
+		name     string
+		enabled  map[string]bool
+		expected []string
+		testErr  func(t *testing.T, err error)
+	}{
+		{
+			name:     "OK - switched on detectors ordered by name",
+			enabled:  map[string]bool{EnvVarDetectorName: true, ConfigMapDetectorName: true},
+			expected: []string{ConfigMapDetectorName, EnvVarDetectorName},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:     "OK - switched off detector",
+			enabled:  map[string]bool{EnvVarDetectorName: false, ConfigMapDetectorName: true},
+			expected: []string{ConfigMapDetectorName},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:    "fails - unknown detector",
+			enabled: map[string]bool{"catalog": true},
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrUnknownDetector)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			detectors, err := NewDetectors(tc.enabled)
+			tc.testErr(t, err)
+			if err != nil {
+				return
+			}
+			names := []string{}
+			for _, d := range detectors {
+				names = append(names, d.Name())
+			}
+			assert.Equal(t, tc.expected, names)
+		})
+	}
+}
+
+func TestRegisterDetector(t *testing.T) {
+	t.Cleanup(func() {
+		_detectorsMu.Lock()
+		delete(_detectors, "catalog")
+		_detectorsMu.Unlock()
+	})
+
+	assert.NoError(t, RegisterDetector(catalogDetector{}))
+	assert.ErrorIs(t, RegisterDetector(catalogDetector{}), ErrInvalidDetector)
+	assert.ErrorIs(t, RegisterDetector(EnvVarDetector{}), ErrInvalidDetector)
+	assert.ErrorIs(t, RegisterDetector(nil), ErrInvalidDetector)
+
+	detectors, err := NewDetectors(map[string]bool{"catalog": true})
+	assert.NoError(t, err)
+	assert.Equal(t, []DependencyDetector{catalogDetector{}}, detectors)
+}
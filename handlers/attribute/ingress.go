@@ -0,0 +1,190 @@
+package attribute
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// IngressPortsAnnotation replaces the detected ingress ports of a workload, e.g "8080, 5353/udp". "*" allows every port.
+	IngressPortsAnnotation = "netpol-ctrl.io/ingress-ports"
+	// IngressPortsExtraAnnotation adds ports to the detected ingress ports of a workload, e.g "9090"
+	IngressPortsExtraAnnotation = "netpol-ctrl.io/ingress-ports-extra"
+)
+
+// _protocols are the accepted protocols of the ingress port annotation entries
+var _protocols = map[string]corev1.Protocol{
+	"tcp":  corev1.ProtocolTCP,
+	"udp":  corev1.ProtocolUDP,
+	"sctp": corev1.ProtocolSCTP,
+}
+
+// ParsePort parses a <port> or <port>/<protocol> annotation entry. The protocol defaults to TCP.
+func ParsePort(entry string) (TargetPort, error) {
+	portStr, protoStr, hasProto := strings.Cut(entry, "/")
+
+	port, err := strconv.ParseInt(portStr, 10, 32)
+	if err != nil || port < 1 || port > 65535 {
+		return TargetPort{}, fmt.Errorf("%w: %q is not a valid port", ErrMalformedEntry, entry)
+	}
+
+	protocol := corev1.ProtocolTCP
+	if hasProto {
+		p, ok := _protocols[strings.ToLower(protoStr)]
+		if !ok {
+			return TargetPort{}, fmt.Errorf("%w: %q has an unknown protocol", ErrMalformedEntry, entry)
+		}
+		protocol = p
+	}
+	return TargetPort{Port: int32(port), Protocol: protocol}, nil
+}
+
+// parsePorts parses the entries of an ingress port annotation. Malformed entries are skipped, and returned as warnings.
+func parsePorts(obj metav1.Object, annotation string) ([]TargetPort, []string) {
+	var ports []TargetPort
+	var warnings []string
+
+	for _, entry := range splitAnnotation(obj.GetAnnotations()[annotation]) {
+		port, err := ParsePort(entry)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("%s: %v", annotation, err))
+			continue
+		}
+		ports = appendUniquePorts(ports, []TargetPort{port})
+	}
+	return ports, warnings
+}
+
+// containerPorts returns the ports declared by the containers of the PodSpec
+func containerPorts(spec *corev1.PodSpec) []TargetPort {
+	var ports []TargetPort
+	for _, c := range spec.Containers {
+		for _, cp := range c.Ports {
+			protocol := cp.Protocol
+			if protocol == "" {
+				protocol = corev1.ProtocolTCP
+			}
+			ports = appendUniquePorts(ports, []TargetPort{{Port: cp.ContainerPort, Protocol: protocol}})
+		}
+	}
+	return ports
+}
+
+// ContainerPorts returns the ports declared by the containers of the object's Pods
+func ContainerPorts(obj metav1.Object) []TargetPort {
+	spec, err := podSpecOf(obj)
+	if err != nil {
+		return nil
+	}
+	return containerPorts(spec)
+}
+
+// namedContainerPort returns the container port of the PodSpec with the given name and protocol, or 0 if there is none
+func namedContainerPort(spec *corev1.PodSpec, name string, protocol corev1.Protocol) int32 {
+	for _, c := range spec.Containers {
+		for _, cp := range c.Ports {
+			cpProtocol := cp.Protocol
+			if cpProtocol == "" {
+				cpProtocol = corev1.ProtocolTCP
+			}
+			if cp.Name == name && cpProtocol == protocol {
+				return cp.ContainerPort
+			}
+		}
+	}
+	return 0
+}
+
+/*
+servicePorts returns the targetPorts of the Services which select the Pods of the object. Named targetPorts are looked up in the
+object's own containers first. The second return value is false if a named targetPort can't be resolved at all.
+*/
+func (h *Handler) servicePorts(obj metav1.Object, spec *corev1.PodSpec) ([]TargetPort, bool, error) {
+	podLabels := labels.Set(PodTemplateLabels(obj))
+	if len(podLabels) == 0 {
+		return nil, true, nil
+	}
+
+	svcs, err := h.Client.CoreV1().Services(obj.GetNamespace()).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, false, fmt.Errorf("could not list the services of %s. %w", obj.GetName(), err)
+	}
+
+	var ports []TargetPort
+	for i := range svcs.Items {
+		svc := &svcs.Items[i]
+		if len(svc.Spec.Selector) == 0 || !labels.SelectorFromSet(svc.Spec.Selector).Matches(podLabels) {
+			continue
+		}
+
+		for _, sp := range svc.Spec.Ports {
+			if sp.TargetPort.Type == intstr.String {
+				protocol := sp.Protocol
+				if protocol == "" {
+					protocol = corev1.ProtocolTCP
+				}
+				if port := namedContainerPort(spec, sp.TargetPort.StrVal, protocol); port != 0 {
+					ports = appendUniquePorts(ports, []TargetPort{{Port: port, Protocol: protocol}})
+					continue
+				}
+			}
+
+			tps, err := h.resolveTargetPort(svc, sp)
+			if err != nil {
+				return nil, false, err
+			}
+			if len(tps) == 0 {
+				return nil, false, nil
+			}
+			ports = appendUniquePorts(ports, tps)
+		}
+	}
+	return ports, true, nil
+}
+
+/*
+GetIngressPorts returns the ports the Pods of the object serve on: the containerPorts of the Pod template, the targetPorts of the
+Services selecting the Pods, and the ports of the IngressPortsExtraAnnotation. The IngressPortsAnnotation replaces all of these.
+A nil result means every port, which is also the fallback when the object doesn't declare any ports, or a named targetPort can't
+be resolved. Malformed annotation entries are skipped, and returned as warnings so that they can be reported. If none of the entries
+of the IngressPortsAnnotation is valid, the detected ports are used instead.
+*/
+func (h *Handler) GetIngressPorts(obj metav1.Object) ([]TargetPort, []string, error) {
+	var warnings []string
+	if override, ok := obj.GetAnnotations()[IngressPortsAnnotation]; ok {
+		if strings.TrimSpace(override) == "*" {
+			return nil, nil, nil
+		}
+		ports, overrideWarnings := parsePorts(obj, IngressPortsAnnotation)
+		if len(ports) > 0 {
+			return ports, overrideWarnings, nil
+		}
+		// an override without a single valid port would open every port, so the detected ones are kept instead
+		warnings = append(overrideWarnings, fmt.Sprintf("%s has no valid ports, the detected ports are used instead", IngressPortsAnnotation))
+	}
+
+	spec, err := podSpecOf(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	svcPorts, resolved, err := h.servicePorts(obj, spec)
+	if err != nil {
+		return nil, nil, err
+	}
+	extra, extraWarnings := parsePorts(obj, IngressPortsExtraAnnotation)
+	warnings = append(warnings, extraWarnings...)
+	if !resolved {
+		return nil, warnings, nil
+	}
+
+	ports := appendUniquePorts(containerPorts(spec), svcPorts)
+	return appendUniquePorts(ports, extra), warnings, nil
+}
@@ -0,0 +1,136 @@
+package attribute
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected TargetPort
+		wantErr  bool
+	}{
+		{"8080", TargetPort{Port: 8080, Protocol: corev1.ProtocolTCP}, false},
+		{"5353/udp", TargetPort{Port: 5353, Protocol: corev1.ProtocolUDP}, false},
+		{"9090/TCP", TargetPort{Port: 9090, Protocol: corev1.ProtocolTCP}, false},
+		{"http", TargetPort{}, true},
+		{"70000", TargetPort{}, true},
+		{"53/icmp", TargetPort{}, true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.input, func(t *testing.T) {
+			port, err := ParsePort(tc.input)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, ErrMalformedEntry)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, port)
+		})
+	}
+}
+
+func TestGetIngressPorts(t *testing.T) {
+	newDeployment := func(annotations map[string]string, ports ...corev1.ContainerPort) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Annotations: annotations},
+			Spec: appsv1.DeploymentSpec{
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}},
+					Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Ports: ports}}},
+				},
+			},
+		}
+	}
+	webSvc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "web"},
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromString("http")},
+				{Name: "admin", Port: 9000, TargetPort: intstr.FromInt(9001)},
+			},
+		},
+	}
+
+	tests := []struct {
+		name             string
+		obj              *appsv1.Deployment
+		services         []*corev1.Service
+		expected         []TargetPort
+		expectedWarnings int
+	}{
+		{
+			name:     "OK - container ports with their protocols",
+			obj:      newDeployment(nil, corev1.ContainerPort{ContainerPort: 8080}, corev1.ContainerPort{ContainerPort: 5353, Protocol: corev1.ProtocolUDP}),
+			expected: []TargetPort{{Port: 5353, Protocol: corev1.ProtocolUDP}, {Port: 8080, Protocol: corev1.ProtocolTCP}},
+		},
+		{
+			name:     "OK - container ports and the target ports of the selecting Services",
+			obj:      newDeployment(nil, corev1.ContainerPort{Name: "http", ContainerPort: 8080}),
+			services: []*corev1.Service{webSvc},
+			expected: []TargetPort{{Port: 8080, Protocol: corev1.ProtocolTCP}, {Port: 9001, Protocol: corev1.ProtocolTCP}},
+		},
+		{
+			name:     "OK - no declared ports allow every port",
+			obj:      newDeployment(nil),
+			expected: nil,
+		},
+		{
+			name:             "OK - extra ports extend the detected ones",
+			obj:              newDeployment(map[string]string{IngressPortsExtraAnnotation: "9090, bogus"}, corev1.ContainerPort{ContainerPort: 8080}),
+			expected:         []TargetPort{{Port: 8080, Protocol: corev1.ProtocolTCP}, {Port: 9090, Protocol: corev1.ProtocolTCP}},
+			expectedWarnings: 1,
+		},
+		{
+			name:     "OK - ports annotation overrides the detected ones",
+			obj:      newDeployment(map[string]string{IngressPortsAnnotation: "3000/udp"}, corev1.ContainerPort{ContainerPort: 8080}),
+			services: []*corev1.Service{webSvc},
+			expected: []TargetPort{{Port: 3000, Protocol: corev1.ProtocolUDP}},
+		},
+		{
+			name:             "OK - ports annotation without a valid entry keeps the detected ones",
+			obj:              newDeployment(map[string]string{IngressPortsAnnotation: "bogus, 70000"}, corev1.ContainerPort{ContainerPort: 8080}),
+			expected:         []TargetPort{{Port: 8080, Protocol: corev1.ProtocolTCP}},
+			expectedWarnings: 3,
+		},
+		{
+			name:     "OK - wildcard ports annotation allows every port",
+			obj:      newDeployment(map[string]string{IngressPortsAnnotation: "*"}, corev1.ContainerPort{ContainerPort: 8080}),
+			expected: nil,
+		},
+		{
+			name:     "OK - unresolvable named target port allows every port",
+			obj:      newDeployment(nil, corev1.ContainerPort{ContainerPort: 8080}),
+			services: []*corev1.Service{webSvc},
+			expected: nil,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := fake.NewSimpleClientset()
+			for _, svc := range tc.services {
+				_, err := c.CoreV1().Services(svc.Namespace).Create(context.Background(), svc, metav1.CreateOptions{})
+				if err != nil {
+					t.Fatalf("error creating test svc %v", err)
+				}
+			}
+			h := &Handler{Client: c}
+
+			ports, warnings, err := h.GetIngressPorts(tc.obj)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, ports)
+			assert.Len(t, warnings, tc.expectedWarnings)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package attribute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// TargetPort is a port the Pods behind a cluster.local address can be reached on
+type TargetPort struct {
+	Port     int32
+	Protocol corev1.Protocol
+}
+
+// Target is a resolved cluster.local address
+type Target struct {
+	// Namespace is the namespace of the Pods behind the address
+	Namespace string
+	// Labels are the labels of the Pods behind the address
+	Labels map[string][]string
+	// Ports are the ports the Pods can be reached on. It's empty if they can be reached on any port.
+	Ports []TargetPort
+}
+
+// splitPort splits the <address>:<port> form. The port is 0 if s doesn't end with a valid port.
+func splitPort(s string) (string, int32) {
+	i := strings.LastIndex(s, ":")
+	if i == -1 {
+		return s, 0
+	}
+	port, err := strconv.ParseInt(s[i+1:], 10, 32)
+	if err != nil || port < 1 || port > 65535 {
+		return s, 0
+	}
+	return s[:i], int32(port)
+}
+
+/*
+findLocalAddress returns the first cluster.local address of an env. var value together with its port if there is one, e.g
+db.data.svc.cluster.local:5432 from postgres://user@db.data.svc.cluster.local:5432/app. It returns an empty string if there is none.
+*/
+func findLocalAddress(value string) string {
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r != ':' && !isHostnameChar(r) }) {
+		if isValidLocalEnvVar(field) {
+			return field
+		}
+		if host, port := splitPort(field); port != 0 && isValidLocalEnvVar(host) {
+			return field
+		}
+	}
+	return ""
+}
+
+// explicitPorts returns the port written in the cluster.local address, or nil if there is none
+func explicitPorts(ref LocalRef) []TargetPort {
+	if ref.Port == 0 {
+		return nil
+	}
+	return []TargetPort{{Port: ref.Port, Protocol: corev1.ProtocolTCP}}
+}
+
+/*
+resolvePorts returns the ports the Pods behind a cluster.local address can be reached on. For Services these are the targetPorts
+of the Service, narrowed down to the Service port written in the address if there is one. For Pods only the port written in the
+address is used. A nil result means every port, which is also the fallback when a port can't be resolved.
+*/
+func (h *Handler) resolvePorts(ref LocalRef) ([]TargetPort, error) {
+	var svc *corev1.Service
+	var err error
+
+	switch {
+	case ref.Kind == RefKindIP:
+		svc, err = h.getSvcByClusterIP(ref.IP)
+	case ref.Kind == RefKindSvc && ref.Hostname == "":
+		svc, err = h.getSvc(ref.Name, ref.Namespace)
+	default:
+		return explicitPorts(ref), nil
+	}
+	if err != nil {
+		if errors.Is(err, ErrResourceNotFound) {
+			return explicitPorts(ref), nil
+		}
+		return nil, err
+	}
+
+	// ExternalName Services and Services without selectors become ipBlocks, and their ports are not known
+	if svc.Spec.Type == corev1.ServiceTypeExternalName || len(svc.Spec.Selector) == 0 {
+		return explicitPorts(ref), nil
+	}
+
+	var ports []TargetPort
+	for _, sp := range svc.Spec.Ports {
+		if ref.Port != 0 && sp.Port != ref.Port {
+			continue
+		}
+		tps, err := h.resolveTargetPort(svc, sp)
+		if err != nil {
+			return nil, err
+		}
+		if len(tps) == 0 {
+			return nil, nil
+		}
+		ports = appendUniquePorts(ports, tps)
+	}
+
+	// e.g headless Services are reached on the Pod ports directly
+	if len(ports) == 0 {
+		return explicitPorts(ref), nil
+	}
+	return ports, nil
+}
+
+// resolveTargetPort returns the container ports a Service port forwards to. Named targetPorts are looked up on the Pods of the Service.
+func (h *Handler) resolveTargetPort(svc *corev1.Service, sp corev1.ServicePort) ([]TargetPort, error) {
+	protocol := sp.Protocol
+	if protocol == "" {
+		protocol = corev1.ProtocolTCP
+	}
+
+	if sp.TargetPort.Type == intstr.Int {
+		port := sp.TargetPort.IntVal
+		if port == 0 {
+			port = sp.Port
+		}
+		return []TargetPort{{Port: port, Protocol: protocol}}, nil
+	}
+
+	pods, err := h.Client.CoreV1().Pods(svc.Namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: labels.SelectorFromSet(svc.Spec.Selector).String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list the pods of svc %s. %w", svc.Name, err)
+	}
+
+	var ports []TargetPort
+	for _, pod := range pods.Items {
+		for _, c := range pod.Spec.Containers {
+			for _, cp := range c.Ports {
+				cpProtocol := cp.Protocol
+				if cpProtocol == "" {
+					cpProtocol = corev1.ProtocolTCP
+				}
+				if cp.Name == sp.TargetPort.StrVal && cpProtocol == protocol {
+					ports = appendUniquePorts(ports, []TargetPort{{Port: cp.ContainerPort, Protocol: protocol}})
+				}
+			}
+		}
+	}
+	return ports, nil
+}
+
+// appendUniquePorts appends the ports of src which are not in dst yet, and keeps the result sorted
+func appendUniquePorts(dst []TargetPort, src []TargetPort) []TargetPort {
+	for _, p := range src {
+		found := false
+		for _, d := range dst {
+			if d == p {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst = append(dst, p)
+		}
+	}
+	sort.Slice(dst, func(i, j int) bool {
+		if dst[i].Port != dst[j].Port {
+			return dst[i].Port < dst[j].Port
+		}
+		return dst[i].Protocol < dst[j].Protocol
+	})
+	return dst
+}
@@ -0,0 +1,135 @@
+package attribute
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSplitPort(t *testing.T) {
+	host, port := splitPort("db.data.svc.cluster.local:5432")
+	assert.Equal(t, "db.data.svc.cluster.local", host)
+	assert.Equal(t, int32(5432), port)
+
+	host, port = splitPort("db.data.svc.cluster.local")
+	assert.Equal(t, "db.data.svc.cluster.local", host)
+	assert.Equal(t, int32(0), port)
+
+	host, port = splitPort("db.data.svc.cluster.local:99999")
+	assert.Equal(t, "db.data.svc.cluster.local:99999", host)
+	assert.Equal(t, int32(0), port)
+}
+
+func TestResolveEnvVarTargets(t *testing.T) {
+	objects := []runtime.Object{
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "data"},
+			Spec: corev1.ServiceSpec{
+				Selector: map[string]string{"app": "db"},
+				Ports: []corev1.ServicePort{
+					{Name: "postgres", Port: 5432, TargetPort: intstr.FromInt(15432)},
+					{Name: "metrics", Port: 9187, TargetPort: intstr.FromString("metrics")},
+				},
+			},
+		},
+		&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "data", Labels: map[string]string{"app": "db"}},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{
+					{Name: "exporter", Ports: []corev1.ContainerPort{{Name: "metrics", ContainerPort: 9100}}},
+				},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "dns", Namespace: "data"},
+			Spec: corev1.ServiceSpec{
+				Selector:  map[string]string{"app": "dns"},
+				ClusterIP: "10.96.0.10",
+				Ports:     []corev1.ServicePort{{Port: 53, Protocol: corev1.ProtocolUDP}},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "unnamed", Namespace: "data"},
+			Spec: corev1.ServiceSpec{
+				Selector: map[string]string{"app": "unnamed"},
+				Ports:    []corev1.ServicePort{{Port: 8080, TargetPort: intstr.FromString("http")}},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		envVars  map[string]string
+		expected []Target
+	}{
+		{
+			name:    "OK - every targetPort of the Service, named ones mapped to container ports",
+			envVars: map[string]string{"DB": "db.data.svc.cluster.local"},
+			expected: []Target{{
+				Namespace: "data",
+				Labels:    map[string][]string{"app": {"db"}},
+				Ports:     []TargetPort{{Port: 9100, Protocol: corev1.ProtocolTCP}, {Port: 15432, Protocol: corev1.ProtocolTCP}},
+			}},
+		},
+		{
+			name:    "OK - explicit port narrows the Service ports",
+			envVars: map[string]string{"DB": "db.data.svc.cluster.local:5432"},
+			expected: []Target{{
+				Namespace: "data",
+				Labels:    map[string][]string{"app": {"db"}},
+				Ports:     []TargetPort{{Port: 15432, Protocol: corev1.ProtocolTCP}},
+			}},
+		},
+		{
+			name:    "OK - protocol of the Service port",
+			envVars: map[string]string{"DNS": "dns.data.svc.cluster.local"},
+			expected: []Target{{
+				Namespace: "data",
+				Labels:    map[string][]string{"app": {"dns"}},
+				Ports:     []TargetPort{{Port: 53, Protocol: corev1.ProtocolUDP}},
+			}},
+		},
+		{
+			name:    "OK - unresolvable named targetPort allows every port",
+			envVars: map[string]string{"UNNAMED": "unnamed.data.svc.cluster.local"},
+			expected: []Target{{
+				Namespace: "data",
+				Labels:    map[string][]string{"app": {"unnamed"}},
+			}},
+		},
+		{
+			name:    "OK - namespace of the Service behind a ClusterIP",
+			envVars: map[string]string{"DNS": "10.96.0.10"},
+			expected: []Target{{
+				Namespace: "data",
+				Labels:    map[string][]string{"app": {"dns"}},
+				Ports:     []TargetPort{{Port: 53, Protocol: corev1.ProtocolUDP}},
+			}},
+		},
+		{
+			name:    "OK - explicit port of a Pod address",
+			envVars: map[string]string{"DB0": "db-0.data.pod.cluster.local:9100"},
+			expected: []Target{{
+				Namespace: "data",
+				Labels:    map[string][]string{"app": {"db"}},
+				Ports:     []TargetPort{{Port: 9100, Protocol: corev1.ProtocolTCP}},
+			}},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			h := &Handler{Client: fake.NewSimpleClientset(objects...)}
+
+			targets, pending, err := h.ResolveEnvVarTargets(tc.envVars)
+			assert.NoError(t, err)
+			assert.Empty(t, pending)
+			assert.Equal(t, tc.expected, targets)
+		})
+	}
+}
@@ -0,0 +1,191 @@
+// the dependency package keeps track of which objects of interest depend on which cluster objects (e.g Services and Pods)
+package dependency
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/object"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Index is an in-memory reverse index from dependency targets to the objects that refer to them. It's safe for concurrent use, and a nil *Index is a no-op.
+type Index struct {
+	mu         sync.RWMutex
+	dependents map[string]map[string]metav1.Object
+	targets    map[string][]string
+	objects    map[string]metav1.Object
+}
+
+func NewIndex() *Index {
+	return &Index{
+		dependents: make(map[string]map[string]metav1.Object),
+		targets:    make(map[string][]string),
+		objects:    make(map[string]metav1.Object),
+	}
+}
+
+// ServiceKey returns the index key of a Service target
+func ServiceKey(namespace string, name string) string {
+	return fmt.Sprintf("svc/%s/%s", namespace, name)
+}
+
+// ServiceIPKey returns the index key of a Service target referred to by its ClusterIP
+func ServiceIPKey(ip string) string {
+	return fmt.Sprintf("svcip/%s", ip)
+}
+
+// PodKey returns the index key of a Pod target
+func PodKey(namespace string, name string) string {
+	return fmt.Sprintf("pod/%s/%s", namespace, name)
+}
+
+// PodIPKey returns the index key of a Pod target referred to by its IP, e.g 10-244-1-7.ns.pod.cluster.local
+func PodIPKey(ip string) string {
+	return fmt.Sprintf("podip/%s", ip)
+}
+
+// ConfigMapKey returns the index key of a ConfigMap the cluster.local addresses of an object are read from
+func ConfigMapKey(namespace string, name string) string {
+	return fmt.Sprintf("configmap/%s/%s", namespace, name)
+}
+
+// WorkloadKey returns the index key of a workload target declared in an annotation, by its declared kind (deploy, sts or ds)
+func WorkloadKey(kind string, namespace string, name string) string {
+	return fmt.Sprintf("%s/%s/%s", kind, namespace, name)
+}
+
+// SplitKey returns the kind (svc, svcip, pod, podip, configmap, deploy, sts or ds), the namespace and the name of a target key. The namespace is empty for the IP keys
+func SplitKey(key string) (kind string, namespace string, name string) {
+	parts := strings.SplitN(key, "/", 3)
+	switch len(parts) {
+	case 3:
+		return parts[0], parts[1], parts[2]
+	case 2:
+		return parts[0], "", parts[1]
+	}
+	return "", "", key
+}
+
+// ObjectKey identifies a dependent object by its group, kind, namespace and name
+func ObjectKey(obj metav1.Object) string {
+	return fmt.Sprintf("%s/%s/%s", object.GroupKind(obj), obj.GetNamespace(), obj.GetName())
+}
+
+// Set replaces the targets the dependent object refers to, and returns the targets it referred to before
+func (i *Index) Set(dependent metav1.Object, targets []string) []string {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	key := ObjectKey(dependent)
+	previous := i.remove(key)
+
+	for _, t := range targets {
+		if i.dependents[t] == nil {
+			i.dependents[t] = make(map[string]metav1.Object)
+		}
+		i.dependents[t][key] = dependent
+	}
+	i.targets[key] = targets
+	i.objects[key] = dependent
+	return previous
+}
+
+// Remove deletes the dependent object and all of its targets from the index, and returns the targets it referred to
+func (i *Index) Remove(dependent metav1.Object) []string {
+	if i == nil {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.remove(ObjectKey(dependent))
+}
+
+func (i *Index) remove(key string) []string {
+	previous := i.targets[key]
+	for _, t := range i.targets[key] {
+		delete(i.dependents[t], key)
+		if len(i.dependents[t]) == 0 {
+			delete(i.dependents, t)
+		}
+	}
+	delete(i.targets, key)
+	delete(i.objects, key)
+	return previous
+}
+
+// Object returns the last seen version of the dependent object with the given ObjectKey
+func (i *Index) Object(key string) (metav1.Object, bool) {
+	if i == nil {
+		return nil, false
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	obj, ok := i.objects[key]
+	return obj, ok
+}
+
+// Dependents returns the last seen version of every object that refers to the target
+func (i *Index) Dependents(target string) []metav1.Object {
+	if i == nil {
+		return nil
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	deps := make([]metav1.Object, 0, len(i.dependents[target]))
+	for _, d := range i.dependents[target] {
+		deps = append(deps, d)
+	}
+	return deps
+}
+
+// Objects returns the last seen version of every object of the namespace which is in the index, ordered by their ObjectKeys
+func (i *Index) Objects(namespace string) []metav1.Object {
+	if i == nil {
+		return nil
+	}
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	keys := make([]string, 0, len(i.objects))
+	for k, obj := range i.objects {
+		if obj.GetNamespace() == namespace {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	objs := make([]metav1.Object, 0, len(keys))
+	for _, k := range keys {
+		objs = append(objs, i.objects[k])
+	}
+	return objs
+}
+
+// Changed returns the targets which are only in one of the two lists
+func Changed(oldTargets []string, newTargets []string) []string {
+	count := make(map[string]int)
+	for _, t := range oldTargets {
+		count[t] |= 1
+	}
+	for _, t := range newTargets {
+		count[t] |= 2
+	}
+
+	var changed []string
+	for t, c := range count {
+		if c != 3 {
+			changed = append(changed, t)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
@@ -0,0 +1,122 @@
+package dependency
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestIndex(t *testing.T) {
+	backend := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "default"}}
+	worker := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: "jobs"}}
+	backendPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "default"}}
+
+	i := NewIndex()
+	i.Set(backend, []string{ServiceKey("default", "frontend"), ServiceKey("data", "db")})
+	i.Set(worker, []string{ServiceKey("data", "db")})
+	i.Set(backendPod, []string{ServiceKey("default", "frontend")})
+
+	assert.ElementsMatch(t, []metav1.Object{backend, backendPod}, i.Dependents(ServiceKey("default", "frontend")))
+	assert.ElementsMatch(t, []metav1.Object{backend, worker}, i.Dependents(ServiceKey("data", "db")))
+
+	// the targets are replaced on Set
+	i.Set(backend, []string{ServiceKey("data", "cache")})
+	assert.ElementsMatch(t, []metav1.Object{backendPod}, i.Dependents(ServiceKey("default", "frontend")))
+	assert.ElementsMatch(t, []metav1.Object{worker}, i.Dependents(ServiceKey("data", "db")))
+	assert.ElementsMatch(t, []metav1.Object{backend}, i.Dependents(ServiceKey("data", "cache")))
+
+	obj, ok := i.Object(ObjectKey(worker))
+	assert.True(t, ok)
+	assert.Equal(t, worker, obj)
+
+	i.Remove(worker)
+	assert.Empty(t, i.Dependents(ServiceKey("data", "db")))
+	_, ok = i.Object(ObjectKey(worker))
+	assert.False(t, ok)
+}
+
+func TestIndexPodTargets(t *testing.T) {
+	backend := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "default"}}
+
+	i := NewIndex()
+	i.Set(backend, []string{PodKey("data", "db-0"), PodIPKey("10.244.1.7"), ServiceIPKey("10.96.12.4")})
+
+	assert.ElementsMatch(t, []metav1.Object{backend}, i.Dependents(PodKey("data", "db-0")))
+	assert.ElementsMatch(t, []metav1.Object{backend}, i.Dependents(PodIPKey("10.244.1.7")))
+	assert.ElementsMatch(t, []metav1.Object{backend}, i.Dependents(ServiceIPKey("10.96.12.4")))
+	assert.Empty(t, i.Dependents(PodKey("data", "db-1")))
+}
+
+func TestObjectKeyCustomKinds(t *testing.T) {
+	newWorkload := func(apiVersion string, kind string) *unstructured.Unstructured {
+		obj := &unstructured.Unstructured{}
+		obj.SetAPIVersion(apiVersion)
+		obj.SetKind(kind)
+		obj.SetName("web")
+		obj.SetNamespace("default")
+		return obj
+	}
+	rollout := newWorkload("argoproj.io/v1alpha1", "Rollout")
+	cloneSet := newWorkload("apps.kruise.io/v1alpha1", "CloneSet")
+	otherRollout := newWorkload("rollouts.example.com/v1", "Rollout")
+
+	assert.NotEqual(t, ObjectKey(rollout), ObjectKey(cloneSet))
+	assert.NotEqual(t, ObjectKey(rollout), ObjectKey(otherRollout))
+
+	i := NewIndex()
+	i.Set(rollout, []string{ServiceKey("default", "api")})
+	i.Set(cloneSet, []string{ServiceKey("default", "db")})
+
+	// the objects with the same name don't replace each other
+	assert.ElementsMatch(t, []metav1.Object{rollout}, i.Dependents(ServiceKey("default", "api")))
+	assert.ElementsMatch(t, []metav1.Object{cloneSet}, i.Dependents(ServiceKey("default", "db")))
+	obj, ok := i.Object(ObjectKey(cloneSet))
+	assert.True(t, ok)
+	assert.Equal(t, cloneSet, obj)
+}
+
+func TestNilIndex(t *testing.T) {
+	var i *Index
+	obj := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"}}
+
+	i.Set(obj, []string{ServiceKey("default", "svc")})
+	i.Remove(obj)
+	assert.Empty(t, i.Dependents(ServiceKey("default", "svc")))
+	_, ok := i.Object(ObjectKey(obj))
+	assert.False(t, ok)
+}
+
+func TestIndexObjects(t *testing.T) {
+	backend := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "default"}}
+	worker := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "worker", Namespace: "jobs"}}
+	backendPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "default"}}
+
+	i := NewIndex()
+	assert.Nil(t, i.Set(backend, []string{ServiceKey("default", "frontend")}))
+	i.Set(worker, nil)
+	i.Set(backendPod, nil)
+
+	assert.Equal(t, []metav1.Object{backend, backendPod}, i.Objects("default"))
+	assert.Equal(t, []metav1.Object{worker}, i.Objects("jobs"))
+
+	assert.Equal(t, []string{ServiceKey("default", "frontend")}, i.Set(backend, []string{ServiceKey("data", "db")}))
+	assert.Equal(t, []string{ServiceKey("data", "db")}, i.Remove(backend))
+}
+
+func TestChanged(t *testing.T) {
+	assert.Equal(t, []string{"pod/default/b", "svc/default/a"}, Changed([]string{"svc/default/a", "svc/default/c"}, []string{"svc/default/c", "pod/default/b"}))
+	assert.Empty(t, Changed([]string{"svc/default/a"}, []string{"svc/default/a"}))
+	assert.Empty(t, Changed(nil, nil))
+}
+
+func TestSplitKey(t *testing.T) {
+	kind, namespace, name := SplitKey(ServiceKey("default", "api"))
+	assert.Equal(t, []string{"svc", "default", "api"}, []string{kind, namespace, name})
+
+	kind, namespace, name = SplitKey(PodIPKey("10.244.1.7"))
+	assert.Equal(t, []string{"podip", "", "10.244.1.7"}, []string{kind, namespace, name})
+}
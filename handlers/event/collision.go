@@ -0,0 +1,145 @@
+package event
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	attr "github.com/adykaaa/k8s-netpol-ctrl/handlers/attribute"
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/dependency"
+	np "github.com/adykaaa/k8s-netpol-ctrl/handlers/networkpolicy"
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/object"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CollisionMode decides what happens to the objects of interest which select the same Pods, e.g the Deployments "api" and "api-canary" both selecting "app: api"
+type CollisionMode string
+
+const (
+	// CollisionFlag keeps one policy for the Pods, built for the first of the colliding objects, and reports the others with Events
+	CollisionFlag CollisionMode = "flag"
+	// CollisionMerge gives the colliding objects one shared policy, which lets through the dependencies and dependents of all of them
+	CollisionMerge CollisionMode = "merge"
+)
+
+// _selectorCollisions counts the detected selector collisions by namespace. It's published on /debug/vars with the rest of the expvars.
+var _selectorCollisions = expvar.NewMap("selectorCollisions")
+
+// collidingObjects returns the other objects of interest in the index whose selector selects the same Pods as the selector
+func (h *Handler) collidingObjects(selector *metav1.LabelSelector, obj metav1.Object) []metav1.Object {
+	if isEmptySelector(selector) {
+		return nil
+	}
+
+	var others []metav1.Object
+	key := dependency.ObjectKey(obj)
+	for _, other := range h.Dependencies.Objects(obj.GetNamespace()) {
+		if dependency.ObjectKey(other) == key || object.OptedOut(other) {
+			continue
+		}
+		otherSelector, _, err := h.convertToMeta(other)
+		if err != nil || !selectorsEqual(selector, otherSelector) {
+			continue
+		}
+		others = append(others, other)
+	}
+	return others
+}
+
+// collisionGroup returns the objects ordered by their ObjectKeys, the first of them is the one the shared policy is named after
+func collisionGroup(objs ...metav1.Object) []metav1.Object {
+	sort.Slice(objs, func(i, j int) bool { return dependency.ObjectKey(objs[i]) < dependency.ObjectKey(objs[j]) })
+	return objs
+}
+
+// displayName returns the kind and name of the object, e.g Deployment/api
+func displayName(obj metav1.Object) string {
+	return fmt.Sprintf("%s/%s", object.Kind(obj), obj.GetName())
+}
+
+// reportCollision reports that the object selects the same Pods as the other objects of the group, as a warning Event and in the metrics
+func (h *Handler) reportCollision(obj metav1.Object, group []metav1.Object) {
+	var others []string
+	for _, member := range group {
+		if dependency.ObjectKey(member) != dependency.ObjectKey(obj) {
+			others = append(others, displayName(member))
+		}
+	}
+	_selectorCollisions.Add(obj.GetNamespace(), 1)
+
+	message := fmt.Sprintf("the object selects the same Pods as %s", strings.Join(others, ", "))
+	switch {
+	case h.Collisions == CollisionMerge:
+		message += ", they share one policy"
+	case dependency.ObjectKey(group[0]) == dependency.ObjectKey(obj):
+		message += ", the policy of the Pods is built for this object only"
+	default:
+		message += fmt.Sprintf(", the policy of the Pods is built for %s only", displayName(group[0]))
+	}
+	h.warn(obj, "SelectorCollision", message)
+}
+
+// trackDependencies records the targets of the object in the dependency index, without building a policy for it
+func (h *Handler) trackDependencies(obj metav1.Object) error {
+	refs, err := h.getLocalRefs(obj)
+	if err != nil && !errors.Is(err, attr.ErrNoEnvVars) {
+		return err
+	}
+	targets := h.objectTargets(obj, refs)
+	h.enqueueTargetOwners(obj, dependency.Changed(h.Dependencies.Set(obj, targets), targets))
+	return nil
+}
+
+/*
+reconcileGroup builds the NetworkPolicy of the objects selecting the same Pods from scratch, and replaces the policy of the first
+object with it. The policies of the other objects are deleted.
+There is only one policy for the Pods, so that the policies don't race each other. In CollisionMerge mode it lets through the traffic
+of every object of the group, otherwise only the traffic of the first one - the dependencies of the others are still tracked.
+*/
+func (h *Handler) reconcileGroup(selector *metav1.LabelSelector, group []metav1.Object) error {
+	p, err := h.buildPolicy(selector, group[0])
+	if err != nil {
+		return err
+	}
+
+	for _, member := range group[1:] {
+		if h.Collisions != CollisionMerge {
+			if err := h.trackDependencies(member); err != nil {
+				return err
+			}
+			continue
+		}
+		memberPolicy, err := h.buildPolicy(selector, member)
+		if err != nil {
+			return err
+		}
+		np.MergePolicy(memberPolicy, p)
+	}
+
+	action := object.Update
+	existing, err := h.ownedPolicy(group[0], selector)
+	switch {
+	case errors.Is(err, np.ErrNotFound):
+		action = object.Create
+	case err != nil:
+		return err
+	default:
+		p.Name, p.ResourceVersion = existing.Name, existing.ResourceVersion
+	}
+
+	if err := object.NewHandler(h.DyanmicClient, p).Mutate(action); err != nil {
+		return err
+	}
+	log.Printf("NetworkPolicy %s reconciled for %s \n", p.GetName(), group[0].GetName())
+
+	// the Pods have one policy, the ones built for the other objects of the group before they started colliding are dropped
+	for _, member := range group[1:] {
+		if err := h.deleteOwnedPolicy(member, selector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,35 +1,62 @@
 package event
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"reflect"
+	"strings"
 
 	attr "github.com/adykaaa/k8s-netpol-ctrl/handlers/attribute"
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/dependency"
 	np "github.com/adykaaa/k8s-netpol-ctrl/handlers/networkpolicy"
 	"github.com/adykaaa/k8s-netpol-ctrl/handlers/object"
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 )
 
+// maxRetries is how many times the reconciliation of a queued object is retried before it's dropped
+const maxRetries = 5
+
 type NetworkPolicyHandler interface {
-	NewPolicy(name string, namespace string, podSelectorLabels map[string]string, targetPodLabels map[string][]string) (*networkingv1.NetworkPolicy, error)
-	GetPolicyByPodLabels(namespace string, podLabels map[string]string) (*networkingv1.NetworkPolicy, error)
-	AppendLabelsToPeers(targetPodLabels map[string][]string) (ingressPeers []networkingv1.NetworkPolicyPeer, egressPeers []networkingv1.NetworkPolicyPeer, err error)
+	NewPolicy(name string, namespace string, podSelector *metav1.LabelSelector, peers np.Peers) (*networkingv1.NetworkPolicy, error)
+	GetPolicyByOwner(namespace string, kind string, name string) (*networkingv1.NetworkPolicy, error)
 }
 
 type ObjectHandler interface {
 	AddLabel() error
+	RemoveLabel() error
 	Mutate(action object.Action) error
 }
 
 type AttributeHandler interface {
 	ConvertLabels(targetPodLabels map[string]string) map[string][]string
-	GetLocalEnvVars(obj metav1.Object) (map[string]string, error)
-	GetLabelsFromEnvVars(envVars map[string]string) (map[string][]string, error)
-	MergeLabels(targetLabels ...map[string][]string) (map[string][]string, error)
+	DetectReferences(obj metav1.Object) ([]attr.Reference, error)
+	ResolveEnvVarTargets(envVars map[string]string) ([]attr.Target, []string, error)
+	GetIPBlocksFromEnvVars(envVars map[string]string) ([]string, error)
+	GetDeclaredTargets(obj metav1.Object, annotation string) ([]attr.DeclaredTarget, []string, []string, error)
+	GetIngressPorts(obj metav1.Object) ([]attr.TargetPort, []string, error)
+	WatchedConfigMaps(obj metav1.Object) []string
+}
+
+// OwnerResolver finds the object the policy of an owned Pod belongs to
+type OwnerResolver interface {
+	GroupPod(pod *corev1.Pod) (metav1.Object, error)
+	TopOwner(obj metav1.Object) (*metav1.OwnerReference, error)
+	// Forget drops what is cached about the owner of the deleted Pod
+	Forget(pod *corev1.Pod)
 }
 
 type Handler struct {
@@ -38,117 +65,641 @@ type Handler struct {
 	NetworkPolicyHandler NetworkPolicyHandler
 	ObjectHandler        ObjectHandler
 	AttributeHandler     AttributeHandler
+	// Dependencies tracks which objects of interest refer to which Services and Pods
+	Dependencies *dependency.Index
+	// PodIndexer is the indexer of the Pod informer with the attribute.PodIPIndex. If it's nil, Pods are looked up by IP through the API
+	PodIndexer cache.Indexer
+	// ServiceIndexer is the indexer of the Service informer with the attribute.ClusterIPIndex. If it's nil, Services are looked up by ClusterIP through the API
+	ServiceIndexer cache.Indexer
+	// Owners groups the Pods of unmanaged owners under their top-level owner. If it's nil, every owned Pod is skipped
+	Owners OwnerResolver
+	// Queue holds the ObjectKeys of the objects waiting for reconciliation. If it's nil, the objects are reconciled right away
+	Queue workqueue.RateLimitingInterface
+	// Recorder reports the problems with the objects of interest as Events. If it's nil, the problems are only logged
+	Recorder record.EventRecorder
+	// NonIntrusive keeps the handler from writing to the objects of interest. Objects which can't be selected by their existing labels are reported instead of labeled
+	NonIntrusive bool
+	// Collisions decides how the objects selecting the same Pods share their policy. The zero value works like CollisionFlag
+	Collisions CollisionMode
+	// NamespaceBaseline gives the namespaces labeled with BaselineLabel a default-deny policy
+	NamespaceBaseline bool
+	// IdentityLabels picks the label keys which end up in the podSelector of the policies. The zero value keeps every key.
+	IdentityLabels object.IdentityLabelPolicy
+	// TemplateConfigMap is the <namespace>/<name> of the ConfigMap holding the policy templates, its changes queue the objects picking a template
+	TemplateConfigMap string
+}
+
+// warn logs a problem with the object, and reports it as a warning Event
+func (h *Handler) warn(obj metav1.Object, reason string, message string) {
+	log.Printf("%s/%s: %s \n", obj.GetNamespace(), obj.GetName(), message)
+	if ro, ok := obj.(runtime.Object); ok && h.Recorder != nil {
+		h.Recorder.Event(ro, corev1.EventTypeWarning, reason, message)
+	}
 }
 
 /*
-handleLabelChange modifies the existing NetworkPolicy if the object's labels have changed. It clears all existing LabelSelectorRequirements
-which were targetting pods based on the old object's labels, and sets them up according to the new object's labels
+declaredPeers returns the ingress and egress peers declared in the IngressFromAnnotation and EgressToAnnotation of the object, the
+entries pointing at objects that don't exist yet, and the warnings about the entries that are malformed or can't be resolved
 */
-func (h *Handler) handleLabelChange(oldLabels map[string]string, newLabels map[string]string, p *networkingv1.NetworkPolicy) error {
-	p.Spec.PodSelector.MatchLabels = newLabels
-	convNewLabels := h.AttributeHandler.ConvertLabels(newLabels)
-	convOldLabels := h.AttributeHandler.ConvertLabels(oldLabels)
+func (h *Handler) declaredPeers(obj metav1.Object) ([]networkingv1.NetworkPolicyPeer, []networkingv1.NetworkPolicyPeer, []string, []string, error) {
+	ingressTargets, ingressPending, ingressWarnings, err := h.AttributeHandler.GetDeclaredTargets(obj, attr.IngressFromAnnotation)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
 
-	np.RemoveOldLabels(convOldLabels, p.Spec.Ingress, p.Spec.Egress)
+	egressTargets, egressPending, egressWarnings, err := h.AttributeHandler.GetDeclaredTargets(obj, attr.EgressToAnnotation)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
 
-	ingressPol, egressPol, err := h.NetworkPolicyHandler.AppendLabelsToPeers(convNewLabels)
+	return np.NewDeclaredPeers(obj.GetNamespace(), ingressTargets),
+		np.NewDeclaredPeers(obj.GetNamespace(), egressTargets),
+		append(ingressPending, egressPending...),
+		append(ingressWarnings, egressWarnings...),
+		nil
+}
+
+// declaredAnnotationsEqual reports whether the IngressFromAnnotation and EgressToAnnotation of the two objects are the same
+func declaredAnnotationsEqual(a metav1.Object, b metav1.Object) bool {
+	for _, key := range []string{attr.IngressFromAnnotation, attr.EgressToAnnotation} {
+		if a.GetAnnotations()[key] != b.GetAnnotations()[key] {
+			return false
+		}
+	}
+	return true
+}
+
+// convertToMeta is object.ConvertToMeta with only the identity label keys kept in the selector
+func (h *Handler) convertToMeta(obj interface{}) (*metav1.LabelSelector, metav1.Object, error) {
+	selector, metaObj, err := object.ConvertToMeta(obj)
 	if err != nil {
-		return err
+		return nil, nil, err
+	}
+	return h.IdentityLabels.Selector(selector), metaObj, nil
+}
+
+// isEmptySelector reports whether the selector has nothing to select the Pods of an object by
+func isEmptySelector(selector *metav1.LabelSelector) bool {
+	return len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0
+}
+
+// selectorsEqual reports whether the two selectors select the same Pods, as far as their policies are concerned
+func selectorsEqual(a *metav1.LabelSelector, b *metav1.LabelSelector) bool {
+	return attr.MapsEqual(a.MatchLabels, b.MatchLabels) && equality.Semantic.DeepEqual(a.MatchExpressions, b.MatchExpressions)
+}
+
+// ingressPortsEqual reports whether the objects serve on the same ports, as far as their policies are concerned
+func ingressPortsEqual(a metav1.Object, b metav1.Object) bool {
+	for _, key := range []string{attr.IngressPortsAnnotation, attr.IngressPortsExtraAnnotation} {
+		if a.GetAnnotations()[key] != b.GetAnnotations()[key] {
+			return false
+		}
 	}
+	return reflect.DeepEqual(attr.ContainerPorts(a), attr.ContainerPorts(b))
+}
 
-	np.ExtendPeers(ingressPol, egressPol, p)
+// localRefTargets returns the dependency index keys of the Service and Pod a parsed cluster.local address or IP literal points at
+func localRefTargets(ref attr.LocalRef) []string {
+	switch {
+	case ref.Kind == attr.RefKindIP:
+		return []string{dependency.ServiceIPKey(ref.IP)}
+	case ref.Hostname != "":
+		return []string{dependency.ServiceKey(ref.Namespace, ref.Name), dependency.PodKey(ref.Namespace, ref.Hostname)}
+	case ref.Kind == attr.RefKindSvc:
+		return []string{dependency.ServiceKey(ref.Namespace, ref.Name)}
+	case ref.Kind == attr.RefKindPod:
+		if ip := attr.PodIPFromDNSLabel(ref.Name); ip != "" {
+			return []string{dependency.PodIPKey(ip)}
+		}
+		return []string{dependency.PodKey(ref.Namespace, ref.Name)}
+	}
 	return nil
 }
 
 /*
-handleEnvVarChange handles the case when during an Update event, the metaObject's environment variables which are pointing to
-cluster.local addresses have changed, and updates the metaObject's NetworkPolicy accordingly by adding the necessary labels to
-the policy's peers.
+dependencyTargets returns the dependency index keys of the Services, Pods and workloads the object refers to, either through its
+cluster.local addresses (refs) or through the entries of its IngressFromAnnotation and EgressToAnnotation
 */
-func (h *Handler) handleEnvVarChange(objLabels map[string]string, envVars map[string]string, p *networkingv1.NetworkPolicy) error {
-	el, err := h.AttributeHandler.GetLabelsFromEnvVars(envVars)
-	if err != nil {
-		return err
+func dependencyTargets(obj metav1.Object, refs map[string]string) []string {
+	var targets []string
+	for _, v := range refs {
+		ref, err := attr.ParseLocalRef(v)
+		if err != nil {
+			continue
+		}
+		targets = append(targets, localRefTargets(ref)...)
 	}
 
-	podLabels, err := h.AttributeHandler.MergeLabels(h.AttributeHandler.ConvertLabels(objLabels), el)
+	for _, key := range []string{attr.IngressFromAnnotation, attr.EgressToAnnotation} {
+		for _, entry := range strings.Split(obj.GetAnnotations()[key], ",") {
+			ref, err := attr.ParseDeclaredRef(entry, obj.GetNamespace())
+			if err != nil {
+				continue
+			}
+			switch ref.Kind {
+			case "svc":
+				targets = append(targets, dependency.ServiceKey(ref.Namespace, ref.Name))
+			case "pod":
+				targets = append(targets, dependency.PodKey(ref.Namespace, ref.Name))
+			case "deploy", "sts", "ds":
+				targets = append(targets, dependency.WorkloadKey(ref.Kind, ref.Namespace, ref.Name))
+			}
+		}
+	}
+	return targets
+}
+
+/*
+objectTargets returns the dependency index keys of the object: the targets of dependencyTargets, the ConfigMaps its cluster.local
+addresses are read from, and the template ConfigMap if the object picks a template, so that the changes of these ConfigMaps queue
+the object
+*/
+func (h *Handler) objectTargets(obj metav1.Object, refs map[string]string) []string {
+	targets := dependencyTargets(obj, refs)
+	for _, name := range h.AttributeHandler.WatchedConfigMaps(obj) {
+		targets = append(targets, dependency.ConfigMapKey(obj.GetNamespace(), name))
+	}
+	if namespace, name, ok := strings.Cut(h.TemplateConfigMap, "/"); ok && obj.GetLabels()[np.TemplateLabel] != "" {
+		targets = append(targets, dependency.ConfigMapKey(namespace, name))
+	}
+	return targets
+}
+
+// _declaredWorkloadKinds maps the kinds of the workloads which can be declared in the annotations to their kinds in the entries
+var _declaredWorkloadKinds = map[string]string{
+	"Deployment":  "deploy",
+	"StatefulSet": "sts",
+	"DaemonSet":   "ds",
+}
+
+// workloadTargetKeys returns the dependency index keys the annotation entries of other objects can refer to the workload by
+func workloadTargetKeys(obj metav1.Object) []string {
+	kind, ok := _declaredWorkloadKinds[object.Kind(obj)]
+	if !ok {
+		return nil
+	}
+	return []string{dependency.WorkloadKey(kind, obj.GetNamespace(), obj.GetName())}
+}
+
+// configMapChanged reports whether the data of the ConfigMap has changed, which might change the addresses found in it
+func configMapChanged(oldCM *corev1.ConfigMap, newCM *corev1.ConfigMap) bool {
+	return !attr.MapsEqual(oldCM.Data, newCM.Data)
+}
+
+// serviceTargetKeys returns the dependency index keys a Service can be referred to by
+func serviceTargetKeys(svc *corev1.Service) []string {
+	keys := []string{dependency.ServiceKey(svc.GetNamespace(), svc.GetName())}
+	for _, ip := range append([]string{svc.Spec.ClusterIP}, svc.Spec.ClusterIPs...) {
+		if ip != "" && ip != corev1.ClusterIPNone {
+			keys = append(keys, dependency.ServiceIPKey(ip))
+		}
+	}
+	return keys
+}
+
+// podTargetKeys returns the dependency index keys a Pod can be referred to by
+func podTargetKeys(pod *corev1.Pod) []string {
+	keys := []string{dependency.PodKey(pod.GetNamespace(), pod.GetName())}
+	for _, ip := range append([]string{pod.Status.PodIP}, podIPs(pod)...) {
+		if ip != "" {
+			keys = append(keys, dependency.PodIPKey(ip))
+		}
+	}
+	return keys
+}
+
+func podIPs(pod *corev1.Pod) []string {
+	ips := make([]string, 0, len(pod.Status.PodIPs))
+	for _, ip := range pod.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	return ips
+}
+
+/*
+serviceChanged reports whether the Service has changed in a way that affects how the addresses pointing at it are resolved, or
+which ports the Pods behind it serve on
+*/
+func serviceChanged(oldSvc *corev1.Service, newSvc *corev1.Service) bool {
+	return !attr.MapsEqual(oldSvc.Spec.Selector, newSvc.Spec.Selector) ||
+		!reflect.DeepEqual(oldSvc.Spec.Ports, newSvc.Spec.Ports) ||
+		oldSvc.Spec.Type != newSvc.Spec.Type ||
+		oldSvc.Spec.ExternalName != newSvc.Spec.ExternalName ||
+		!reflect.DeepEqual(oldSvc.Spec.ClusterIPs, newSvc.Spec.ClusterIPs)
+}
+
+// podChanged reports whether the Pod has changed in a way that affects how the addresses pointing at it are resolved
+func podChanged(oldPod *corev1.Pod, newPod *corev1.Pod) bool {
+	return !attr.MapsEqual(oldPod.GetLabels(), newPod.GetLabels()) ||
+		oldPod.Status.PodIP != newPod.Status.PodIP ||
+		!reflect.DeepEqual(podIPs(oldPod), podIPs(newPod))
+}
+
+/*
+getLocalRefs collects every cluster.local address the object refers to, found by the dependency detectors (e.g in its environment
+variables, or in the ConfigMaps mounted into its Pods). The addresses are keyed by the detector and the place they were found in.
+*/
+func (h *Handler) getLocalRefs(obj metav1.Object) (map[string]string, error) {
+	refs, err := h.AttributeHandler.DetectReferences(obj)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	ingressPol, egressPol, err := h.NetworkPolicyHandler.AppendLabelsToPeers(podLabels)
+	addresses := make(map[string]string, len(refs))
+	for _, ref := range refs {
+		addresses[ref.Key()] = ref.Address
+	}
+	return addresses, nil
+}
+
+// groupPod returns the object the Pod's policy belongs to: the Pod itself, or an OwnedPod standing in for the Pods of its owner
+func (h *Handler) groupPod(pod *corev1.Pod) (metav1.Object, error) {
+	if h.Owners == nil || len(pod.GetOwnerReferences()) == 0 {
+		return pod, nil
+	}
+	return h.Owners.GroupPod(pod)
+}
+
+/*
+hasOtherPods reports whether the owner of the Pod has other Pods left, which still need the policy shared by the owner's Pods. The
+Pods are told apart by their top-level owner, since the Pods of other owners might have the same labels.
+*/
+func (h *Handler) hasOtherPods(owned *object.OwnedPod) (bool, error) {
+	ownedLabels := owned.SharedLabels()
+
+	// Pods without shared labels can't be narrowed down by a selector, SelectorFromSet would match every Pod of the namespace anyway
+	opts := metav1.ListOptions{}
+	if len(ownedLabels) > 0 {
+		opts.LabelSelector = labels.SelectorFromSet(ownedLabels).String()
+	}
+	pods, err := h.Client.CoreV1().Pods(owned.GetNamespace()).List(context.Background(), opts)
 	if err != nil {
-		return err
+		return false, fmt.Errorf("could not list the pods of %s. %w", owned.GetName(), err)
 	}
-	np.ExtendPeers(ingressPol, egressPol, p)
 
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Name == owned.Pod.Name || pod.DeletionTimestamp != nil || len(pod.OwnerReferences) == 0 {
+			continue
+		}
+		top, err := h.Owners.TopOwner(pod)
+		if err != nil {
+			// the Pods garbage collected together with their owner don't need the policy
+			if errors.Is(err, object.ErrOwnerNotFound) {
+				continue
+			}
+			return false, err
+		}
+		if top != nil && top.UID == owned.Owner.UID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// reportPending reports the pending dependencies recorded in the object's policy as warning Events
+func (h *Handler) reportPending(obj metav1.Object, p *networkingv1.NetworkPolicy) {
+	for _, ref := range np.Pending(p) {
+		h.warn(obj, "PendingDependency", fmt.Sprintf("%s can't be resolved yet, it's added to the policy once it shows up", ref))
+	}
+}
+
+/*
+handleEndpointSliceChange queues the objects which depend on the Service the EndpointSlice belongs to, so that the Pods and
+addresses behind Services without selectors are kept up to date
+*/
+func (h *Handler) handleEndpointSliceChange(slice *discoveryv1.EndpointSlice) error {
+	svcName := slice.Labels[discoveryv1.LabelServiceName]
+	if svcName == "" {
+		return nil
+	}
+
+	h.enqueueDependents(dependency.ServiceKey(slice.GetNamespace(), svcName))
 	return nil
 }
 
-// HandleAdd handles the case when a K8s object of interest is added to the cluster, and creates a NetworkPolicy for it
-func (h *Handler) HandleAdd(obj interface{}) error {
-	var p *networkingv1.NetworkPolicy
-	objLabels, metaObj, err := object.ConvertToMeta(obj)
+// enqueueDependents queues the reconciliation of every object which depends on any of the targets
+func (h *Handler) enqueueDependents(targets ...string) {
+	for _, t := range targets {
+		for _, dep := range h.Dependencies.Dependents(t) {
+			h.enqueue(dep)
+		}
+	}
+}
+
+// enqueue queues the reconciliation of the object. Without a Queue, the object is reconciled right away
+func (h *Handler) enqueue(obj metav1.Object) {
+	if h.Queue == nil {
+		if err := h.reconcile(obj); err != nil {
+			log.Printf("could not reconcile NetworkPolicy of %s: %v \n", obj.GetName(), err)
+		}
+		return
+	}
+	h.Queue.Add(dependency.ObjectKey(obj))
+}
+
+// Run reconciles the queued objects until the context is cancelled
+func (h *Handler) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		h.Queue.ShutDown()
+	}()
+
+	for h.processNextItem() {
+	}
+}
+
+// processNextItem reconciles the next queued object. It returns false once the Queue is shut down
+func (h *Handler) processNextItem() bool {
+	item, shutdown := h.Queue.Get()
+	if shutdown {
+		return false
+	}
+	defer h.Queue.Done(item)
+
+	// the object has been deleted since it was queued
+	obj, ok := h.Dependencies.Object(item.(string))
+	if !ok {
+		h.Queue.Forget(item)
+		return true
+	}
+
+	if err := h.reconcile(obj); err != nil {
+		if h.Queue.NumRequeues(item) < maxRetries {
+			log.Printf("could not reconcile NetworkPolicy of %s, retrying: %v \n", obj.GetName(), err)
+			h.Queue.AddRateLimited(item)
+			return true
+		}
+		log.Printf("could not reconcile NetworkPolicy of %s, giving up: %v \n", obj.GetName(), err)
+	}
+	h.Queue.Forget(item)
+	return true
+}
+
+/*
+reconcile builds the NetworkPolicy of the object from scratch, and replaces the existing one with it, so that the labels of targets
+which have changed their selectors or labels since are dropped
+*/
+func (h *Handler) reconcile(obj metav1.Object) error {
+	selector, metaObj, err := h.convertToMeta(obj)
 	if err != nil {
 		return err
 	}
-	policyName := fmt.Sprintf("%s-%s-netpol", metaObj.GetName(), metaObj.GetNamespace())
 
 	// we don't mess around in the kube-system namespace
 	if metaObj.GetNamespace() == "kube-system" {
 		return errors.New("objects in the kube-system namespace won't be modified")
 	}
 
-	if len(metaObj.GetLabels()) == 0 {
-		h.ObjectHandler = object.NewHandler(h.DyanmicClient, metaObj)
-		if err := h.ObjectHandler.AddLabel(); err != nil {
-			return err
-		}
+	// the unselectable objects have been reported when they were added, retrying them won't help until their Pods get labels
+	if object.OptedOut(metaObj) || (h.NonIntrusive && isEmptySelector(selector)) {
+		return nil
 	}
 
-	envVars, err := h.AttributeHandler.GetLocalEnvVars(metaObj)
-	if err != nil && !errors.Is(err, attr.ErrNoEnvVars) {
+	return h.reconcileGroup(selector, collisionGroup(append(h.collidingObjects(selector, metaObj), metaObj)...))
+}
+
+// policyName returns the name of the NetworkPolicy belonging to the object
+func policyName(obj metav1.Object) string {
+	return np.PolicyName(object.Kind(obj), obj.GetName())
+}
+
+/*
+handleOptOut handles the objects with the OptOutAnnotation. Their policy and the label the controller has added to their Pods are
+removed. Their dependencies are still tracked, so that the policies of their targets keep letting them in.
+*/
+func (h *Handler) handleOptOut(metaObj metav1.Object, selector *metav1.LabelSelector) error {
+	if err := h.trackDependencies(metaObj); err != nil {
 		return err
 	}
 
-	envLabels, err := h.AttributeHandler.GetLabelsFromEnvVars(envVars)
+	// the policy of another object selecting the same labels is never removed
+	if err := h.deleteOwnedPolicy(metaObj, selector); err != nil {
+		return err
+	}
+
+	if h.NonIntrusive {
+		return nil
+	}
+	h.ObjectHandler = object.NewHandler(h.DyanmicClient, metaObj)
+	return h.ObjectHandler.RemoveLabel()
+}
+
+/*
+buildPolicy creates the NetworkPolicy of the object from its selector, cluster.local addresses and declared dependencies, and
+records the targets of the object in the dependency index
+*/
+func (h *Handler) buildPolicy(selector *metav1.LabelSelector, metaObj metav1.Object) (*networkingv1.NetworkPolicy, error) {
+	name := policyName(metaObj)
+
+	envVars, err := h.getLocalRefs(metaObj)
+	if err != nil && !errors.Is(err, attr.ErrNoEnvVars) {
+		return nil, err
+	}
+
+	// the targets which don't exist yet are left out, and the policy is updated once they show up
+	envTargets, pending, err := h.AttributeHandler.ResolveEnvVarTargets(envVars)
+	if err != nil && !errors.Is(err, attr.ErrNoEnvVars) {
+		return nil, err
+	}
+	envPeers, portRules := np.NewPortRules(metaObj.GetNamespace(), envTargets)
+
+	ingressDecl, egressDecl, declPending, warnings, err := h.declaredPeers(metaObj)
 	if err != nil {
-		if errors.Is(err, attr.ErrNoEnvVars) || errors.Is(err, attr.ErrResourceNotFound) {
-			p, err = h.NetworkPolicyHandler.NewPolicy(policyName, metaObj.GetNamespace(), objLabels, h.AttributeHandler.ConvertLabels(metaObj.GetLabels()))
-			if err != nil {
-				return fmt.Errorf("could not deploy new policy for %s. %w", metaObj.GetName(), err)
-			}
-		} else {
-			return err
+		return nil, err
+	}
+	pending = append(pending, declPending...)
+	for _, w := range warnings {
+		h.warn(metaObj, "InvalidDependency", w)
+	}
+
+	dependentPeers, err := h.dependentPeers(metaObj)
+	if err != nil {
+		return nil, err
+	}
+
+	ingressPorts, warnings, err := h.AttributeHandler.GetIngressPorts(metaObj)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range warnings {
+		h.warn(metaObj, "InvalidIngressPort", w)
+	}
+
+	profile, err := h.policyProfile(metaObj)
+	if err != nil {
+		return nil, err
+	}
+
+	cidrs, err := h.AttributeHandler.GetIPBlocksFromEnvVars(envVars)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := h.newPolicy(name, metaObj, selector, np.Peers{
+		Self:         h.AttributeHandler.ConvertLabels(selector.MatchLabels),
+		Dependencies: append(envPeers, egressDecl...),
+		// the objects depending on this one have to be able to reach it, even on CNIs that enforce both sides of the traffic
+		Dependents:   append(ingressDecl, dependentPeers...),
+		PortRules:    portRules,
+		IngressPorts: ingressPorts,
+		IPBlocks:     cidrs,
+		Profile:      profile,
+		Template:     metaObj.GetLabels()[np.TemplateLabel],
+		Owner:        metaObj,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not deploy new policy for %s. %w", metaObj.GetName(), err)
+	}
+	np.SetOwner(object.Kind(metaObj), metaObj.GetName(), p)
+	np.SetPending(pending, p)
+	h.reportPending(metaObj, p)
+
+	targets := h.objectTargets(metaObj, envVars)
+	h.enqueueTargetOwners(metaObj, dependency.Changed(h.Dependencies.Set(metaObj, targets), targets))
+
+	return p, nil
+}
+
+/*
+newPolicy builds the NetworkPolicy of the object from the peers. If the profile or the template the object picks can't be used, the
+problem is reported, and the policy is built without them.
+*/
+func (h *Handler) newPolicy(name string, metaObj metav1.Object, selector *metav1.LabelSelector, peers np.Peers) (*networkingv1.NetworkPolicy, error) {
+	for {
+		p, err := h.NetworkPolicyHandler.NewPolicy(name, metaObj.GetNamespace(), selector, peers)
+		switch {
+		case errors.Is(err, np.ErrUnknownProfile) && peers.Profile != "":
+			h.warn(metaObj, "UnknownProfile", fmt.Sprintf("%v, the default profile is used instead", err))
+			peers.Profile = ""
+		case (errors.Is(err, np.ErrTemplateNotFound) || errors.Is(err, np.ErrInvalidTemplate) || errors.Is(err, np.ErrInvalidPolicy)) && peers.Template != "":
+			h.warn(metaObj, "InvalidTemplate", fmt.Sprintf("%v, the policy is built without the template", err))
+			peers.Template = ""
+		default:
+			return p, err
 		}
-	} else {
-		allLabels, err := h.AttributeHandler.MergeLabels(h.AttributeHandler.ConvertLabels(objLabels), envLabels)
+	}
+}
+
+// HandleAdd handles the case when a K8s object of interest is added to the cluster, and creates a NetworkPolicy for it
+func (h *Handler) HandleAdd(obj interface{}) error {
+	if slice, ok := obj.(*discoveryv1.EndpointSlice); ok {
+		return h.handleEndpointSliceChange(slice)
+	}
+
+	switch target := obj.(type) {
+	case *corev1.Namespace:
+		return h.handleNamespaceChange(target)
+	case *corev1.ConfigMap:
+		h.enqueueDependents(dependency.ConfigMapKey(target.Namespace, target.Name))
+		return nil
+	case *corev1.Service:
+		// Services are not objects of interest, but the dependencies pointing at them might be pending
+		h.enqueueDependents(serviceTargetKeys(target)...)
+		h.handleServiceOwnersChange(target)
+		return nil
+	case *corev1.Pod:
+		h.enqueueDependents(podTargetKeys(target)...)
+
+		group, err := h.groupPod(target)
 		if err != nil {
 			return err
 		}
-
-		p, err = h.NetworkPolicyHandler.NewPolicy(policyName, metaObj.GetNamespace(), objLabels, allLabels)
-		if err != nil {
-			return fmt.Errorf("could not deploy new policy for %s. %w", metaObj.GetName(), err)
+		// the Pods of an owner share one policy, which might exist already
+		if owned, ok := group.(*object.OwnedPod); ok {
+			return h.reconcile(owned)
 		}
 	}
 
-	h.ObjectHandler = object.NewHandler(h.DyanmicClient, p)
-	err = h.ObjectHandler.Mutate(object.Create)
+	selector, metaObj, err := h.convertToMeta(obj)
 	if err != nil {
 		return err
 	}
+	// the objects declaring the workload in their annotations might be waiting for it
+	h.enqueueDependents(workloadTargetKeys(metaObj)...)
 
-	log.Printf("NetworkPolicy %s added for %s \n", policyName, metaObj.GetName())
-	return nil
+	// we don't mess around in the kube-system namespace
+	if metaObj.GetNamespace() == "kube-system" {
+		return errors.New("objects in the kube-system namespace won't be modified")
+	}
+
+	switch {
+	case object.OptedOut(metaObj):
+		return h.handleOptOut(metaObj, selector)
+	case h.NonIntrusive && isEmptySelector(selector):
+		// the object is left as it is, and can get a policy once its Pods have labels
+		h.warn(metaObj, "Unselectable", "the object has no labels to select its Pods by, and it's not labeled in non-intrusive mode")
+		return nil
+	case isEmptySelector(selector):
+		h.ObjectHandler = object.NewHandler(h.DyanmicClient, metaObj)
+		if err := h.ObjectHandler.AddLabel(); err != nil {
+			return err
+		}
+		selector = &metav1.LabelSelector{MatchLabels: map[string]string{object.ManagedLabel: object.ManagedLabelValue(metaObj)}}
+	}
+
+	// the Pods are selected by other objects too, they get one policy instead of one per object
+	if others := h.collidingObjects(selector, metaObj); len(others) > 0 {
+		group := collisionGroup(append(others, metaObj)...)
+		h.reportCollision(metaObj, group)
+		return h.reconcileGroup(selector, group)
+	}
+
+	// the object might have a policy already, e.g one created before the controller restarted, or one with the legacy name
+	return h.reconcileGroup(selector, []metav1.Object{metaObj})
 }
 
 /*
-HandleUpdate handles the case when a K8s object of interest is updated in the cluster, provided the object's environment variables
-or labels have changed
+HandleUpdate handles the case when a K8s object of interest is updated in the cluster, and rebuilds its NetworkPolicy if the object's
+cluster.local addresses, labels or policy annotations have changed
 */
 func (h *Handler) HandleUpdate(oldObj, newObj interface{}) error {
-	newLabels, newMetaObj, err := object.ConvertToMeta(newObj)
+	switch newTarget := newObj.(type) {
+	case *discoveryv1.EndpointSlice:
+		return h.handleEndpointSliceChange(newTarget)
+	case *corev1.Namespace:
+		oldTarget, ok := oldObj.(*corev1.Namespace)
+		if ok && oldTarget.Annotations[np.ProfileAnnotation] != newTarget.Annotations[np.ProfileAnnotation] {
+			h.enqueueNamespace(newTarget.Name)
+		}
+		// the resyncs of the labeled namespaces bring back the baseline policies deleted by hand
+		if wantsBaseline(newTarget) || (ok && wantsBaseline(oldTarget)) {
+			return h.handleNamespaceChange(newTarget)
+		}
+		return nil
+	case *corev1.ConfigMap:
+		oldTarget, ok := oldObj.(*corev1.ConfigMap)
+		if ok && configMapChanged(oldTarget, newTarget) {
+			h.enqueueDependents(dependency.ConfigMapKey(newTarget.Namespace, newTarget.Name))
+		}
+		return nil
+	case *corev1.Service:
+		oldTarget, ok := oldObj.(*corev1.Service)
+		if ok && serviceChanged(oldTarget, newTarget) {
+			h.enqueueDependents(append(serviceTargetKeys(oldTarget), serviceTargetKeys(newTarget)...)...)
+			h.handleServiceOwnersChange(oldTarget, newTarget)
+		}
+		return nil
+	case *corev1.Pod:
+		// Pods can be targets and objects of interest at the same time
+		oldTarget, ok := oldObj.(*corev1.Pod)
+		if ok && podChanged(oldTarget, newTarget) {
+			h.enqueueDependents(append(podTargetKeys(oldTarget), podTargetKeys(newTarget)...)...)
+		}
+
+		group, err := h.groupPod(newTarget)
+		if err != nil {
+			return err
+		}
+		if owned, ok := group.(*object.OwnedPod); ok {
+			if oldTarget != nil && attr.MapsEqual(oldTarget.Labels, newTarget.Labels) && attr.MapsEqual(oldTarget.Annotations, newTarget.Annotations) {
+				return nil
+			}
+			return h.reconcile(owned)
+		}
+	}
+
+	newSelector, newMetaObj, err := h.convertToMeta(newObj)
 	if err != nil {
 		return err
 	}
@@ -158,78 +709,236 @@ func (h *Handler) HandleUpdate(oldObj, newObj interface{}) error {
 		return errors.New("objects in the kube-system namespace won't be modified")
 	}
 
-	oldLabels, oldMetaObj, err := object.ConvertToMeta(oldObj)
+	oldSelector, oldMetaObj, err := h.convertToMeta(oldObj)
 	if err != nil {
 		return err
 	}
+	// the peers of the objects declaring the workload in their annotations select its Pods by its selector
+	if !selectorsEqual(newSelector, oldSelector) {
+		h.enqueueDependents(workloadTargetKeys(newMetaObj)...)
+	}
 
-	oldObjEnvVars, err := h.AttributeHandler.GetLocalEnvVars(oldMetaObj)
+	if object.OptedOut(newMetaObj) {
+		return h.handleOptOut(newMetaObj, newSelector)
+	}
+	if object.OptedOut(oldMetaObj) {
+		return h.HandleAdd(newMetaObj)
+	}
+
+	oldObjEnvVars, err := h.getLocalRefs(oldMetaObj)
 	if err != nil {
 		return err
 	}
-	newObjEnvVars, err := h.AttributeHandler.GetLocalEnvVars(newMetaObj)
+	newObjEnvVars, err := h.getLocalRefs(newMetaObj)
 	if err != nil {
 		return err
 	}
 
-	if attr.MapsEqual(newObjEnvVars, oldObjEnvVars) && attr.MapsEqual(newLabels, oldLabels) {
+	targets := h.objectTargets(newMetaObj, newObjEnvVars)
+	h.enqueueTargetOwners(newMetaObj, dependency.Changed(h.Dependencies.Set(newMetaObj, targets), targets))
+
+	if attr.MapsEqual(newObjEnvVars, oldObjEnvVars) && selectorsEqual(newSelector, oldSelector) && declaredAnnotationsEqual(oldMetaObj, newMetaObj) &&
+		ingressPortsEqual(oldMetaObj, newMetaObj) &&
+		oldMetaObj.GetAnnotations()[np.ProfileAnnotation] == newMetaObj.GetAnnotations()[np.ProfileAnnotation] &&
+		oldMetaObj.GetLabels()[np.TemplateLabel] == newMetaObj.GetLabels()[np.TemplateLabel] {
 		return nil
 	}
 
-	// if the updated object does not have a NetworkPolicy yet, we create one
-	p, err := h.NetworkPolicyHandler.GetPolicyByPodLabels(oldMetaObj.GetNamespace(), oldLabels)
-	if err != nil {
-		if errors.Is(err, np.ErrNotFound) {
-			h.ObjectHandler = object.NewHandler(h.DyanmicClient, newMetaObj)
-			err = h.HandleAdd(newMetaObj)
-			if err != nil {
+	if !selectorsEqual(newSelector, oldSelector) {
+		// the objects which shared the policy with the old selector get it rebuilt without this one
+		if oldOthers := h.collidingObjects(oldSelector, oldMetaObj); len(oldOthers) > 0 {
+			if err := h.reconcileGroup(oldSelector, collisionGroup(oldOthers...)); err != nil {
 				return err
 			}
-			return nil
 		}
-		return err
+		if newOthers := h.collidingObjects(newSelector, newMetaObj); len(newOthers) > 0 {
+			h.reportCollision(newMetaObj, collisionGroup(append(newOthers, newMetaObj)...))
+		}
 	}
 
-	if !attr.MapsEqual(newLabels, oldLabels) {
-		err := h.handleLabelChange(oldLabels, newLabels, p)
-		if err != nil {
-			return err
-		}
+	// the policy is rebuilt as a whole, the targets of the old object might have been deleted or relabeled since
+	return h.reconcile(newMetaObj)
+}
+
+/*
+ownedPolicy returns the NetworkPolicy of the object: the one recorded as its own, or for the policies created before the owner was
+recorded, the one with the object's policy name or legacy policy name which selects the Pods of the object. Those are adopted with the
+next update of the policy, which records the owner. The policies are never looked up by the peers selecting the Pods, since the peers
+of the dependencies select the same Pods, and the policies recorded as the policy of another object are never returned.
+*/
+func (h *Handler) ownedPolicy(obj metav1.Object, selector *metav1.LabelSelector) (*networkingv1.NetworkPolicy, error) {
+	p, err := h.NetworkPolicyHandler.GetPolicyByOwner(obj.GetNamespace(), object.Kind(obj), obj.GetName())
+	if !errors.Is(err, np.ErrNotFound) {
+		return p, err
 	}
 
-	if !attr.MapsEqual(newObjEnvVars, oldObjEnvVars) {
-		err := h.handleEnvVarChange(newLabels, newObjEnvVars, p)
-		if err != nil {
-			return err
+	for _, name := range []string{policyName(obj), np.LegacyPolicyName(obj.GetName(), obj.GetNamespace())} {
+		p, err = h.Client.NetworkingV1().NetworkPolicies(obj.GetNamespace()).Get(context.Background(), name, metav1.GetOptions{})
+		switch {
+		case k8serrors.IsNotFound(err):
+			continue
+		case err != nil:
+			return nil, err
 		}
+		if kind, _ := np.Owner(p); kind != "" || selector == nil || !equality.Semantic.DeepEqual(p.Spec.PodSelector, *selector) {
+			continue
+		}
+		return p, nil
 	}
+	return nil, np.ErrNotFound
+}
 
-	h.ObjectHandler = object.NewHandler(h.DyanmicClient, p)
-	err = h.ObjectHandler.Mutate(object.Update)
+// deleteOwnedPolicy deletes the NetworkPolicy of the object, if it has one
+func (h *Handler) deleteOwnedPolicy(obj metav1.Object, selector *metav1.LabelSelector) error {
+	p, err := h.ownedPolicy(obj, selector)
+	switch {
+	case errors.Is(err, np.ErrNotFound):
+		return nil
+	case err != nil:
+		return err
+	}
+
+	if err := object.NewHandler(h.DyanmicClient, p).Mutate(object.Delete); err != nil {
+		return err
+	}
+	log.Printf("NetworkPolicy %s deleted for %s \n", p.GetName(), obj.GetName())
+	return nil
+}
+
+// ownerGone reports whether the object of the kind does not exist anymore. The objects of unknown kinds are never reported as gone.
+func (h *Handler) ownerGone(kind string, namespace string, name string) (bool, error) {
+	gvr, ok := object.GVRForKind(kind)
+	if !ok {
+		return false, nil
+	}
+
+	_, err := h.DyanmicClient.Resource(gvr).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+		return true, nil
+	case err != nil:
+		return false, err
+	}
+	return false, nil
+}
+
+/*
+handleUnknownFinalState handles the deletes the informer has missed, without knowing the final state of the object. Only the
+namespace/name key of the object is known, so the policies owned by an object of that name are deleted, once their owner is
+confirmed to be gone - a Pod and a Deployment can have the same name.
+*/
+func (h *Handler) handleUnknownFinalState(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
 	if err != nil {
 		return err
 	}
 
-	log.Printf("NetworkPolicy %s updated for %s \n", p.GetName(), newMetaObj.GetName())
+	policies, err := h.Client.NetworkingV1().NetworkPolicies(namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: np.ManagedByLabel + "=" + np.ManagedByValue,
+	})
+	if err != nil {
+		return fmt.Errorf("could not list the policies of %s. %w", namespace, err)
+	}
+
+	for i := range policies.Items {
+		p := &policies.Items[i]
+		kind, owner := np.Owner(p)
+		if owner != name {
+			continue
+		}
+		gone, err := h.ownerGone(kind, namespace, name)
+		if err != nil {
+			return err
+		}
+		if !gone {
+			continue
+		}
+
+		for _, obj := range h.Dependencies.Objects(namespace) {
+			if obj.GetName() == name && object.Kind(obj) == kind {
+				h.enqueueTargetOwners(obj, h.Dependencies.Remove(obj))
+			}
+		}
+
+		h.ObjectHandler = object.NewHandler(h.DyanmicClient, p)
+		if err := h.ObjectHandler.Mutate(object.Delete); err != nil {
+			return err
+		}
+		log.Printf("NetworkPolicy %s deleted for %s/%s, its final state is unknown \n", p.GetName(), kind, name)
+	}
 	return nil
 }
 
 /*
 HandleDelete handles the case when an object of interest is deleted from the cluster. If the object had a NetworkPolicy belonging to it,
-the policy gets deleted
+the policy gets deleted. The deletes the informer has missed come as tombstones, with the last known state of the object if there is one.
 */
 func (h *Handler) HandleDelete(obj interface{}) error {
-	objLabels, metaObj, err := object.ConvertToMeta(obj)
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		if tombstone.Obj == nil {
+			return h.handleUnknownFinalState(tombstone.Key)
+		}
+		obj = tombstone.Obj
+	}
+
+	switch target := obj.(type) {
+	case *discoveryv1.EndpointSlice:
+		return h.handleEndpointSliceChange(target)
+	case *corev1.Namespace:
+		// the baseline policy goes away with the namespace
+		return nil
+	case *corev1.ConfigMap:
+		h.enqueueDependents(dependency.ConfigMapKey(target.Namespace, target.Name))
+		return nil
+	case *corev1.Service:
+		h.enqueueDependents(serviceTargetKeys(target)...)
+		h.handleServiceOwnersChange(target)
+		return nil
+	case *corev1.Pod:
+		h.enqueueDependents(podTargetKeys(target)...)
+
+		group, err := h.groupPod(target)
+		if h.Owners != nil {
+			h.Owners.Forget(target)
+		}
+		if err != nil {
+			return err
+		}
+		if owned, ok := group.(*object.OwnedPod); ok {
+			remaining, err := h.hasOtherPods(owned)
+			if err != nil || remaining {
+				return err
+			}
+			obj = owned
+		}
+	}
+
+	selector, metaObj, err := h.convertToMeta(obj)
 	if err != nil {
 		return err
 	}
+	h.enqueueTargetOwners(metaObj, h.Dependencies.Remove(metaObj))
+	h.enqueueDependents(workloadTargetKeys(metaObj)...)
+
+	// opted out objects don't have a policy
+	if object.OptedOut(metaObj) {
+		return nil
+	}
 
 	// we don't mess around in the kube-system namespace
 	if metaObj.GetNamespace() == "kube-system" {
 		return errors.New("objects in the kube-system namespace won't be modified")
 	}
 
-	p, err := h.NetworkPolicyHandler.GetPolicyByPodLabels(metaObj.GetNamespace(), objLabels)
+	// the Pods are still selected by other objects, which get a policy of their own
+	if others := h.collidingObjects(selector, metaObj); len(others) > 0 {
+		if err := h.reconcileGroup(selector, collisionGroup(others...)); err != nil {
+			return err
+		}
+		return h.deleteOwnedPolicy(metaObj, selector)
+	}
+
+	p, err := h.ownedPolicy(metaObj, selector)
 	if err != nil {
 		return err
 	}
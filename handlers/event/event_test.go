@@ -6,19 +6,28 @@ import (
 	"testing"
 
 	"github.com/adykaaa/k8s-netpol-ctrl/handlers/attribute"
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/dependency"
 	"github.com/adykaaa/k8s-netpol-ctrl/handlers/networkpolicy"
 	"github.com/adykaaa/k8s-netpol-ctrl/handlers/object"
 	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/dynamic"
 	dynamicfake "k8s.io/client-go/dynamic/fake"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 )
 
 func deployPolicyForDynamic(t *testing.T, client dynamic.Interface) (*networkingv1.NetworkPolicy, error) {
@@ -26,7 +35,7 @@ func deployPolicyForDynamic(t *testing.T, client dynamic.Interface) (*networking
 
 	networkPolicy := &networkingv1.NetworkPolicy{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "testpolicy",
+			Name:      "pod-testname-netpol",
 			Namespace: "testnamespace",
 		},
 		Spec: networkingv1.NetworkPolicySpec{
@@ -139,26 +148,12 @@ func returnTestPod(t *testing.T, labels map[string]string) *corev1.Pod {
 	}
 }
 
-func returnTestSvc(t *testing.T, labels map[string]string) *corev1.Service {
-	t.Helper()
-
-	return &corev1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      "testname",
-			Namespace: "testnamespace",
-		},
-		Spec: corev1.ServiceSpec{
-			Selector: labels,
-		},
-	}
-}
-
 func deployPolicyForSimple(t *testing.T, c kubernetes.Interface, podSelector map[string]string) (*networkingv1.NetworkPolicy, error) {
 	t.Helper()
 
 	p := &networkingv1.NetworkPolicy{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      "testpolicy",
+			Name:      "pod-testname-netpol",
 			Namespace: "testnamespace",
 		},
 		Spec: networkingv1.NetworkPolicySpec{
@@ -218,6 +213,41 @@ func deployPolicyForSimple(t *testing.T, c kubernetes.Interface, podSelector map
 	return p, nil
 }
 
+// egressOnlyLabelSelectorReq reports whether every target is in the egress peers of the policy, and none of them is in the ingress peers
+func egressOnlyLabelSelectorReq(t *testing.T, targets []metav1.LabelSelectorRequirement, policy *networkingv1.NetworkPolicy) bool {
+	t.Helper()
+
+	hasReq := func(peers []networkingv1.NetworkPolicyPeer, target metav1.LabelSelectorRequirement) bool {
+		for _, peer := range peers {
+			if peer.PodSelector == nil {
+				continue
+			}
+			for _, req := range peer.PodSelector.MatchExpressions {
+				if reflect.DeepEqual(target, req) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	for _, target := range targets {
+		for _, ingressRule := range policy.Spec.Ingress {
+			if hasReq(ingressRule.From, target) {
+				return false
+			}
+		}
+		inEgress := false
+		for _, egressRule := range policy.Spec.Egress {
+			inEgress = inEgress || hasReq(egressRule.To, target)
+		}
+		if !inEgress {
+			return false
+		}
+	}
+	return true
+}
+
 func containsLabelSelectorReq(t *testing.T, targets []metav1.LabelSelectorRequirement, policy *networkingv1.NetworkPolicy) bool {
 	t.Helper()
 
@@ -259,240 +289,6 @@ func containsLabelSelectorReq(t *testing.T, targets []metav1.LabelSelectorRequir
 	return true
 }
 
-func TestHandleLabelChange(t *testing.T) {
-	testCases := []struct {
-		name                     string
-		newLabels                map[string]string
-		expectedLabelSelectorReq []metav1.LabelSelectorRequirement
-		testErr                  func(t *testing.T, err error)
-	}{
-		{
-			name:      "OK - old reqs removed, new one added",
-			newLabels: map[string]string{"label1": "value1"},
-			expectedLabelSelectorReq: []metav1.LabelSelectorRequirement{
-				{
-					Key:      "label1",
-					Operator: metav1.LabelSelectorOpIn,
-					Values:   []string{"value1"},
-				},
-			},
-			testErr: func(t *testing.T, err error) {
-				assert.NoError(t, err)
-			},
-		},
-		{
-			name:      "OK - labels removed",
-			newLabels: map[string]string{"app": "test"},
-			expectedLabelSelectorReq: []metav1.LabelSelectorRequirement{
-				{
-					Key:      "app",
-					Operator: metav1.LabelSelectorOpIn,
-					Values:   []string{"test"},
-				},
-			},
-			testErr: func(t *testing.T, err error) {
-				assert.NoError(t, err)
-			},
-		},
-		{
-			name:      "errors - new labels empty",
-			newLabels: map[string]string{},
-			expectedLabelSelectorReq: []metav1.LabelSelectorRequirement{
-				{
-					Key:      "app",
-					Operator: metav1.LabelSelectorOpIn,
-					Values:   []string{"test"},
-				},
-			},
-			testErr: func(t *testing.T, err error) {
-				assert.Error(t, err)
-			},
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			c := fake.NewSimpleClientset()
-			h := &Handler{
-				Client: c,
-				AttributeHandler: &attribute.Handler{
-					Client: c,
-				},
-				NetworkPolicyHandler: &networkpolicy.Handler{
-					Client: c,
-				},
-			}
-			oldLabels := map[string]string{"app": "test", "label2": "value2"}
-			p, _ := deployPolicyForSimple(t, h.Client, oldLabels)
-
-			err := h.handleLabelChange(oldLabels, tc.newLabels, p)
-			tc.testErr(t, err)
-
-			for _, er := range p.Spec.Egress {
-				for _, peer := range er.To {
-					reflect.DeepEqual(peer.PodSelector.MatchExpressions, tc.expectedLabelSelectorReq)
-				}
-			}
-
-			for _, ir := range p.Spec.Ingress {
-				for _, peer := range ir.From {
-					reflect.DeepEqual(peer.PodSelector.MatchExpressions, tc.expectedLabelSelectorReq)
-				}
-			}
-
-		})
-	}
-}
-
-func TestHandleEnvVarChange(t *testing.T) {
-	testCases := []struct {
-		name                     string
-		inputEnvVars             map[string]string
-		inputObjLabels           map[string]string
-		testObj                  string
-		expectedLabelSelectorReq []metav1.LabelSelectorRequirement
-		testErr                  func(t *testing.T, err error)
-	}{
-		{
-			name:           "OK - adding Pod labels to NetworkPolicy",
-			inputEnvVars:   map[string]string{"test": "testname.testnamespace.pod.cluster.local"},
-			inputObjLabels: map[string]string{"podlabel": "value1"},
-			testObj:        "pod",
-			expectedLabelSelectorReq: []metav1.LabelSelectorRequirement{
-				{
-					Key:      "podlabel",
-					Operator: metav1.LabelSelectorOpIn,
-					Values:   []string{"value1"},
-				},
-			},
-
-			testErr: func(t *testing.T, err error) {
-				assert.NoError(t, err)
-			},
-		},
-		{
-			name:           "OK - adding Svc -> Pod labels to NetworkPolicy",
-			inputEnvVars:   map[string]string{"test": "testname.testnamespace.svc.cluster.local"},
-			inputObjLabels: map[string]string{"svclabel": "value1"},
-			testObj:        "svc",
-			expectedLabelSelectorReq: []metav1.LabelSelectorRequirement{
-				{
-					Key:      "svclabel",
-					Operator: metav1.LabelSelectorOpIn,
-					Values:   []string{"value1"},
-				},
-			},
-
-			testErr: func(t *testing.T, err error) {
-				assert.NoError(t, err)
-			},
-		},
-		{
-			name:           "fails - object doesn't exist in the cluster",
-			inputEnvVars:   map[string]string{"test": "nonexistent.stuff.svc.cluster.local"},
-			inputObjLabels: map[string]string{"svclabel": "value1"},
-			testObj:        "svc",
-			expectedLabelSelectorReq: []metav1.LabelSelectorRequirement{
-				{
-					Key:      "randomlabel",
-					Operator: metav1.LabelSelectorOpIn,
-					Values:   []string{"value1"},
-				},
-			},
-
-			testErr: func(t *testing.T, err error) {
-				assert.Error(t, err)
-			},
-		},
-		{
-			name:           "fails - no env vars",
-			inputEnvVars:   map[string]string{},
-			inputObjLabels: map[string]string{"svclabel": "value1"},
-			testObj:        "svc",
-			expectedLabelSelectorReq: []metav1.LabelSelectorRequirement{
-				{
-					Key:      "",
-					Operator: metav1.LabelSelectorOpIn,
-					Values:   []string{},
-				},
-			},
-
-			testErr: func(t *testing.T, err error) {
-				assert.ErrorIs(t, err, attribute.ErrNoEnvVars)
-			},
-		},
-		{
-			name:           "fails - no input labels",
-			inputEnvVars:   map[string]string{"test": "testname.testnamespace.svc.cluster.local"},
-			inputObjLabels: map[string]string{},
-			testObj:        "svc",
-			expectedLabelSelectorReq: []metav1.LabelSelectorRequirement{
-				{
-					Key:      "",
-					Operator: metav1.LabelSelectorOpIn,
-					Values:   []string{},
-				},
-			},
-
-			testErr: func(t *testing.T, err error) {
-				assert.Error(t, err)
-			},
-		},
-	}
-
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			var envErr error
-			c := fake.NewSimpleClientset()
-
-			h := &Handler{
-				Client: c,
-				AttributeHandler: &attribute.Handler{
-					Client: c,
-				},
-				NetworkPolicyHandler: &networkpolicy.Handler{
-					Client: c,
-				},
-			}
-
-			policy, _ := deployPolicyForSimple(t, h.Client, tc.inputObjLabels)
-
-			switch tc.testObj {
-			case "pod":
-				pod := returnTestPod(t, tc.inputObjLabels)
-
-				p, err := h.Client.CoreV1().Pods(pod.GetNamespace()).Create(context.Background(), pod, metav1.CreateOptions{})
-				if err != nil {
-					t.Fatalf("test pod creation failed. %v", err)
-				}
-
-				envErr = h.handleEnvVarChange(p.GetLabels(), tc.inputEnvVars, policy)
-				tc.testErr(t, envErr)
-
-			case "svc":
-				svc := returnTestSvc(t, tc.inputObjLabels)
-
-				s, err := h.Client.CoreV1().Services(svc.GetNamespace()).Create(context.Background(), svc, metav1.CreateOptions{})
-				if err != nil {
-					t.Fatalf("test pod creation failed. %v", err)
-				}
-				envErr = h.handleEnvVarChange(s.Spec.Selector, tc.inputEnvVars, policy)
-				tc.testErr(t, envErr)
-			}
-
-			_, err := h.Client.NetworkingV1().NetworkPolicies(policy.Namespace).Update(context.Background(), policy, metav1.UpdateOptions{})
-			if err != nil {
-				t.Fatalf("test policy update failed! %v", err)
-			}
-
-			if envErr == nil && !containsLabelSelectorReq(t, tc.expectedLabelSelectorReq, policy) {
-				t.Errorf("policy not modified as expected. Expected: %v, Actual %v", tc.expectedLabelSelectorReq, policy.Spec.Ingress[0].From)
-			}
-
-		})
-	}
-}
-
 func TestHandleAdd(t *testing.T) {
 	testCases := []struct {
 		name                     string
@@ -683,6 +479,7 @@ func TestHandleUpdate(t *testing.T) {
 		newObj                   interface{}
 		deployAuxObj             func(t *testing.T, c kubernetes.Interface)
 		expectedLabelSelectorReq []metav1.LabelSelectorRequirement
+		expectedEgressOnlyReq    []metav1.LabelSelectorRequirement
 		shouldNotContainReq      []metav1.LabelSelectorRequirement
 		testErr                  func(t *testing.T, err error)
 	}{
@@ -852,6 +649,8 @@ func TestHandleUpdate(t *testing.T) {
 					Operator: metav1.LabelSelectorOpIn,
 					Values:   []string{"value2"},
 				},
+			},
+			expectedEgressOnlyReq: []metav1.LabelSelectorRequirement{
 				{
 					Key:      "pod",
 					Operator: metav1.LabelSelectorOpIn,
@@ -991,6 +790,10 @@ func TestHandleUpdate(t *testing.T) {
 						t.Fatalf("policy does not contain LabelSelectorReq %v", tc.expectedLabelSelectorReq)
 					}
 
+					if !egressOnlyLabelSelectorReq(t, tc.expectedEgressOnlyReq, &p) {
+						t.Fatalf("policy does not contain LabelSelectorReq %v in its egress rules only", tc.expectedEgressOnlyReq)
+					}
+
 					if len(tc.shouldNotContainReq) > 0 && containsLabelSelectorReq(t, tc.shouldNotContainReq, &p) {
 						t.Fatalf("policy %v should not contain %v", p, tc.shouldNotContainReq)
 					}
@@ -1002,6 +805,122 @@ func TestHandleUpdate(t *testing.T) {
 	}
 }
 
+func TestHandleUpdateRebuildsPolicy(t *testing.T) {
+	c := fake.NewSimpleClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "testnamespace"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "api"}},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "testnamespace"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "db"}},
+		},
+	)
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	oldPod := returnTestPod(t, map[string]string{"app": "backend"})
+	oldPod.Spec.Containers = []corev1.Container{{
+		Name: "containername",
+		Env:  []corev1.EnvVar{{Name: "API", Value: "api.testnamespace.svc.cluster.local"}},
+	}}
+	assert.NoError(t, h.HandleAdd(oldPod))
+	// the policy is looked up through the typed client, so it's copied there
+	p := getPolicyByName(t, h, "pod-testname-netpol")
+	_, err := c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), p, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	newPod := oldPod.DeepCopy()
+	newPod.Spec.Containers[0].Env = []corev1.EnvVar{{Name: "DB", Value: "db.testnamespace.svc.cluster.local"}}
+	assert.NoError(t, h.HandleUpdate(oldPod, newPod))
+
+	// the policy is rebuilt from the new object, so the target it doesn't refer to anymore is dropped
+	p = getPolicyByName(t, h, "pod-testname-netpol")
+	assert.True(t, egressOnlyLabelSelectorReq(t, []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"db"}},
+	}, p))
+	assert.False(t, egressOnlyLabelSelectorReq(t, []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"api"}},
+	}, p))
+}
+
+func TestAdoptLegacyPolicy(t *testing.T) {
+	testCases := []struct {
+		name        string
+		podSelector map[string]string
+		remaining   []string
+	}{
+		{
+			name:        "OK - the legacy policy selecting the Pods is adopted",
+			podSelector: map[string]string{"app": "backend"},
+			remaining:   []string{"testname-testnamespace-netpol"},
+		},
+		{
+			name:        "OK - the legacy policy selecting other Pods is left alone",
+			podSelector: map[string]string{"app": "other"},
+			remaining:   []string{"testname-testnamespace-netpol", "pod-testname-netpol"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			legacy := &networkingv1.NetworkPolicy{
+				TypeMeta:   metav1.TypeMeta{Kind: "NetworkPolicy", APIVersion: "networking.k8s.io/v1"},
+				ObjectMeta: metav1.ObjectMeta{Name: "testname-testnamespace-netpol", Namespace: "testnamespace"},
+				Spec:       networkingv1.NetworkPolicySpec{PodSelector: metav1.LabelSelector{MatchLabels: tc.podSelector}},
+			}
+			u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(legacy)
+			assert.NoError(t, err)
+
+			// the policy is looked up through the typed client, so it's copied there
+			c := fake.NewSimpleClientset(legacy)
+			dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+				{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+			}, &unstructured.Unstructured{Object: u})
+			h := &Handler{
+				Client:        c,
+				DyanmicClient: dc,
+				NetworkPolicyHandler: &networkpolicy.Handler{
+					Client: c,
+				},
+				AttributeHandler: &attribute.Handler{
+					Client: c,
+				},
+				Dependencies: dependency.NewIndex(),
+			}
+
+			assert.NoError(t, h.HandleAdd(returnTestPod(t, map[string]string{"app": "backend"})))
+
+			allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+			if err != nil {
+				t.Fatalf("error during retrieving all test policies")
+			}
+			var names []string
+			for _, p := range allPolicies {
+				names = append(names, p.Name)
+			}
+			assert.ElementsMatch(t, tc.remaining, names)
+
+			// the adopted policy records its owner, so it's found by it from now on
+			kind, name := networkpolicy.Owner(getPolicyByName(t, h, tc.remaining[len(tc.remaining)-1]))
+			assert.Equal(t, "Pod", kind)
+			assert.Equal(t, "testname", name)
+		})
+	}
+}
+
 func TestHandleDelete(t *testing.T) {
 	testCases := []struct {
 		name    string
@@ -1012,7 +931,7 @@ func TestHandleDelete(t *testing.T) {
 			name: "OK",
 			obj: &corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
-					Name:      "testpod",
+					Name:      "testname",
 					Namespace: "testnamespace",
 					Labels:    map[string]string{"app": "test"},
 				},
@@ -1091,3 +1010,1861 @@ func TestHandleDelete(t *testing.T) {
 		})
 	}
 }
+
+func TestHandleDeleteTombstone(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "testnamespace"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "api"}}},
+		},
+	}
+
+	testCases := []struct {
+		name      string
+		tombstone cache.DeletedFinalStateUnknown
+		remaining []string
+		testErr   func(t *testing.T, err error)
+	}{
+		{
+			name:      "OK - tombstone with the final state",
+			tombstone: cache.DeletedFinalStateUnknown{Key: "testnamespace/api", Obj: deployment},
+			remaining: []string{"pod-api-netpol"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:      "OK - tombstone without the final state only removes the policies of the objects that are gone",
+			tombstone: cache.DeletedFinalStateUnknown{Key: "testnamespace/api"},
+			remaining: []string{"pod-api-netpol"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:      "errors - malformed key",
+			tombstone: cache.DeletedFinalStateUnknown{Key: "a/b/c"},
+			remaining: []string{"deployment-api-netpol", "pod-api-netpol"},
+			testErr: func(t *testing.T, err error) {
+				assert.Error(t, err)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			// the Pod named like the Deployment still exists, so its policy has to stay
+			pod := &unstructured.Unstructured{Object: map[string]interface{}{
+				"apiVersion": "v1",
+				"kind":       "Pod",
+				"metadata":   map[string]interface{}{"name": "api", "namespace": "testnamespace"},
+			}}
+			c := fake.NewSimpleClientset()
+			dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+				{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+				{Group: "", Version: "v1", Resource: "pods"}:                             "PodList",
+				{Group: "apps", Version: "v1", Resource: "deployments"}:                  "DeploymentList",
+			}, pod)
+
+			h := &Handler{
+				Client:        c,
+				DyanmicClient: dc,
+				NetworkPolicyHandler: &networkpolicy.Handler{
+					Client: c,
+				},
+				AttributeHandler: &attribute.Handler{
+					Client: c,
+				},
+				Dependencies: dependency.NewIndex(),
+			}
+
+			// the policies are created in both clients, the typed one serves the lookups and the dynamic one the deletes
+			for _, owner := range []metav1.Object{deployment, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "testnamespace"}}} {
+				p := &networkingv1.NetworkPolicy{
+					TypeMeta:   metav1.TypeMeta{Kind: "NetworkPolicy", APIVersion: "networking.k8s.io/v1"},
+					ObjectMeta: metav1.ObjectMeta{Name: policyName(owner), Namespace: "testnamespace"},
+					Spec:       networkingv1.NetworkPolicySpec{PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}}},
+				}
+				networkpolicy.SetOwner(object.Kind(owner), owner.GetName(), p)
+
+				_, err := c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), p, metav1.CreateOptions{})
+				assert.NoError(t, err)
+				u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(p)
+				assert.NoError(t, err)
+				_, err = dc.Resource(networkingv1.SchemeGroupVersion.WithResource("networkpolicies")).Namespace("testnamespace").
+					Create(context.Background(), &unstructured.Unstructured{Object: u}, metav1.CreateOptions{})
+				assert.NoError(t, err)
+			}
+
+			err := h.HandleDelete(tc.tombstone)
+			tc.testErr(t, err)
+
+			allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+			if err != nil {
+				t.Fatalf("error during retrieving all test policies")
+			}
+			var names []string
+			for _, p := range allPolicies {
+				names = append(names, p.Name)
+			}
+			assert.ElementsMatch(t, tc.remaining, names)
+		})
+	}
+}
+
+func TestHandleEndpointSliceChange(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	podLabels := map[string]string{"app": "test", "label2": "value2"}
+	_, _ = deployPolicyForDynamic(t, h.DyanmicClient)
+	_, _ = deployPolicyForSimple(t, h.Client, podLabels)
+
+	pod := returnTestPod(t, podLabels)
+	pod.Spec.Containers = []corev1.Container{
+		{
+			Name: "containername",
+			Env:  []corev1.EnvVar{{Name: "DB", Value: "legacy-db.testnamespace.svc.cluster.local"}},
+		},
+	}
+	h.Dependencies.Set(pod, []string{dependency.ServiceKey("testnamespace", "legacy-db")})
+
+	_, err := c.CoreV1().Services("testnamespace").Create(context.Background(), &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "legacy-db", Namespace: "testnamespace"},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("error creating test svc %v", err)
+	}
+
+	slice := &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "legacy-db-1",
+			Namespace: "testnamespace",
+			Labels:    map[string]string{discoveryv1.LabelServiceName: "legacy-db"},
+		},
+		AddressType: discoveryv1.AddressTypeIPv4,
+		Endpoints:   []discoveryv1.Endpoint{{Addresses: []string{"192.168.10.4"}}},
+	}
+	_, err = c.DiscoveryV1().EndpointSlices("testnamespace").Create(context.Background(), slice, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("error creating test endpointslice %v", err)
+	}
+
+	err = h.HandleUpdate(slice, slice)
+	assert.NoError(t, err)
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	assert.Contains(t, allPolicies[0].Spec.Egress[0].To, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: "192.168.10.4/32"}})
+}
+
+func TestHandleAddDeclaredDependencies(t *testing.T) {
+	c := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "api"}},
+	})
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	recorder := record.NewFakeRecorder(10)
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Recorder: recorder,
+	}
+
+	err := h.HandleAdd(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "backend",
+			Namespace: "testnamespace",
+			Labels:    map[string]string{"app": "backend"},
+			Annotations: map[string]string{
+				attribute.EgressToAnnotation:    "svc/api.default, svc api",
+				attribute.IngressFromAnnotation: "ns/monitoring",
+			},
+		},
+	})
+	assert.NoError(t, err)
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+
+	apiPeer := networkingv1.NetworkPolicyPeer{
+		PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}},
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/metadata.name": "default"}},
+	}
+	monitoringPeer := networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/metadata.name": "monitoring"}},
+	}
+	assert.Contains(t, allPolicies[0].Spec.Egress[0].To, apiPeer)
+	assert.NotContains(t, allPolicies[0].Spec.Ingress[0].From, apiPeer)
+	assert.Contains(t, allPolicies[0].Spec.Ingress[0].From, monitoringPeer)
+	assert.NotContains(t, allPolicies[0].Spec.Egress[0].To, monitoringPeer)
+
+	select {
+	case e := <-recorder.Events:
+		assert.Contains(t, e, "Warning InvalidDependency")
+	default:
+		t.Errorf("expected a warning event for the malformed entry")
+	}
+}
+
+func TestHandleDeclaredChange(t *testing.T) {
+	c := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "testnamespace"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "api"}},
+	})
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	pod := func(egressTo string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "backend",
+				Namespace:   "testnamespace",
+				Labels:      map[string]string{"app": "backend"},
+				Annotations: map[string]string{attribute.EgressToAnnotation: egressTo},
+			},
+		}
+	}
+	oldPod, newPod := pod("svc/api"), pod("ns/monitoring")
+	assert.NoError(t, h.HandleAdd(oldPod))
+
+	// the policy is looked up through the typed client, so it's copied there
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	_, err = c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), &allPolicies[0], metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// the declared Service is relabeled before the annotation changes, the old annotation doesn't resolve to its old peer anymore
+	_, err = c.CoreV1().Services("testnamespace").Update(context.Background(), &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "testnamespace"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "api-v2"}},
+	}, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, h.HandleUpdate(oldPod, newPod))
+
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	apiPeer := networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}}}
+	monitoringPeer := networkingv1.NetworkPolicyPeer{
+		NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/metadata.name": "monitoring"}},
+	}
+	assert.NotContains(t, allPolicies[0].Spec.Egress[0].To, apiPeer)
+	assert.Contains(t, allPolicies[0].Spec.Egress[0].To, monitoringPeer)
+}
+
+func TestHandleAddNonIntrusive(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	recorder := record.NewFakeRecorder(10)
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Recorder:     recorder,
+		NonIntrusive: true,
+	}
+
+	// a Deployment without labels of its own is selected by its selector, and left alone
+	err := h.HandleAdd(&appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "testnamespace"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "api"}}},
+		},
+	})
+	assert.NoError(t, err)
+
+	// a Pod without labels can't be selected, so it's reported instead of labeled
+	err = h.HandleAdd(&corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "unlabeled", Namespace: "testnamespace"}})
+	assert.NoError(t, err)
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	assert.Equal(t, "deployment-api-netpol", allPolicies[0].Name)
+
+	for _, action := range dc.Actions() {
+		assert.Equal(t, "networkpolicies", action.GetResource().Resource, "unexpected %s of %s", action.GetVerb(), action.GetResource().Resource)
+	}
+
+	select {
+	case e := <-recorder.Events:
+		assert.Contains(t, e, "Warning Unselectable")
+	default:
+		t.Errorf("expected a warning event for the unlabeled pod")
+	}
+}
+
+func TestHandleOptOut(t *testing.T) {
+	pod := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Pod",
+		"metadata":   map[string]interface{}{"name": "unlabeled", "namespace": "testnamespace"},
+	}}
+	c := fake.NewSimpleClientset()
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+		{Group: "", Version: "v1", Resource: "pods"}:                             "PodList",
+	}, pod)
+	podsGVR := schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	// a Pod without labels is labeled by a patch, and its policy selects it by the label
+	err := h.HandleAdd(&corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "unlabeled", Namespace: "testnamespace"},
+	})
+	assert.NoError(t, err)
+
+	labeled, err := dc.Resource(podsGVR).Namespace("testnamespace").Get(context.Background(), "unlabeled", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{object.ManagedLabel: "unlabeled-testnamespace"}, labeled.GetLabels())
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	assert.Equal(t, map[string]string{object.ManagedLabel: "unlabeled-testnamespace"}, allPolicies[0].Spec.PodSelector.MatchLabels)
+
+	// the policy is looked up through the typed client, so it's copied there
+	_, err = c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), &allPolicies[0], metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// once the Pod opts out, its policy is removed along with the label
+	err = h.HandleUpdate(&corev1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: "unlabeled", Namespace: "testnamespace", Labels: labeled.GetLabels()},
+	}, &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "unlabeled",
+			Namespace:   "testnamespace",
+			Labels:      labeled.GetLabels(),
+			Annotations: map[string]string{object.OptOutAnnotation: "true"},
+		},
+	})
+	assert.NoError(t, err)
+
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Empty(t, allPolicies)
+
+	unlabeled, err := dc.Resource(podsGVR).Namespace("testnamespace").Get(context.Background(), "unlabeled", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, unlabeled.GetLabels())
+}
+
+func TestHandleNamespaceBaseline(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		Dependencies:      dependency.NewIndex(),
+		NamespaceBaseline: true,
+	}
+
+	labeled := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop", Labels: map[string]string{BaselineLabel: BaselineDeny}}}
+	unlabeled := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop"}}
+
+	// kube-system and the namespaces without the label don't get a baseline
+	assert.NoError(t, h.HandleAdd(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "kube-system", Labels: labeled.Labels}}))
+	assert.NoError(t, h.HandleAdd(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "blog"}}))
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Empty(t, allPolicies)
+
+	// a labeled namespace gets the baseline
+	assert.NoError(t, h.HandleAdd(labeled))
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	assert.Equal(t, "namespace-shop-netpol", allPolicies[0].Name)
+	assert.Empty(t, allPolicies[0].Spec.Ingress)
+
+	// the policy is looked up through the typed client, so it's copied there
+	_, err = c.NetworkingV1().NetworkPolicies("shop").Create(context.Background(), &allPolicies[0], metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// the resync of the labeled namespace keeps the baseline, without rewriting it
+	dc.ClearActions()
+	assert.NoError(t, h.HandleUpdate(labeled, labeled))
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	for _, action := range dc.Actions() {
+		assert.NotEqual(t, "update", action.GetVerb())
+	}
+
+	// removing the label removes the baseline
+	assert.NoError(t, h.HandleUpdate(labeled, unlabeled))
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Empty(t, allPolicies)
+
+	// deleting a namespace is a no-op, its policies go away with it
+	assert.NoError(t, h.HandleDelete(labeled))
+}
+
+func TestHandleNamespaceBaselineConflict(t *testing.T) {
+	// a policy of the baseline's name, created by someone else
+	foreign := &networkingv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: "namespace-shop-netpol", Namespace: "shop"},
+		Spec:       networkingv1.NetworkPolicySpec{PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+	}
+	c := fake.NewSimpleClientset(foreign)
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	recorder := record.NewFakeRecorder(10)
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		Dependencies:      dependency.NewIndex(),
+		NamespaceBaseline: true,
+		Recorder:          recorder,
+	}
+
+	labeled := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop", Labels: map[string]string{BaselineLabel: BaselineDeny}}}
+	assert.NoError(t, h.HandleAdd(labeled))
+	assert.NoError(t, h.HandleUpdate(labeled, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop"}}))
+
+	// the policy is neither overwritten nor removed
+	assert.Empty(t, dc.Actions())
+	assert.Contains(t, <-recorder.Events, "BaselineConflict")
+}
+
+func TestHandleAddProfile(t *testing.T) {
+	c := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+		Name:        "testnamespace",
+		Annotations: map[string]string{networkpolicy.ProfileAnnotation: "open-egress"},
+	}})
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	recorder := record.NewFakeRecorder(10)
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+		Recorder:     recorder,
+	}
+
+	deployment := func(name string, profile string) *appsv1.Deployment {
+		d := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "testnamespace"},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+				Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": name}}},
+			},
+		}
+		if profile != "" {
+			d.Annotations = map[string]string{networkpolicy.ProfileAnnotation: profile}
+		}
+		return d
+	}
+
+	// the profile of the workload wins over the one of its namespace
+	assert.NoError(t, h.HandleAdd(deployment("api", "strict")))
+	assert.NoError(t, h.HandleAdd(deployment("worker", "")))
+	assert.NoError(t, h.HandleAdd(deployment("legacy", "lenient")))
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	policies := make(map[string]*networkingv1.NetworkPolicy, len(allPolicies))
+	for i := range allPolicies {
+		policies[allPolicies[i].Name] = &allPolicies[i]
+	}
+	assert.Len(t, policies, 3)
+
+	assert.Equal(t, "strict", networkpolicy.AppliedProfile(policies["deployment-api-netpol"]))
+	assert.Len(t, policies["deployment-api-netpol"].Spec.Ingress[0].From, 1)
+	assert.NotEmpty(t, policies["deployment-api-netpol"].Spec.Egress)
+
+	assert.Equal(t, "open-egress", networkpolicy.AppliedProfile(policies["deployment-worker-netpol"]))
+	assert.Empty(t, policies["deployment-worker-netpol"].Spec.Egress)
+
+	// an unknown profile falls back to the default one, and is reported
+	assert.Empty(t, networkpolicy.AppliedProfile(policies["deployment-legacy-netpol"]))
+	assert.NotEmpty(t, policies["deployment-legacy-netpol"].Spec.Egress)
+	select {
+	case e := <-recorder.Events:
+		assert.Contains(t, e, "Warning UnknownProfile")
+	default:
+		t.Errorf("expected a warning event for the unknown profile")
+	}
+
+	// the policies are looked up through the typed client, so they are copied there
+	_, err = c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), policies["deployment-api-netpol"], metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// dropping the profile of the workload rebuilds its policy with the profile of the namespace
+	assert.NoError(t, h.HandleUpdate(deployment("api", "strict"), deployment("api", "")))
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	for _, p := range allPolicies {
+		if p.Name == "deployment-api-netpol" {
+			assert.Equal(t, "open-egress", networkpolicy.AppliedProfile(&p))
+			assert.Empty(t, p.Spec.Egress)
+		}
+	}
+}
+
+func TestHandleAddTemplate(t *testing.T) {
+	c := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "netpol-ctrl-templates", Namespace: "kube-system"},
+		Data: map[string]string{
+			"ingress-only": "spec:\n  ingress: {{ toJSON .Policy.Spec.Ingress }}\n  policyTypes: [\"Ingress\"]\n",
+			"broken":       "spec:\n  egress:\n  - to:\n    - ipBlock:\n        cidr: not-a-cidr\n",
+		},
+	})
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	recorder := record.NewFakeRecorder(10)
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client:            c,
+			TemplateNamespace: "kube-system",
+			TemplateConfigMap: "netpol-ctrl-templates",
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+		Recorder:     recorder,
+	}
+
+	deployment := func(name string, template string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "testnamespace", Labels: map[string]string{networkpolicy.TemplateLabel: template}},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+				Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": name}}},
+			},
+		}
+	}
+
+	assert.NoError(t, h.HandleAdd(deployment("api", "ingress-only")))
+	assert.NoError(t, h.HandleAdd(deployment("worker", "broken")))
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 2)
+	for _, p := range allPolicies {
+		switch p.Name {
+		case "deployment-api-netpol":
+			assert.Equal(t, "ingress-only", networkpolicy.AppliedTemplate(&p))
+			assert.Equal(t, map[string]string{"app": "api"}, p.Spec.PodSelector.MatchLabels)
+			assert.NotEmpty(t, p.Spec.Ingress)
+			assert.Empty(t, p.Spec.Egress)
+		case "deployment-worker-netpol":
+			// the invalid template is reported, and the policy is built without it
+			assert.Empty(t, networkpolicy.AppliedTemplate(&p))
+			assert.NotEmpty(t, p.Spec.Egress)
+		default:
+			t.Errorf("unexpected policy %s", p.Name)
+		}
+	}
+
+	select {
+	case e := <-recorder.Events:
+		assert.Contains(t, e, "Warning InvalidTemplate")
+	default:
+		t.Errorf("expected a warning event for the invalid template")
+	}
+}
+
+// catalogDetector stands in for a custom detector, which knows the dependencies of the workloads from a service catalog
+type catalogDetector map[string][]string
+
+func (catalogDetector) Name() string {
+	return "catalog"
+}
+
+func (d catalogDetector) Detect(obj metav1.Object, _ attribute.ClusterView) ([]attribute.Reference, error) {
+	var refs []attribute.Reference
+	for _, address := range d[obj.GetName()] {
+		refs = append(refs, attribute.Reference{Address: address, Source: obj.GetName()})
+	}
+	return refs, nil
+}
+
+func TestHandleAddCustomDetector(t *testing.T) {
+	c := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "payments", Namespace: "testnamespace"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "payments"}},
+	})
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client:    c,
+			Detectors: []attribute.DependencyDetector{catalogDetector{"testname": {"payments.testnamespace.svc.cluster.local"}}},
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	// the env. var detector is switched off, so only the dependency from the catalog ends up in the policy
+	pod := returnTestPod(t, map[string]string{"app": "checkout"})
+	pod.Spec.Containers = []corev1.Container{
+		{
+			Name: "containername",
+			Env:  []corev1.EnvVar{{Name: "API", Value: "api.testnamespace.svc.cluster.local"}},
+		},
+	}
+	assert.NoError(t, h.HandleAdd(pod))
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	assert.True(t, egressOnlyLabelSelectorReq(t, []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"payments"}},
+	}, &allPolicies[0]))
+	assert.Empty(t, networkpolicy.Pending(&allPolicies[0]))
+}
+
+func TestHandleConfigMapChange(t *testing.T) {
+	c := fake.NewSimpleClientset(
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "payments", Namespace: "testnamespace"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "payments"}},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "ledger", Namespace: "testnamespace"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "ledger"}},
+		},
+	)
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client:           c,
+			ConfigMapIndexer: indexer,
+			Detectors:        []attribute.DependencyDetector{attribute.ConfigMapDetector{}, attribute.EnvVarDetector{}},
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	configMap := func(upstream string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "app-conf", Namespace: "testnamespace"},
+			Data:       map[string]string{"nginx.conf": "proxy_pass http://" + upstream + ":8080;"},
+		}
+	}
+	oldCM, newCM := configMap("payments.testnamespace.svc.cluster.local"), configMap("ledger.testnamespace.svc.cluster.local")
+	assert.NoError(t, indexer.Add(oldCM))
+
+	pod := returnTestPod(t, map[string]string{"app": "checkout"})
+	pod.Spec.Volumes = []corev1.Volume{{Name: "conf", VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+		LocalObjectReference: corev1.LocalObjectReference{Name: "app-conf"},
+	}}}}
+	assert.NoError(t, h.HandleAdd(pod))
+	assert.Len(t, h.Dependencies.Dependents(dependency.ConfigMapKey("testnamespace", "app-conf")), 1)
+
+	// the policy is looked up through the typed client, so it's copied there
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	_, err = c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), &allPolicies[0], metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// the resyncs don't change anything
+	assert.NoError(t, h.HandleUpdate(oldCM, oldCM))
+
+	assert.NoError(t, indexer.Update(newCM))
+	assert.NoError(t, h.HandleUpdate(oldCM, newCM))
+
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	assert.True(t, egressOnlyLabelSelectorReq(t, []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"ledger"}},
+	}, &allPolicies[0]))
+	assert.False(t, egressOnlyLabelSelectorReq(t, []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"payments"}},
+	}, &allPolicies[0]))
+}
+
+func TestHandleTemplateChange(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client:            c,
+			TemplateNamespace: "kube-system",
+			TemplateConfigMap: "netpol-ctrl-templates",
+			ConfigMapIndexer:  indexer,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies:      dependency.NewIndex(),
+		TemplateConfigMap: "kube-system/netpol-ctrl-templates",
+	}
+
+	templates := func(cidr string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "netpol-ctrl-templates", Namespace: "kube-system"},
+			Data:       map[string]string{"egress": "spec:\n  egress:\n  - to:\n    - ipBlock:\n        cidr: " + cidr + "\n"},
+		}
+	}
+	oldCM, newCM := templates("10.0.0.0/8"), templates("192.168.0.0/16")
+	assert.NoError(t, indexer.Add(oldCM))
+
+	assert.NoError(t, h.HandleAdd(returnTestPod(t, map[string]string{"app": "checkout", networkpolicy.TemplateLabel: "egress"})))
+	assert.Len(t, h.Dependencies.Dependents(dependency.ConfigMapKey("kube-system", "netpol-ctrl-templates")), 1)
+
+	// the policy is looked up through the typed client, so it's copied there
+	p := getPolicyByName(t, h, "pod-testname-netpol")
+	assert.Equal(t, "10.0.0.0/8", p.Spec.Egress[0].To[0].IPBlock.CIDR)
+	_, err := c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), p, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// the changed template is rendered again for the objects picking it
+	assert.NoError(t, indexer.Update(newCM))
+	assert.NoError(t, h.HandleUpdate(oldCM, newCM))
+	p = getPolicyByName(t, h, "pod-testname-netpol")
+	assert.Equal(t, "192.168.0.0/16", p.Spec.Egress[0].To[0].IPBlock.CIDR)
+}
+
+func TestHandleSelectorCollision(t *testing.T) {
+	deployment := func(name string, egressTo string) *appsv1.Deployment {
+		return &appsv1.Deployment{
+			TypeMeta: metav1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "testnamespace",
+				Annotations: map[string]string{attribute.EgressToAnnotation: egressTo},
+			},
+			Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}},
+				Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "api"}}},
+			},
+		}
+	}
+	namespacePeer := func(namespace string) networkingv1.NetworkPolicyPeer {
+		return networkingv1.NetworkPolicyPeer{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{corev1.LabelMetadataName: namespace}}}
+	}
+
+	tests := []struct {
+		name           string
+		mode           CollisionMode
+		expectedEgress []networkingv1.NetworkPolicyPeer
+		missingEgress  []networkingv1.NetworkPolicyPeer
+	}{
+		{
+			name:           "flag - the policy is built for the first object",
+			mode:           CollisionFlag,
+			expectedEgress: []networkingv1.NetworkPolicyPeer{namespacePeer("data")},
+			missingEgress:  []networkingv1.NetworkPolicyPeer{namespacePeer("cache")},
+		},
+		{
+			name:           "merge - the policy lets through the traffic of both objects",
+			mode:           CollisionMerge,
+			expectedEgress: []networkingv1.NetworkPolicyPeer{namespacePeer("data"), namespacePeer("cache")},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := fake.NewSimpleClientset()
+			dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+				{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+			})
+			recorder := record.NewFakeRecorder(10)
+
+			h := &Handler{
+				Client:        c,
+				DyanmicClient: dc,
+				NetworkPolicyHandler: &networkpolicy.Handler{
+					Client: c,
+				},
+				AttributeHandler: &attribute.Handler{
+					Client: c,
+				},
+				Dependencies: dependency.NewIndex(),
+				Recorder:     recorder,
+				Collisions:   tc.mode,
+			}
+
+			// the policies are looked up through the typed client, so they're copied there
+			syncPolicies := func() []networkingv1.NetworkPolicy {
+				allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+				if err != nil {
+					t.Fatalf("error during retrieving all test policies")
+				}
+				for i := range allPolicies {
+					p := allPolicies[i].DeepCopy()
+					if _, err := c.NetworkingV1().NetworkPolicies(p.Namespace).Update(context.Background(), p, metav1.UpdateOptions{}); err != nil {
+						_, err = c.NetworkingV1().NetworkPolicies(p.Namespace).Create(context.Background(), p, metav1.CreateOptions{})
+						assert.NoError(t, err)
+					}
+				}
+				return allPolicies
+			}
+
+			err := h.HandleAdd(deployment("api", "ns/data"))
+			assert.NoError(t, err)
+			syncPolicies()
+
+			err = h.HandleAdd(deployment("api-canary", "ns/cache"))
+			assert.NoError(t, err)
+			allPolicies := syncPolicies()
+
+			assert.Len(t, allPolicies, 1)
+			assert.Equal(t, "deployment-api-netpol", allPolicies[0].Name)
+			for _, peer := range tc.expectedEgress {
+				assert.Contains(t, allPolicies[0].Spec.Egress[0].To, peer)
+			}
+			for _, peer := range tc.missingEgress {
+				assert.NotContains(t, allPolicies[0].Spec.Egress[0].To, peer)
+			}
+
+			select {
+			case e := <-recorder.Events:
+				assert.Contains(t, e, "Warning SelectorCollision")
+				assert.Contains(t, e, "Deployment/api")
+			default:
+				t.Errorf("expected a warning event for the colliding object")
+			}
+
+			// the Pods are still selected by the canary, so the policy stays and is rebuilt for it
+			err = h.HandleDelete(deployment("api", "ns/data"))
+			assert.NoError(t, err)
+			allPolicies = syncPolicies()
+
+			assert.Len(t, allPolicies, 1)
+			assert.Contains(t, allPolicies[0].Spec.Egress[0].To, namespacePeer("cache"))
+			assert.NotContains(t, allPolicies[0].Spec.Egress[0].To, namespacePeer("data"))
+		})
+	}
+}
+
+func TestReconcileDependency(t *testing.T) {
+	backendLabels := map[string]string{"app": "backend"}
+	backend := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "backend", Namespace: "testnamespace"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: backendLabels},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: backendLabels}},
+		},
+	}
+	frontend := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "frontend", Namespace: "testnamespace"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "frontend"}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{
+					Name: "frontend",
+					Env:  []corev1.EnvVar{{Name: "BACKEND", Value: "backend-svc.testnamespace.svc.cluster.local"}},
+				}}},
+			},
+		},
+	}
+
+	c := fake.NewSimpleClientset(backend, frontend, &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "backend-svc", Namespace: "testnamespace"},
+		Spec:       corev1.ServiceSpec{Selector: backendLabels},
+	})
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	assert.NoError(t, h.HandleAdd(frontend))
+	// the policy is looked up through the typed client, so it's copied there
+	frontendPolicy := getPolicyByName(t, h, "deployment-frontend-netpol")
+	_, err := c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), frontendPolicy, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// the egress peers of frontend select the Pods of backend, but its policy is never taken for the policy of backend
+	assert.NoError(t, h.reconcile(backend))
+
+	reconciled := getPolicyByName(t, h, "deployment-frontend-netpol")
+	assert.Equal(t, frontendPolicy.Spec, reconciled.Spec)
+	kind, name := networkpolicy.Owner(reconciled)
+	assert.Equal(t, "Deployment", kind)
+	assert.Equal(t, "frontend", name)
+
+	backendPolicy := getPolicyByName(t, h, "deployment-backend-netpol")
+	assert.Equal(t, backendLabels, backendPolicy.Spec.PodSelector.MatchLabels)
+}
+
+func TestHandleUpdateDependency(t *testing.T) {
+	backendLabels := map[string]string{"app": "backend"}
+	frontend := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "frontend", Namespace: "testnamespace"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "frontend"}},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{
+					Name: "frontend",
+					Env:  []corev1.EnvVar{{Name: "BACKEND", Value: "backend-svc.testnamespace.svc.cluster.local"}},
+				}}},
+			},
+		},
+	}
+
+	c := fake.NewSimpleClientset(frontend,
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "backend-svc", Namespace: "testnamespace"},
+			Spec:       corev1.ServiceSpec{Selector: backendLabels},
+		},
+		&corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{Name: "db-svc", Namespace: "testnamespace"},
+			Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "db"}},
+		},
+	)
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	assert.NoError(t, h.HandleAdd(frontend))
+	// the policy is looked up through the typed client, so it's copied there
+	frontendPolicy := getPolicyByName(t, h, "deployment-frontend-netpol")
+	_, err := c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), frontendPolicy, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	// the backend Pod has no policy yet, and the egress peers of frontend select it
+	oldBackend := returnTestPod(t, backendLabels)
+	newBackend := returnTestPod(t, backendLabels)
+	newBackend.Spec.Containers = []corev1.Container{{
+		Name: "containername",
+		Env:  []corev1.EnvVar{{Name: "DB", Value: "db-svc.testnamespace.svc.cluster.local"}},
+	}}
+	assert.NoError(t, h.HandleUpdate(oldBackend, newBackend))
+
+	updated := getPolicyByName(t, h, "deployment-frontend-netpol")
+	assert.Equal(t, frontendPolicy.Spec, updated.Spec)
+
+	backendPolicy := getPolicyByName(t, h, "pod-testname-netpol")
+	assert.True(t, egressOnlyLabelSelectorReq(t, []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"db"}},
+	}, backendPolicy))
+}
+
+func TestHandleTargetChange(t *testing.T) {
+	podLabels := map[string]string{"app": "test", "label2": "value2"}
+
+	tests := []struct {
+		name     string
+		env      string
+		objects  []runtime.Object
+		oldObj   interface{}
+		newObj   interface{}
+		expected []string
+		stale    []string
+	}{
+		{
+			name: "OK - Service selector changed",
+			env:  "frontend-svc.testnamespace.svc.cluster.local",
+			objects: []runtime.Object{&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "frontend-svc", Namespace: "testnamespace"},
+				Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "frontend-v2"}},
+			}},
+			oldObj: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "frontend-svc", Namespace: "testnamespace"},
+				Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "frontend"}},
+			},
+			newObj: &corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "frontend-svc", Namespace: "testnamespace"},
+				Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "frontend-v2"}},
+			},
+			expected: []string{"test", "frontend-v2"},
+			stale:    []string{"frontend"},
+		},
+		{
+			name: "OK - Pod labels changed",
+			env:  "db-0.testnamespace.pod.cluster.local",
+			objects: []runtime.Object{&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "testnamespace", Labels: map[string]string{"app": "db-v2"}},
+			}},
+			oldObj: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "testnamespace", Labels: map[string]string{"app": "db"}},
+			},
+			newObj: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "db-0", Namespace: "testnamespace", Labels: map[string]string{"app": "db-v2"}},
+			},
+			expected: []string{"test", "db-v2"},
+			stale:    []string{"db"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := fake.NewSimpleClientset(tt.objects...)
+			dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+				{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+			})
+
+			h := &Handler{
+				Client:        c,
+				DyanmicClient: dc,
+				NetworkPolicyHandler: &networkpolicy.Handler{
+					Client: c,
+				},
+				AttributeHandler: &attribute.Handler{
+					Client: c,
+				},
+				Dependencies: dependency.NewIndex(),
+			}
+
+			_, _ = deployPolicyForDynamic(t, h.DyanmicClient)
+			_, _ = deployPolicyForSimple(t, h.Client, podLabels)
+
+			pod := returnTestPod(t, podLabels)
+			pod.Spec.Containers = []corev1.Container{
+				{
+					Name: "containername",
+					Env:  []corev1.EnvVar{{Name: "TARGET", Value: tt.env}},
+				},
+			}
+			ref, err := attribute.ParseLocalRef(tt.env)
+			if err != nil {
+				t.Fatalf("error parsing test ref %v", err)
+			}
+			h.Dependencies.Set(pod, localRefTargets(ref))
+
+			err = h.HandleUpdate(tt.oldObj, tt.newObj)
+			assert.NoError(t, err)
+
+			allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+			if err != nil {
+				t.Fatalf("error during retrieving all test policies")
+			}
+			// the target Pod is a standalone Pod too, so it might get a policy of its own
+			var p networkingv1.NetworkPolicy
+			for _, pol := range allPolicies {
+				if pol.Name == policyName(pod) {
+					p = pol
+				}
+			}
+
+			var values []string
+			for _, peer := range p.Spec.Egress[0].To {
+				if peer.PodSelector == nil {
+					continue
+				}
+				for _, req := range peer.PodSelector.MatchExpressions {
+					if req.Key == "app" {
+						values = append(values, req.Values...)
+					}
+				}
+			}
+			assert.Subset(t, values, tt.expected)
+			for _, v := range tt.stale {
+				assert.NotContains(t, values, v)
+			}
+		})
+	}
+}
+
+func TestDependencyTargets(t *testing.T) {
+	obj := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "backend",
+			Namespace:   "default",
+			Annotations: map[string]string{attribute.EgressToAnnotation: "svc/api, pod/worker-0.jobs, ns/monitoring"},
+		},
+	}
+	refs := map[string]string{
+		"DB":     "db.data.svc.cluster.local",
+		"WEB":    "web-0.web-headless.default.svc.cluster.local",
+		"CACHE":  "10-244-1-7.default.pod.cluster.local",
+		"LEGACY": "10.96.12.4",
+	}
+
+	assert.ElementsMatch(t, []string{
+		dependency.ServiceKey("data", "db"),
+		dependency.ServiceKey("default", "web-headless"),
+		dependency.PodKey("default", "web-0"),
+		dependency.PodIPKey("10.244.1.7"),
+		dependency.ServiceIPKey("10.96.12.4"),
+		dependency.ServiceKey("default", "api"),
+		dependency.PodKey("jobs", "worker-0"),
+	}, dependencyTargets(obj, refs))
+}
+
+func TestHandleAddPendingDependency(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	recorder := record.NewFakeRecorder(10)
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+		Recorder:     recorder,
+	}
+
+	pod := returnTestPod(t, map[string]string{"app": "backend"})
+	pod.Spec.Containers = []corev1.Container{
+		{
+			Name: "containername",
+			Env:  []corev1.EnvVar{{Name: "API", Value: "api.testnamespace.svc.cluster.local"}},
+		},
+	}
+
+	err := h.HandleAdd(pod)
+	assert.NoError(t, err)
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	assert.Equal(t, []string{"api.testnamespace.svc.cluster.local"}, networkpolicy.Pending(&allPolicies[0]))
+	assert.False(t, egressOnlyLabelSelectorReq(t, []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"api"}},
+	}, &allPolicies[0]))
+
+	select {
+	case e := <-recorder.Events:
+		assert.Contains(t, e, "Warning PendingDependency")
+	default:
+		t.Errorf("expected a warning event for the pending dependency")
+	}
+
+	// the policy of the object is created through the dynamic client, so the typed one has to know about it as well
+	_, err = c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), &allPolicies[0], metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("error creating test policy %v", err)
+	}
+
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "testnamespace"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "api"}},
+	}
+	_, err = c.CoreV1().Services("testnamespace").Create(context.Background(), svc, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("error creating test svc %v", err)
+	}
+
+	err = h.HandleAdd(svc)
+	assert.NoError(t, err)
+
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	assert.Empty(t, networkpolicy.Pending(&allPolicies[0]))
+	assert.True(t, egressOnlyLabelSelectorReq(t, []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"api"}},
+	}, &allPolicies[0]))
+}
+
+func TestHandleAddPendingWorkload(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	pod := returnTestPod(t, map[string]string{"app": "backend"})
+	pod.Annotations = map[string]string{attribute.EgressToAnnotation: "deploy/api"}
+	assert.NoError(t, h.HandleAdd(pod))
+
+	backendPolicy := getPolicyByName(t, h, "pod-testname-netpol")
+	assert.Equal(t, []string{"deploy/api"}, networkpolicy.Pending(backendPolicy))
+
+	// the policy is looked up through the typed client, so it's copied there
+	_, err := c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), backendPolicy, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	apiLabels := map[string]string{"app": "api"}
+	api := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "testnamespace"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: apiLabels},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: apiLabels}},
+		},
+	}
+	_, err = c.AppsV1().Deployments("testnamespace").Create(context.Background(), api, metav1.CreateOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, h.HandleAdd(api))
+
+	// once the workload appears, backend may reach it and it lets backend in
+	backendPolicy = getPolicyByName(t, h, "pod-testname-netpol")
+	assert.Empty(t, networkpolicy.Pending(backendPolicy))
+	assert.Contains(t, backendPolicy.Spec.Egress[0].To, networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{MatchLabels: apiLabels},
+	})
+
+	apiPolicy := getPolicyByName(t, h, "deployment-api-netpol")
+	assert.Contains(t, apiPolicy.Spec.Ingress[0].From, networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "backend"}},
+	})
+}
+
+func TestHandleAddPortRestrictedDependency(t *testing.T) {
+	c := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "testnamespace"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "db"},
+			Ports:    []corev1.ServicePort{{Port: 5432, TargetPort: intstr.FromInt(15432)}},
+		},
+	})
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	pod := returnTestPod(t, map[string]string{"app": "backend"})
+	pod.Spec.Containers = []corev1.Container{
+		{
+			Name: "containername",
+			Env:  []corev1.EnvVar{{Name: "DB", Value: "postgres://db.testnamespace.svc.cluster.local:5432/app"}},
+		},
+	}
+
+	err := h.HandleAdd(pod)
+	assert.NoError(t, err)
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+
+	egress := allPolicies[0].Spec.Egress
+	assert.Len(t, egress, 2)
+	for _, peer := range egress[0].To {
+		if peer.PodSelector != nil && len(peer.PodSelector.MatchExpressions) > 0 {
+			assert.NotContains(t, peer.PodSelector.MatchExpressions[0].Values, "db")
+		}
+	}
+	assert.Equal(t, "db", egress[1].To[0].PodSelector.MatchExpressions[0].Values[0])
+	assert.Equal(t, int32(15432), egress[1].Ports[0].Port.IntVal)
+	assert.Equal(t, corev1.ProtocolTCP, *egress[1].Ports[0].Protocol)
+}
+
+func TestHandleIngressPorts(t *testing.T) {
+	c := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "testnamespace"},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{"app": "web"},
+			Ports:    []corev1.ServicePort{{Port: 80, TargetPort: intstr.FromInt(8080)}},
+		},
+	})
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	pod := returnTestPod(t, map[string]string{"app": "web"})
+	pod.Spec.Containers = []corev1.Container{
+		{
+			Name:  "containername",
+			Ports: []corev1.ContainerPort{{ContainerPort: 9090, Protocol: corev1.ProtocolUDP}},
+		},
+	}
+
+	err := h.HandleAdd(pod)
+	assert.NoError(t, err)
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+
+	ports := allPolicies[0].Spec.Ingress[0].Ports
+	assert.Len(t, ports, 2)
+	assert.Equal(t, int32(8080), ports[0].Port.IntVal)
+	assert.Equal(t, corev1.ProtocolTCP, *ports[0].Protocol)
+	assert.Equal(t, int32(9090), ports[1].Port.IntVal)
+	assert.Equal(t, corev1.ProtocolUDP, *ports[1].Protocol)
+	// the dependencies of the object are not limited by the object's own ports
+	assert.Empty(t, allPolicies[0].Spec.Egress[0].Ports)
+
+	_, err = c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), &allPolicies[0], metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("error creating test policy %v", err)
+	}
+
+	updated := pod.DeepCopy()
+	updated.Annotations = map[string]string{attribute.IngressPortsAnnotation: "*"}
+	err = h.HandleUpdate(pod, updated)
+	assert.NoError(t, err)
+
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Empty(t, allPolicies[0].Spec.Ingress[0].Ports)
+}
+
+func TestHandleAddCronJob(t *testing.T) {
+	c := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "testnamespace"},
+		Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "db"}},
+	})
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "report"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{
+					Name: "containername",
+					Env:  []corev1.EnvVar{{Name: "DB", Value: "db.testnamespace.svc.cluster.local"}},
+				},
+			},
+		},
+	}
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "report", Namespace: "testnamespace", Labels: map[string]string{"team": "data"}},
+		Spec: batchv1.CronJobSpec{
+			JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}},
+		},
+	}
+
+	err := h.HandleAdd(cronJob)
+	assert.NoError(t, err)
+
+	// the Jobs of every run belong to the policy of the CronJob
+	runTemplate := template.DeepCopy()
+	runTemplate.Labels["controller-uid"] = "1234"
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "report-28000000",
+			Namespace:       "testnamespace",
+			Labels:          map[string]string{"app": "report"},
+			OwnerReferences: []metav1.OwnerReference{{Kind: "CronJob", Name: "report"}},
+		},
+		Spec: batchv1.JobSpec{Template: *runTemplate},
+	}
+	err = h.HandleAdd(job)
+	assert.Error(t, err)
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	assert.Equal(t, "cronjob-report-netpol", allPolicies[0].Name)
+	kind, name := networkpolicy.Owner(&allPolicies[0])
+	assert.Equal(t, "CronJob", kind)
+	assert.Equal(t, "report", name)
+	assert.Equal(t, map[string]string{"app": "report"}, allPolicies[0].Spec.PodSelector.MatchLabels)
+	assert.True(t, egressOnlyLabelSelectorReq(t, []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"db"}},
+	}, &allPolicies[0]))
+}
+
+func TestHandleAddExpressionSelector(t *testing.T) {
+	expressions := []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"api"}},
+		{Key: "tier", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"cache"}},
+	}
+	api := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "testnamespace", Labels: map[string]string{"team": "core"}},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchExpressions: expressions},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "api", "tier": "web"}}},
+		},
+	}
+	worker := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "worker",
+			Namespace:   "testnamespace",
+			Labels:      map[string]string{"team": "core"},
+			Annotations: map[string]string{attribute.EgressToAnnotation: "deploy/api"},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "worker"}},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "worker"}}},
+		},
+	}
+
+	c := fake.NewSimpleClientset(api)
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	assert.NoError(t, h.HandleAdd(api))
+	assert.NoError(t, h.HandleAdd(worker))
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 2)
+
+	expressionPeer := networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchExpressions: expressions}}
+	for _, p := range allPolicies {
+		switch p.Name {
+		case "deployment-api-netpol":
+			assert.Equal(t, metav1.LabelSelector{MatchExpressions: expressions}, p.Spec.PodSelector)
+			assert.Contains(t, p.Spec.Ingress[0].From, expressionPeer)
+			assert.Contains(t, p.Spec.Egress[0].To, expressionPeer)
+
+			// the policy is found by its podSelector, so reconciling updates it instead of creating another one
+			_, err := h.Client.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), &p, metav1.CreateOptions{})
+			assert.NoError(t, err)
+			assert.NoError(t, h.reconcile(api))
+		case "deployment-worker-netpol":
+			assert.Contains(t, p.Spec.Egress[0].To, expressionPeer)
+			assert.NotContains(t, p.Spec.Ingress[0].From, expressionPeer)
+		default:
+			t.Errorf("unexpected policy %s", p.Name)
+		}
+	}
+}
+
+func TestHandleAddIdentityLabels(t *testing.T) {
+	web := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "testnamespace"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web", "version": "1.2.0"}},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web", "version": "1.2.0"}}},
+		},
+	}
+	legacy := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "legacy", Namespace: "testnamespace"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"version": "0.9.0"}},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"version": "0.9.0"}}},
+		},
+	}
+
+	c := fake.NewSimpleClientset(web, legacy)
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies:   dependency.NewIndex(),
+		IdentityLabels: object.IdentityLabelPolicy{Deny: []string{"version"}},
+	}
+
+	assert.NoError(t, h.HandleAdd(web))
+	assert.NoError(t, h.HandleAdd(legacy))
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 2)
+	for _, p := range allPolicies {
+		switch p.Name {
+		case "deployment-web-netpol":
+			assert.Equal(t, map[string]string{"app": "web"}, p.Spec.PodSelector.MatchLabels)
+		case "deployment-legacy-netpol":
+			// the volatile keys are kept if they are the only ones, so that the policy doesn't select every Pod
+			assert.Equal(t, map[string]string{"version": "0.9.0"}, p.Spec.PodSelector.MatchLabels)
+		default:
+			t.Errorf("unexpected policy %s", p.Name)
+		}
+	}
+}
+
+func TestHandleOwnedPods(t *testing.T) {
+	c := fake.NewSimpleClientset()
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+
+	rc := &unstructured.Unstructured{}
+	rc.SetAPIVersion("v1")
+	rc.SetKind("ReplicationController")
+	rc.SetName("legacy")
+	rc.SetNamespace("testnamespace")
+	rc.SetUID("rc-uid")
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ReplicationController"}, meta.RESTScopeNamespace)
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Owners:       object.NewOwnerResolver(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), rc), mapper),
+		Dependencies: dependency.NewIndex(),
+	}
+
+	controller := true
+	var pods []*corev1.Pod
+	for _, name := range []string{"legacy-a", "legacy-b"} {
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       "testnamespace",
+				Labels:          map[string]string{"app": "legacy"},
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "ReplicationController", Name: "legacy", UID: "rc-uid", Controller: &controller}},
+			},
+		}
+		_, err := c.CoreV1().Pods("testnamespace").Create(context.Background(), pod, metav1.CreateOptions{})
+		if err != nil {
+			t.Fatalf("error creating test POD %v", err)
+		}
+		pods = append(pods, pod)
+	}
+
+	err := h.HandleAdd(pods[0])
+	assert.NoError(t, err)
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+	assert.Equal(t, "replicationcontroller-legacy-netpol", allPolicies[0].Name)
+
+	// the policy of the object is created through the dynamic client, so the typed one has to know about it as well
+	_, err = c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), &allPolicies[0], metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("error creating test policy %v", err)
+	}
+
+	// the second Pod of the owner shares the policy of the first one
+	err = h.HandleAdd(pods[1])
+	assert.NoError(t, err)
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+
+	// the policy stays as long as the owner has Pods
+	err = c.CoreV1().Pods("testnamespace").Delete(context.Background(), pods[0].Name, metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("error deleting test POD %v", err)
+	}
+	err = h.HandleDelete(pods[0])
+	assert.NoError(t, err)
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Len(t, allPolicies, 1)
+
+	err = c.CoreV1().Pods("testnamespace").Delete(context.Background(), pods[1].Name, metav1.DeleteOptions{})
+	if err != nil {
+		t.Fatalf("error deleting test POD %v", err)
+	}
+	err = h.HandleDelete(pods[1])
+	assert.NoError(t, err)
+	allPolicies, err = getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	assert.Empty(t, allPolicies)
+}
+
+func TestHasOtherPods(t *testing.T) {
+	controller := true
+	newRC := func(name string) *unstructured.Unstructured {
+		rc := &unstructured.Unstructured{}
+		rc.SetAPIVersion("v1")
+		rc.SetKind("ReplicationController")
+		rc.SetName(name)
+		rc.SetNamespace("testnamespace")
+		rc.SetUID(types.UID(name + "-uid"))
+		return rc
+	}
+	newPod := func(name string, owner string, podLabels map[string]string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:            name,
+				Namespace:       "testnamespace",
+				Labels:          podLabels,
+				OwnerReferences: []metav1.OwnerReference{{APIVersion: "v1", Kind: "ReplicationController", Name: owner, UID: types.UID(owner + "-uid"), Controller: &controller}},
+			},
+		}
+	}
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Version: "v1", Kind: "ReplicationController"}, meta.RESTScopeNamespace)
+
+	tests := []struct {
+		name      string
+		pods      []*corev1.Pod
+		remaining bool
+	}{
+		{
+			name:      "OK - another Pod of the owner",
+			pods:      []*corev1.Pod{newPod("legacy-b", "legacy", map[string]string{"app": "legacy"})},
+			remaining: true,
+		},
+		{
+			name:      "OK - the Pods of another owner with the same labels don't count",
+			pods:      []*corev1.Pod{newPod("other-a", "other", map[string]string{"app": "legacy"})},
+			remaining: false,
+		},
+		{
+			name: "OK - without labels, only the Pods of the owner count",
+			pods: []*corev1.Pod{
+				newPod("other-a", "other", nil),
+				{ObjectMeta: metav1.ObjectMeta{Name: "standalone", Namespace: "testnamespace"}},
+			},
+			remaining: false,
+		},
+		{
+			name:      "OK - the Pods of an owner that is gone don't count",
+			pods:      []*corev1.Pod{newPod("gone-a", "gone", map[string]string{"app": "legacy"})},
+			remaining: false,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			c := fake.NewSimpleClientset()
+			for _, pod := range tc.pods {
+				_, err := c.CoreV1().Pods("testnamespace").Create(context.Background(), pod, metav1.CreateOptions{})
+				if err != nil {
+					t.Fatalf("error creating test POD %v", err)
+				}
+			}
+			h := &Handler{
+				Client: c,
+				Owners: object.NewOwnerResolver(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), newRC("legacy"), newRC("other")), mapper),
+			}
+
+			deleted := newPod("legacy-a", "legacy", tc.pods[0].Labels)
+			group, err := h.groupPod(deleted)
+			assert.NoError(t, err)
+			owned, ok := group.(*object.OwnedPod)
+			if !ok {
+				t.Fatalf("the POD should belong to its owner")
+			}
+
+			remaining, err := h.hasOtherPods(owned)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.remaining, remaining)
+		})
+	}
+}
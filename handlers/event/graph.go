@@ -0,0 +1,253 @@
+package event
+
+import (
+	"context"
+	"log"
+
+	attr "github.com/adykaaa/k8s-netpol-ctrl/handlers/attribute"
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/dependency"
+	np "github.com/adykaaa/k8s-netpol-ctrl/handlers/networkpolicy"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+/*
+selfTargetKeys returns the dependency index keys other objects can refer to the object's Pods by: the keys of the Services
+selecting the Pods, the key of the workload itself, and for standalone Pods the keys of the Pod itself
+*/
+func (h *Handler) selfTargetKeys(obj metav1.Object) ([]string, error) {
+	keys := workloadTargetKeys(obj)
+	if pod, ok := obj.(*corev1.Pod); ok {
+		keys = podTargetKeys(pod)
+	}
+
+	podLabels := labels.Set(attr.PodTemplateLabels(obj))
+	if len(podLabels) == 0 {
+		return keys, nil
+	}
+
+	svcs, err := h.Client.CoreV1().Services(obj.GetNamespace()).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range svcs.Items {
+		svc := &svcs.Items[i]
+		if len(svc.Spec.Selector) > 0 && labels.SelectorFromSet(svc.Spec.Selector).Matches(podLabels) {
+			keys = append(keys, serviceTargetKeys(svc)...)
+		}
+	}
+	return keys, nil
+}
+
+/*
+dependentPeers returns the ingress peers of the objects which depend on the object, so that its policy lets their traffic in.
+Only the ingress direction is allowed this way - the object itself can't reach its dependents unless it depends on them too.
+*/
+func (h *Handler) dependentPeers(obj metav1.Object) ([]networkingv1.NetworkPolicyPeer, error) {
+	keys, err := h.selfTargetKeys(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{dependency.ObjectKey(obj): true}
+	var targets []attr.DeclaredTarget
+	for _, key := range keys {
+		for _, dep := range h.Dependencies.Dependents(key) {
+			depKey := dependency.ObjectKey(dep)
+			if seen[depKey] {
+				continue
+			}
+			seen[depKey] = true
+
+			depSelector, _, err := h.convertToMeta(dep)
+			if err != nil || isEmptySelector(depSelector) {
+				continue
+			}
+			targets = append(targets, attr.DeclaredTarget{
+				Namespace:   dep.GetNamespace(),
+				Labels:      depSelector.MatchLabels,
+				Expressions: depSelector.MatchExpressions,
+			})
+		}
+	}
+
+	return np.NewDeclaredPeers(obj.GetNamespace(), targets), nil
+}
+
+// serviceOwners returns the objects of interest whose Pods are selected by the Service
+func (h *Handler) serviceOwners(svc *corev1.Service) []metav1.Object {
+	if len(svc.Spec.Selector) == 0 {
+		return nil
+	}
+
+	var owners []metav1.Object
+	selector := labels.SelectorFromSet(svc.Spec.Selector)
+	for _, obj := range h.Dependencies.Objects(svc.GetNamespace()) {
+		if selector.Matches(labels.Set(attr.PodTemplateLabels(obj))) {
+			owners = append(owners, obj)
+		}
+	}
+	return owners
+}
+
+// podOwners returns the objects of interest whose policies select the Pod
+func (h *Handler) podOwners(pod *corev1.Pod) []metav1.Object {
+	var owners []metav1.Object
+	for _, obj := range h.Dependencies.Objects(pod.GetNamespace()) {
+		objSelector, _, err := h.convertToMeta(obj)
+		if err != nil || isEmptySelector(objSelector) {
+			continue
+		}
+		selector, err := metav1.LabelSelectorAsSelector(objSelector)
+		if err == nil && selector.Matches(labels.Set(pod.Labels)) {
+			owners = append(owners, obj)
+		}
+	}
+	return owners
+}
+
+// targetOwners returns the objects of interest whose Pods are behind a Service, Pod or workload target, referred to by name or by IP
+func (h *Handler) targetOwners(target string) ([]metav1.Object, error) {
+	kind, namespace, name := dependency.SplitKey(target)
+	ctx := context.Background()
+
+	switch kind {
+	case "svc":
+		svc, err := h.Client.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if k8serrors.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return h.serviceOwners(svc), nil
+	case "pod":
+		pod, err := h.Client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			if k8serrors.IsNotFound(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return h.podOwners(pod), nil
+	case "svcip":
+		svc, err := h.serviceByClusterIP(name)
+		if err != nil || svc == nil {
+			return nil, err
+		}
+		return h.serviceOwners(svc), nil
+	case "podip":
+		pod, err := h.podByIP(name)
+		if err != nil || pod == nil {
+			return nil, err
+		}
+		return h.podOwners(pod), nil
+	case "deploy", "sts", "ds":
+		var owners []metav1.Object
+		for _, obj := range h.Dependencies.Objects(namespace) {
+			if attr.Contains(workloadTargetKeys(obj), target) {
+				owners = append(owners, obj)
+			}
+		}
+		return owners, nil
+	}
+	return nil, nil
+}
+
+/*
+serviceByClusterIP returns the Service that has the given ClusterIP, or nil if there is none. It uses the ServiceIndexer if there
+is one, otherwise it lists the Services of every namespace.
+*/
+func (h *Handler) serviceByClusterIP(ip string) (*corev1.Service, error) {
+	if h.ServiceIndexer != nil {
+		objs, err := h.ServiceIndexer.ByIndex(attr.ClusterIPIndex, ip)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			if svc, ok := obj.(*corev1.Service); ok {
+				return svc, nil
+			}
+		}
+		return nil, nil
+	}
+
+	svcs, err := h.Client.CoreV1().Services(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i := range svcs.Items {
+		if ips, _ := attr.ServiceClusterIPIndexFunc(&svcs.Items[i]); attr.Contains(ips, ip) {
+			return &svcs.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+/*
+podByIP returns the running Pod that has the given IP, or nil if there is none. It uses the PodIndexer if there is one, otherwise
+it lists the Pods of every namespace.
+*/
+func (h *Handler) podByIP(ip string) (*corev1.Pod, error) {
+	var candidates []*corev1.Pod
+	if h.PodIndexer != nil {
+		objs, err := h.PodIndexer.ByIndex(attr.PodIPIndex, ip)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			if pod, ok := obj.(*corev1.Pod); ok {
+				candidates = append(candidates, pod)
+			}
+		}
+	} else {
+		pods, err := h.Client.CoreV1().Pods(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range pods.Items {
+			if ips, _ := attr.PodIPIndexFunc(&pods.Items[i]); attr.Contains(ips, ip) {
+				candidates = append(candidates, &pods.Items[i])
+			}
+		}
+	}
+
+	for _, pod := range candidates {
+		// IPs of finished Pods can already be reused by other Pods
+		if pod.Status.Phase != corev1.PodSucceeded && pod.Status.Phase != corev1.PodFailed {
+			return pod, nil
+		}
+	}
+	return nil, nil
+}
+
+/*
+handleServiceOwnersChange queues the objects selected by the Service. A Service which comes, goes or changes its selector or
+ports changes who can be reached through it and on which ports, so the ingress rules of the objects behind it change too.
+*/
+func (h *Handler) handleServiceOwnersChange(svcs ...*corev1.Service) {
+	for _, svc := range svcs {
+		for _, owner := range h.serviceOwners(svc) {
+			h.enqueue(owner)
+		}
+	}
+}
+
+// enqueueTargetOwners queues the objects behind the targets, so that their policies pick up the dependents which have come or gone
+func (h *Handler) enqueueTargetOwners(dependent metav1.Object, targets []string) {
+	for _, target := range targets {
+		owners, err := h.targetOwners(target)
+		if err != nil {
+			log.Printf("could not find the objects behind %s: %v \n", target, err)
+			continue
+		}
+		for _, owner := range owners {
+			if dependency.ObjectKey(owner) != dependency.ObjectKey(dependent) {
+				h.enqueue(owner)
+			}
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package event
+
+import (
+	"context"
+	"testing"
+
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/attribute"
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/dependency"
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/networkpolicy"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func getPolicyByName(t *testing.T, h *Handler, name string) *networkingv1.NetworkPolicy {
+	t.Helper()
+
+	allPolicies, err := getAllNetworkPolicies(t, h.DyanmicClient)
+	if err != nil {
+		t.Fatalf("error during retrieving all test policies")
+	}
+	for i := range allPolicies {
+		if allPolicies[i].Name == name {
+			return &allPolicies[i]
+		}
+	}
+	t.Fatalf("policy %s not found", name)
+	return nil
+}
+
+func TestBidirectionalPropagation(t *testing.T) {
+	frontendLabels := map[string]string{"app": "frontend"}
+	c := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "frontend-svc", Namespace: "testnamespace"},
+		Spec:       corev1.ServiceSpec{Selector: frontendLabels},
+	})
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	frontend := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "frontend", Namespace: "testnamespace", Labels: frontendLabels},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: frontendLabels},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: frontendLabels}},
+		},
+	}
+	err := h.HandleAdd(frontend)
+	assert.NoError(t, err)
+
+	// the policy of the object is created through the dynamic client, so the typed one has to know about it as well
+	frontendPolicy := getPolicyByName(t, h, "deployment-frontend-netpol")
+	_, err = c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), frontendPolicy, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("error creating test policy %v", err)
+	}
+
+	backend := returnTestPod(t, map[string]string{"app": "backend"})
+	backend.Spec.Containers = []corev1.Container{
+		{
+			Name: "containername",
+			Env:  []corev1.EnvVar{{Name: "FRONTEND", Value: "frontend-svc.testnamespace.svc.cluster.local"}},
+		},
+	}
+	err = h.HandleAdd(backend)
+	assert.NoError(t, err)
+
+	backendPeer := networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "backend"}},
+	}
+
+	// backend can reach frontend, but frontend can't reach backend
+	frontendPolicy = getPolicyByName(t, h, "deployment-frontend-netpol")
+	assert.Contains(t, frontendPolicy.Spec.Ingress[0].From, backendPeer)
+	assert.NotContains(t, frontendPolicy.Spec.Egress[0].To, backendPeer)
+
+	backendPolicy := getPolicyByName(t, h, "pod-testname-netpol")
+	assert.True(t, egressOnlyLabelSelectorReq(t, []metav1.LabelSelectorRequirement{
+		{Key: "app", Operator: metav1.LabelSelectorOpIn, Values: []string{"frontend"}},
+	}, backendPolicy))
+
+	// once backend is gone, frontend doesn't let it in anymore
+	_ = h.HandleDelete(backend)
+	frontendPolicy = getPolicyByName(t, h, "deployment-frontend-netpol")
+	assert.NotContains(t, frontendPolicy.Spec.Ingress[0].From, backendPeer)
+}
+
+func TestPropagationByClusterIP(t *testing.T) {
+	dbLabels := map[string]string{"app": "db"}
+	c := fake.NewSimpleClientset(&corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "db-svc", Namespace: "testnamespace"},
+		Spec: corev1.ServiceSpec{
+			Selector:  dbLabels,
+			ClusterIP: "10.96.0.20",
+			Ports:     []corev1.ServicePort{{Port: 5432}},
+		},
+	})
+	dc := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "networking.k8s.io", Version: "v1", Resource: "networkpolicies"}: "NetworkPolicyList",
+	})
+
+	h := &Handler{
+		Client:        c,
+		DyanmicClient: dc,
+		NetworkPolicyHandler: &networkpolicy.Handler{
+			Client: c,
+		},
+		AttributeHandler: &attribute.Handler{
+			Client: c,
+		},
+		Dependencies: dependency.NewIndex(),
+	}
+
+	db := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: "testnamespace"},
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{MatchLabels: dbLabels},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: dbLabels}},
+		},
+	}
+	assert.NoError(t, h.HandleAdd(db))
+	// the policy is looked up through the typed client, so it's copied there
+	dbPolicy := getPolicyByName(t, h, "deployment-db-netpol")
+	_, err := c.NetworkingV1().NetworkPolicies("testnamespace").Create(context.Background(), dbPolicy, metav1.CreateOptions{})
+	assert.NoError(t, err)
+
+	backend := returnTestPod(t, map[string]string{"app": "backend"})
+	backend.Spec.Containers = []corev1.Container{
+		{
+			Name: "containername",
+			Env:  []corev1.EnvVar{{Name: "DB", Value: "10.96.0.20:5432"}},
+		},
+	}
+	assert.NoError(t, h.HandleAdd(backend))
+
+	// backend refers to db by the ClusterIP of its Service, and db lets it in all the same
+	dbPolicy = getPolicyByName(t, h, "deployment-db-netpol")
+	assert.Contains(t, dbPolicy.Spec.Ingress[0].From, networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "backend"}},
+	})
+}
@@ -7,6 +7,8 @@ package eventmock
 import (
 	reflect "reflect"
 
+	attribute "github.com/adykaaa/k8s-netpol-ctrl/handlers/attribute"
+	networkpolicy "github.com/adykaaa/k8s-netpol-ctrl/handlers/networkpolicy"
 	object "github.com/adykaaa/k8s-netpol-ctrl/handlers/object"
 	gomock "github.com/golang/mock/gomock"
 	v1 "k8s.io/api/networking/v1"
@@ -36,39 +38,23 @@ func (m *MockNetworkPolicyHandler) EXPECT() *MockNetworkPolicyHandlerMockRecorde
 	return m.recorder
 }
 
-// AppendLabelsToPeers mocks base method.
-func (m *MockNetworkPolicyHandler) AppendLabelsToPeers(arg0 map[string][]string) ([]v1.NetworkPolicyPeer, []v1.NetworkPolicyPeer, error) {
+// GetPolicyByOwner mocks base method.
+func (m *MockNetworkPolicyHandler) GetPolicyByOwner(arg0, arg1, arg2 string) (*v1.NetworkPolicy, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "AppendLabelsToPeers", arg0)
-	ret0, _ := ret[0].([]v1.NetworkPolicyPeer)
-	ret1, _ := ret[1].([]v1.NetworkPolicyPeer)
-	ret2, _ := ret[2].(error)
-	return ret0, ret1, ret2
-}
-
-// AppendLabelsToPeers indicates an expected call of AppendLabelsToPeers.
-func (mr *MockNetworkPolicyHandlerMockRecorder) AppendLabelsToPeers(arg0 interface{}) *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "AppendLabelsToPeers", reflect.TypeOf((*MockNetworkPolicyHandler)(nil).AppendLabelsToPeers), arg0)
-}
-
-// GetPolicyByPodLabels mocks base method.
-func (m *MockNetworkPolicyHandler) GetPolicyByPodLabels(arg0 string, arg1 map[string]string) (*v1.NetworkPolicy, error) {
-	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetPolicyByPodLabels", arg0, arg1)
+	ret := m.ctrl.Call(m, "GetPolicyByOwner", arg0, arg1, arg2)
 	ret0, _ := ret[0].(*v1.NetworkPolicy)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetPolicyByPodLabels indicates an expected call of GetPolicyByPodLabels.
-func (mr *MockNetworkPolicyHandlerMockRecorder) GetPolicyByPodLabels(arg0, arg1 interface{}) *gomock.Call {
+// GetPolicyByOwner indicates an expected call of GetPolicyByOwner.
+func (mr *MockNetworkPolicyHandlerMockRecorder) GetPolicyByOwner(arg0, arg1, arg2 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPolicyByPodLabels", reflect.TypeOf((*MockNetworkPolicyHandler)(nil).GetPolicyByPodLabels), arg0, arg1)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetPolicyByOwner", reflect.TypeOf((*MockNetworkPolicyHandler)(nil).GetPolicyByOwner), arg0, arg1, arg2)
 }
 
 // NewPolicy mocks base method.
-func (m *MockNetworkPolicyHandler) NewPolicy(arg0, arg1 string, arg2 map[string]string, arg3 map[string][]string) (*v1.NetworkPolicy, error) {
+func (m *MockNetworkPolicyHandler) NewPolicy(arg0, arg1 string, arg2 *v10.LabelSelector, arg3 networkpolicy.Peers) (*v1.NetworkPolicy, error) {
 	m.ctrl.T.Helper()
 	ret := m.ctrl.Call(m, "NewPolicy", arg0, arg1, arg2, arg3)
 	ret0, _ := ret[0].(*v1.NetworkPolicy)
@@ -133,6 +119,20 @@ func (mr *MockObjectHandlerMockRecorder) Mutate(arg0 interface{}) *gomock.Call {
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Mutate", reflect.TypeOf((*MockObjectHandler)(nil).Mutate), arg0)
 }
 
+// RemoveLabel mocks base method.
+func (m *MockObjectHandler) RemoveLabel() error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveLabel")
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveLabel indicates an expected call of RemoveLabel.
+func (mr *MockObjectHandlerMockRecorder) RemoveLabel() *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveLabel", reflect.TypeOf((*MockObjectHandler)(nil).RemoveLabel))
+}
+
 // MockAttributeHandler is a mock of AttributeHandler interface.
 type MockAttributeHandler struct {
 	ctrl     *gomock.Controller
@@ -170,51 +170,95 @@ func (mr *MockAttributeHandlerMockRecorder) ConvertLabels(arg0 interface{}) *gom
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ConvertLabels", reflect.TypeOf((*MockAttributeHandler)(nil).ConvertLabels), arg0)
 }
 
-// GetLabelsFromEnvVars mocks base method.
-func (m *MockAttributeHandler) GetLabelsFromEnvVars(arg0 map[string]string) (map[string][]string, error) {
+// DetectReferences mocks base method.
+func (m *MockAttributeHandler) DetectReferences(arg0 v10.Object) ([]attribute.Reference, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetLabelsFromEnvVars", arg0)
-	ret0, _ := ret[0].(map[string][]string)
+	ret := m.ctrl.Call(m, "DetectReferences", arg0)
+	ret0, _ := ret[0].([]attribute.Reference)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// GetLabelsFromEnvVars indicates an expected call of GetLabelsFromEnvVars.
-func (mr *MockAttributeHandlerMockRecorder) GetLabelsFromEnvVars(arg0 interface{}) *gomock.Call {
+// DetectReferences indicates an expected call of DetectReferences.
+func (mr *MockAttributeHandlerMockRecorder) DetectReferences(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLabelsFromEnvVars", reflect.TypeOf((*MockAttributeHandler)(nil).GetLabelsFromEnvVars), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "DetectReferences", reflect.TypeOf((*MockAttributeHandler)(nil).DetectReferences), arg0)
 }
 
-// GetLocalEnvVars mocks base method.
-func (m *MockAttributeHandler) GetLocalEnvVars(arg0 v10.Object) (map[string]string, error) {
+// GetDeclaredTargets mocks base method.
+func (m *MockAttributeHandler) GetDeclaredTargets(arg0 v10.Object, arg1 string) ([]attribute.DeclaredTarget, []string, []string, error) {
 	m.ctrl.T.Helper()
-	ret := m.ctrl.Call(m, "GetLocalEnvVars", arg0)
-	ret0, _ := ret[0].(map[string]string)
-	ret1, _ := ret[1].(error)
-	return ret0, ret1
+	ret := m.ctrl.Call(m, "GetDeclaredTargets", arg0, arg1)
+	ret0, _ := ret[0].([]attribute.DeclaredTarget)
+	ret1, _ := ret[1].([]string)
+	ret2, _ := ret[2].([]string)
+	ret3, _ := ret[3].(error)
+	return ret0, ret1, ret2, ret3
 }
 
-// GetLocalEnvVars indicates an expected call of GetLocalEnvVars.
-func (mr *MockAttributeHandlerMockRecorder) GetLocalEnvVars(arg0 interface{}) *gomock.Call {
+// GetDeclaredTargets indicates an expected call of GetDeclaredTargets.
+func (mr *MockAttributeHandlerMockRecorder) GetDeclaredTargets(arg0, arg1 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetLocalEnvVars", reflect.TypeOf((*MockAttributeHandler)(nil).GetLocalEnvVars), arg0)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetDeclaredTargets", reflect.TypeOf((*MockAttributeHandler)(nil).GetDeclaredTargets), arg0, arg1)
 }
 
-// MergeLabels mocks base method.
-func (m *MockAttributeHandler) MergeLabels(arg0 ...map[string][]string) (map[string][]string, error) {
+// GetIPBlocksFromEnvVars mocks base method.
+func (m *MockAttributeHandler) GetIPBlocksFromEnvVars(arg0 map[string]string) ([]string, error) {
 	m.ctrl.T.Helper()
-	varargs := []interface{}{}
-	for _, a := range arg0 {
-		varargs = append(varargs, a)
-	}
-	ret := m.ctrl.Call(m, "MergeLabels", varargs...)
-	ret0, _ := ret[0].(map[string][]string)
+	ret := m.ctrl.Call(m, "GetIPBlocksFromEnvVars", arg0)
+	ret0, _ := ret[0].([]string)
 	ret1, _ := ret[1].(error)
 	return ret0, ret1
 }
 
-// MergeLabels indicates an expected call of MergeLabels.
-func (mr *MockAttributeHandlerMockRecorder) MergeLabels(arg0 ...interface{}) *gomock.Call {
+// GetIPBlocksFromEnvVars indicates an expected call of GetIPBlocksFromEnvVars.
+func (mr *MockAttributeHandlerMockRecorder) GetIPBlocksFromEnvVars(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetIPBlocksFromEnvVars", reflect.TypeOf((*MockAttributeHandler)(nil).GetIPBlocksFromEnvVars), arg0)
+}
+
+// GetIngressPorts mocks base method.
+func (m *MockAttributeHandler) GetIngressPorts(arg0 v10.Object) ([]attribute.TargetPort, []string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetIngressPorts", arg0)
+	ret0, _ := ret[0].([]attribute.TargetPort)
+	ret1, _ := ret[1].([]string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// GetIngressPorts indicates an expected call of GetIngressPorts.
+func (mr *MockAttributeHandlerMockRecorder) GetIngressPorts(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetIngressPorts", reflect.TypeOf((*MockAttributeHandler)(nil).GetIngressPorts), arg0)
+}
+
+// ResolveEnvVarTargets mocks base method.
+func (m *MockAttributeHandler) ResolveEnvVarTargets(arg0 map[string]string) ([]attribute.Target, []string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ResolveEnvVarTargets", arg0)
+	ret0, _ := ret[0].([]attribute.Target)
+	ret1, _ := ret[1].([]string)
+	ret2, _ := ret[2].(error)
+	return ret0, ret1, ret2
+}
+
+// ResolveEnvVarTargets indicates an expected call of ResolveEnvVarTargets.
+func (mr *MockAttributeHandlerMockRecorder) ResolveEnvVarTargets(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ResolveEnvVarTargets", reflect.TypeOf((*MockAttributeHandler)(nil).ResolveEnvVarTargets), arg0)
+}
+
+// WatchedConfigMaps mocks base method.
+func (m *MockAttributeHandler) WatchedConfigMaps(arg0 v10.Object) []string {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "WatchedConfigMaps", arg0)
+	ret0, _ := ret[0].([]string)
+	return ret0
+}
+
+// WatchedConfigMaps indicates an expected call of WatchedConfigMaps.
+func (mr *MockAttributeHandlerMockRecorder) WatchedConfigMaps(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "MergeLabels", reflect.TypeOf((*MockAttributeHandler)(nil).MergeLabels), arg0...)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "WatchedConfigMaps", reflect.TypeOf((*MockAttributeHandler)(nil).WatchedConfigMaps), arg0)
 }
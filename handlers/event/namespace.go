@@ -0,0 +1,103 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	np "github.com/adykaaa/k8s-netpol-ctrl/handlers/networkpolicy"
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/object"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// BaselineLabel opts a namespace into the default-deny baseline policy, with the BaselineDeny value
+	BaselineLabel = "netpol-ctrl.io/baseline"
+	BaselineDeny  = "deny"
+)
+
+// wantsBaseline reports whether the namespace has opted into the baseline policy
+func wantsBaseline(ns *corev1.Namespace) bool {
+	return ns.Labels[BaselineLabel] == BaselineDeny
+}
+
+/*
+handleNamespaceChange creates the baseline policy of the namespaces labeled with BaselineLabel if NamespaceBaseline is set, and removes
+it from the namespaces which are not labeled anymore. Only the baseline policies managed by the controller are ever updated or removed,
+a policy of the same name created by someone else is reported instead. Terminating namespaces are left alone, their policies go away
+with them.
+*/
+func (h *Handler) handleNamespaceChange(ns *corev1.Namespace) error {
+	// we don't mess around in the kube-system namespace
+	if !h.NamespaceBaseline || ns.Name == metav1.NamespaceSystem || ns.DeletionTimestamp != nil {
+		return nil
+	}
+
+	p := np.NewBaselinePolicy(ns.Name)
+	existing, err := h.Client.NetworkingV1().NetworkPolicies(ns.Name).Get(context.Background(), p.Name, metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+		existing = nil
+	case err != nil:
+		return err
+	}
+
+	if !wantsBaseline(ns) {
+		if existing == nil || existing.Labels[np.ManagedByLabel] != np.ManagedByValue {
+			return nil
+		}
+		h.ObjectHandler = object.NewHandler(h.DyanmicClient, existing)
+		if err := h.ObjectHandler.Mutate(object.Delete); err != nil {
+			return err
+		}
+		log.Printf("baseline NetworkPolicy %s deleted from %s \n", existing.GetName(), ns.Name)
+		return nil
+	}
+
+	action := object.Create
+	switch {
+	case existing == nil:
+	case existing.Labels[np.ManagedByLabel] != np.ManagedByValue:
+		h.warn(ns, "BaselineConflict", fmt.Sprintf("the NetworkPolicy %s is not managed by the controller, the baseline is not applied", existing.Name))
+		return nil
+	case equality.Semantic.DeepEqual(existing.Spec, p.Spec):
+		// the resyncs don't rewrite the baseline which hasn't changed
+		return nil
+	default:
+		action = object.Update
+		p.ResourceVersion = existing.ResourceVersion
+	}
+	h.ObjectHandler = object.NewHandler(h.DyanmicClient, p)
+	if err := h.ObjectHandler.Mutate(action); err != nil {
+		return err
+	}
+
+	log.Printf("baseline NetworkPolicy %s applied to %s \n", p.GetName(), ns.Name)
+	return nil
+}
+
+// enqueueNamespace queues the reconciliation of every object of interest in the namespace, e.g because its profile has changed
+func (h *Handler) enqueueNamespace(namespace string) {
+	for _, obj := range h.Dependencies.Objects(namespace) {
+		h.enqueue(obj)
+	}
+}
+
+// policyProfile returns the name of the profile picked by the ProfileAnnotation of the object, or by the one of its namespace
+func (h *Handler) policyProfile(obj metav1.Object) (string, error) {
+	if profile := obj.GetAnnotations()[np.ProfileAnnotation]; profile != "" {
+		return profile, nil
+	}
+
+	ns, err := h.Client.CoreV1().Namespaces().Get(context.Background(), obj.GetNamespace(), metav1.GetOptions{})
+	switch {
+	case k8serrors.IsNotFound(err):
+		return "", nil
+	case err != nil:
+		return "", fmt.Errorf("could not fetch namespace %s. %w", obj.GetNamespace(), err)
+	}
+	return ns.Annotations[np.ProfileAnnotation], nil
+}
@@ -2,13 +2,37 @@ package networkpolicy
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/adykaaa/k8s-netpol-ctrl/handlers/attribute"
+	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	// PendingAnnotation lists the cluster.local addresses and annotation entries of the policy's object which point at objects that don't exist yet
+	PendingAnnotation = "netpol-ctrl.io/pending-dependencies"
+	// OwnerKindAnnotation and OwnerNameAnnotation hold the kind and name of the object the policy belongs to, since the name of the policy might be truncated
+	OwnerKindAnnotation = "netpol-ctrl.io/owner-kind"
+	OwnerNameAnnotation = "netpol-ctrl.io/owner-name"
+	// ManagedByLabel marks the policies created by the controller
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedByValue = "netpol-ctrl"
+
+	// maxNameLength is the longest name an object can have
+	maxNameLength = 253
+	// hashLength is the length of the hash in the truncated policy names
+	hashLength = 10
 )
 
 var (
@@ -16,68 +40,55 @@ var (
 	ErrEmptyParam    = errors.New("a required parameter is empty")
 	ErrNotFound      = errors.New("policy not found")
 
-	//DefaultLabels contains the supported ingress and DNS pod labels. These are by default there in every NetworkPolicy.
-	_DefaultLabels = map[string]map[string]string{
+	// _IngressControllerLabels contains the supported ingress controller pod labels. Every NetworkPolicy lets them in, but never out.
+	_IngressControllerLabels = map[string]map[string]string{
 		"nginx":   {"app.kubernetes.io/name": "ingress-nginx"},
 		"contour": {"app.kubernetes.io/name": "contour"},
 		"traefik": {"app.kubernetes.io/name": "traefik"},
 		"haproxy": {"app.kubernetes.io/name": "haproxy"},
-		"coredns": {"k8s-app": "kube-dns"},
 	}
-)
 
-type Handler struct {
-	Client kubernetes.Interface
-}
-
-func isInOldLabels(req metav1.LabelSelectorRequirement, oldLabels map[string][]string) bool {
-	oldVals, ok := oldLabels[req.Key]
-	if !ok {
-		return false
-	}
-	for _, oldVal := range oldVals {
-		for _, reqVal := range req.Values {
-			if oldVal == reqVal {
-				return true
-			}
-		}
-	}
-	return false
-}
-
-func updateIngressRules(oldLabels map[string][]string,
-	ingressRules []networkingv1.NetworkPolicyIngressRule) {
-	for _, rule := range ingressRules {
-		updatedIngress := []metav1.LabelSelectorRequirement{}
-		if rule.From[0].PodSelector != nil {
-			for _, req := range rule.From[0].PodSelector.MatchExpressions {
-				if !isInOldLabels(req, oldLabels) {
-					updatedIngress = append(updatedIngress, req)
-				}
-			}
-			rule.From[0].PodSelector.MatchExpressions = updatedIngress
-		}
+	// _DNSLabels contains the supported DNS pod labels. Every NetworkPolicy lets traffic out to them, but never in.
+	_DNSLabels = map[string]map[string]string{
+		"coredns": {"k8s-app": "kube-dns"},
 	}
-}
+)
 
-func updateEgressRules(oldLabels map[string][]string,
-	egressRules []networkingv1.NetworkPolicyEgressRule) {
-	for _, rule := range egressRules {
-		updatedEgress := []metav1.LabelSelectorRequirement{}
-		if rule.To[0].PodSelector != nil {
-			for _, req := range rule.To[0].PodSelector.MatchExpressions {
-				if !isInOldLabels(req, oldLabels) {
-					updatedEgress = append(updatedEgress, req)
-				}
-			}
-			rule.To[0].PodSelector.MatchExpressions = updatedEgress
-		}
-	}
+/*
+Peers holds every source a NetworkPolicy allows, kept apart so that each of them gets its own direction. The ingress controllers
+are always ingress-only, and DNS is always egress-only.
+*/
+type Peers struct {
+	// Self are the labels of the object's own Pods, which can reach each other in both directions
+	Self map[string][]string
+	// Dependencies are the Pods (and addresses) the object sends traffic to. They are egress-only.
+	Dependencies []networkingv1.NetworkPolicyPeer
+	// Dependents are the Pods sending traffic to the object. They are ingress-only.
+	Dependents []networkingv1.NetworkPolicyPeer
+	// PortRules are the egress rules of the dependencies which can only be reached on some of their ports
+	PortRules []networkingv1.NetworkPolicyEgressRule
+	// IngressPorts are the ports the object's own Pods serve on. Every port can be reached if it's empty.
+	IngressPorts []attribute.TargetPort
+	// IPBlocks are the CIDRs the object sends traffic to
+	IPBlocks []string
+	// Profile is the name of the profile the general peers come from, the default profile is used if it's empty
+	Profile string
+	// Template is the name of the template the policy is rendered from, and Owner is the object the policy is rendered for
+	Template string
+	Owner    metav1.Object
 }
 
-func RemoveOldLabels(oldLabels map[string][]string, ingressRules []networkingv1.NetworkPolicyIngressRule, egressRules []networkingv1.NetworkPolicyEgressRule) {
-	updateIngressRules(oldLabels, ingressRules)
-	updateEgressRules(oldLabels, egressRules)
+type Handler struct {
+	Client kubernetes.Interface
+	// Profiles are the configured profiles, they replace the built-in ones with the same name
+	Profiles map[string]Profile
+	// DefaultProfile is the name of the profile used for the objects which don't pick one. DefaultProfile is used if it's empty.
+	DefaultProfile string
+	// TemplateNamespace and TemplateConfigMap point at the ConfigMap holding the policy templates, there are no templates if it's empty
+	TemplateNamespace string
+	TemplateConfigMap string
+	// ConfigMapIndexer is the indexer of the ConfigMap informer. If it's nil, the template ConfigMap is fetched through the API
+	ConfigMapIndexer cache.Indexer
 }
 
 // getDefaultSupportedPeers appends the necessary podSelectors based on the default labels
@@ -86,9 +97,16 @@ func getDefaultSupportedPeers(defaultLabels map[string]map[string]string) []netw
 		return nil
 	}
 
+	// the names are sorted, so that the values of the peers don't change between policies
+	names := make([]string, 0, len(defaultLabels))
+	for name := range defaultLabels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
 	keyValueMap := make(map[string][]string)
-	for _, labels := range defaultLabels {
-		for k, v := range labels {
+	for _, name := range names {
+		for k, v := range defaultLabels[name] {
 			keyValueMap[k] = append(keyValueMap[k], v)
 		}
 	}
@@ -111,48 +129,355 @@ func getDefaultSupportedPeers(defaultLabels map[string]map[string]string) []netw
 }
 
 /*
-ExtendPeers loops through the ingress and egress peers of an existing policy, and appends all the elements from
-ingressPol and egressPol to the existing NetworkPolicyPeers.
+ExtendPeers appends all the elements from ingressPol and egressPol to the peers of the first ingress and egress rule of an existing
+policy. The first rules are the general ones without ports, the rest are the port restricted rules of the dependencies.
 */
 func ExtendPeers(ingressPol []networkingv1.NetworkPolicyPeer, egressPol []networkingv1.NetworkPolicyPeer, p *networkingv1.NetworkPolicy) error {
 	for _, pol := range ingressPol {
-		for i := range p.Spec.Ingress {
-			if !attribute.Contains(p.Spec.Ingress[i].From, pol) {
-				p.Spec.Ingress[i].From = append(p.Spec.Ingress[i].From, pol)
-			}
+		if len(p.Spec.Ingress) > 0 && !attribute.Contains(p.Spec.Ingress[0].From, pol) {
+			p.Spec.Ingress[0].From = append(p.Spec.Ingress[0].From, pol)
 		}
 	}
 
 	for _, pol := range egressPol {
-		for i := range p.Spec.Egress {
-			if !attribute.Contains(p.Spec.Egress[i].To, pol) {
-				p.Spec.Egress[i].To = append(p.Spec.Egress[i].To, pol)
-			}
+		if len(p.Spec.Egress) > 0 && !attribute.Contains(p.Spec.Egress[0].To, pol) {
+			p.Spec.Egress[0].To = append(p.Spec.Egress[0].To, pol)
 		}
 	}
 	return nil
 }
 
 /*
-appendLabelsToPeers appends the default supported labels (such as Ingress controller pod labels and DNS pod labels which come from DefaultLabels)
-and targetedPodLabels one by one to ingressPeers and egressPeers.
+NewPortRules splits the resolved targets of an object into the peers of the ones which can be reached on any port, and egress rules
+for the ones which can only be reached on some of their ports. Targets with the same ports share a rule. The peers of the targets
+outside of the policy's namespace select their namespace too.
 */
-func (h *Handler) AppendLabelsToPeers(targetPodLabels map[string][]string) (ingressPeers []networkingv1.NetworkPolicyPeer, egressPeers []networkingv1.NetworkPolicyPeer, err error) {
-	size := len(targetPodLabels) + len(_DefaultLabels)
-	ingressPeers = make([]networkingv1.NetworkPolicyPeer, 0, size)
-	egressPeers = make([]networkingv1.NetworkPolicyPeer, 0, size)
+func NewPortRules(policyNamespace string, targets []attribute.Target) ([]networkingv1.NetworkPolicyPeer, []networkingv1.NetworkPolicyEgressRule) {
+	var unrestricted []attribute.Target
+	byPorts := make(map[string][]attribute.Target)
+	var keys []string
 
-	defaultPeers := getDefaultSupportedPeers(_DefaultLabels)
-	if len(targetPodLabels) == 0 || len(defaultPeers) == 0 {
-		return nil, nil, ErrEmptyParam
+	for _, t := range targets {
+		if len(t.Ports) == 0 {
+			unrestricted = append(unrestricted, t)
+			continue
+		}
+		key := fmt.Sprint(t.Ports)
+		if _, ok := byPorts[key]; !ok {
+			keys = append(keys, key)
+		}
+		byPorts[key] = append(byPorts[key], t)
 	}
+	sort.Strings(keys)
 
-	for _, ip := range defaultPeers {
-		ingressPeers = append(ingressPeers, ip)
-		egressPeers = append(egressPeers, ip)
+	rules := make([]networkingv1.NetworkPolicyEgressRule, 0, len(keys))
+	for _, key := range keys {
+		rules = append(rules, networkingv1.NetworkPolicyEgressRule{To: targetPeers(policyNamespace, byPorts[key]), Ports: policyPorts(byPorts[key][0].Ports)})
 	}
+	return targetPeers(policyNamespace, unrestricted), rules
+}
+
+/*
+targetPeers merges the labels of the targets per namespace into LabelPeers. The peers of the targets outside of the policy's
+namespace get a namespaceSelector, a bare podSelector would only select the Pods of the policy's own namespace.
+*/
+func targetPeers(policyNamespace string, targets []attribute.Target) []networkingv1.NetworkPolicyPeer {
+	byNamespace := make(map[string]map[string][]string)
+	var namespaces []string
+	for _, t := range targets {
+		ns := t.Namespace
+		if ns == "" {
+			ns = policyNamespace
+		}
+		if _, ok := byNamespace[ns]; !ok {
+			byNamespace[ns] = make(map[string][]string)
+			namespaces = append(namespaces, ns)
+		}
+		for k, v := range t.Labels {
+			byNamespace[ns][k] = append(byNamespace[ns][k], v...)
+		}
+	}
+	sort.Strings(namespaces)
+
+	var peers []networkingv1.NetworkPolicyPeer
+	for _, ns := range namespaces {
+		nsPeers := LabelPeers(byNamespace[ns])
+		if ns != policyNamespace {
+			for i := range nsPeers {
+				nsPeers[i].NamespaceSelector = &metav1.LabelSelector{
+					MatchLabels: map[string]string{corev1.LabelMetadataName: ns},
+				}
+			}
+		}
+		peers = append(peers, nsPeers...)
+	}
+	return peers
+}
 
-	for k, values := range targetPodLabels {
+// policyPorts converts the resolved ports to NetworkPolicyPorts. No ports (nil) means every port.
+func policyPorts(targetPorts []attribute.TargetPort) []networkingv1.NetworkPolicyPort {
+	var ports []networkingv1.NetworkPolicyPort
+	for _, tp := range targetPorts {
+		port := intstr.FromInt(int(tp.Port))
+		protocol := tp.Protocol
+		ports = append(ports, networkingv1.NetworkPolicyPort{Protocol: &protocol, Port: &port})
+	}
+	return ports
+}
+
+/*
+SetIngressPorts limits the first (general) ingress rule of the policy to the ports the object serves on, so that the ingress
+controllers and the dependents can't reach anything else. No ports lift the limit.
+*/
+func SetIngressPorts(ports []attribute.TargetPort, p *networkingv1.NetworkPolicy) {
+	if len(p.Spec.Ingress) == 0 {
+		return
+	}
+	p.Spec.Ingress[0].Ports = policyPorts(ports)
+}
+
+// SetPortRules replaces the port restricted egress rules of the policy, which are all the egress rules after the first one
+func SetPortRules(rules []networkingv1.NetworkPolicyEgressRule, p *networkingv1.NetworkPolicy) {
+	if len(p.Spec.Egress) == 0 {
+		return
+	}
+	p.Spec.Egress = append(p.Spec.Egress[:1], rules...)
+}
+
+/*
+NewDeclaredPeers converts the targets of the egress-to / ingress-from annotations to NetworkPolicyPeers. Targets in another namespace
+than the policy's get a namespaceSelector too, and namespace targets only have a namespaceSelector.
+*/
+func NewDeclaredPeers(policyNamespace string, targets []attribute.DeclaredTarget) []networkingv1.NetworkPolicyPeer {
+	peers := make([]networkingv1.NetworkPolicyPeer, 0, len(targets))
+
+	for _, t := range targets {
+		peer := networkingv1.NetworkPolicyPeer{}
+		selectsPods := len(t.Labels) > 0 || len(t.Expressions) > 0
+		if selectsPods {
+			peer.PodSelector = &metav1.LabelSelector{MatchLabels: t.Labels, MatchExpressions: t.Expressions}
+		}
+		if !selectsPods || t.Namespace != policyNamespace {
+			peer.NamespaceSelector = &metav1.LabelSelector{
+				MatchLabels: map[string]string{corev1.LabelMetadataName: t.Namespace},
+			}
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// SetPending records the addresses which could not be resolved yet in the PendingAnnotation of the policy, or removes it if there are none
+func SetPending(refs []string, p *networkingv1.NetworkPolicy) {
+	if len(refs) == 0 {
+		delete(p.Annotations, PendingAnnotation)
+		return
+	}
+	if p.Annotations == nil {
+		p.Annotations = map[string]string{}
+	}
+	p.Annotations[PendingAnnotation] = strings.Join(refs, ",")
+}
+
+// Pending returns the addresses recorded in the PendingAnnotation of the policy
+func Pending(p *networkingv1.NetworkPolicy) []string {
+	if p.Annotations[PendingAnnotation] == "" {
+		return nil
+	}
+	return strings.Split(p.Annotations[PendingAnnotation], ",")
+}
+
+/*
+PolicyName returns the name of the policy of an object: "<kind>-<name>-netpol" in lowercase, e.g deployment-api-netpol. The policy is in
+the namespace of the object, so it's not part of the name. The kinds have no dashes, so objects of different kinds never get the same
+name. Names longer than an object name can be are truncated, and get a hash of the kind and name before the "-netpol" suffix, so that
+they stay unique.
+*/
+func PolicyName(kind string, name string) string {
+	full := fmt.Sprintf("%s-%s-netpol", strings.ToLower(kind), name)
+	if len(full) <= maxNameLength {
+		return full
+	}
+
+	sum := sha256.Sum256([]byte(kind + "/" + name))
+	suffix := "-" + hex.EncodeToString(sum[:])[:hashLength] + "-netpol"
+	return strings.TrimRight(full[:maxNameLength-len(suffix)], "-.") + suffix
+}
+
+// LegacyPolicyName returns the name the policies had before they were named by PolicyName: "<name>-<namespace>-netpol"
+func LegacyPolicyName(name string, namespace string) string {
+	return fmt.Sprintf("%s-%s-netpol", name, namespace)
+}
+
+// SetOwner marks the policy as managed by the controller, and records the kind and name of the object it belongs to
+func SetOwner(kind string, name string, p *networkingv1.NetworkPolicy) {
+	if p.Labels == nil {
+		p.Labels = map[string]string{}
+	}
+	p.Labels[ManagedByLabel] = ManagedByValue
+
+	if p.Annotations == nil {
+		p.Annotations = map[string]string{}
+	}
+	p.Annotations[OwnerKindAnnotation] = kind
+	p.Annotations[OwnerNameAnnotation] = name
+}
+
+// Owner returns the kind and name of the object the policy belongs to, recorded by SetOwner
+func Owner(p *networkingv1.NetworkPolicy) (string, string) {
+	return p.Annotations[OwnerKindAnnotation], p.Annotations[OwnerNameAnnotation]
+}
+
+/*
+NewBaselinePolicy returns the default-deny policy of a namespace. It selects every Pod of the namespace, lets nothing in, and only lets
+DNS lookups out, to the DNS Pods in kube-system. The policies of the workloads allow their own traffic on top of it.
+*/
+func NewBaselinePolicy(namespace string) *networkingv1.NetworkPolicy {
+	dnsPeers := getDefaultSupportedPeers(_DNSLabels)
+	for i := range dnsPeers {
+		dnsPeers[i].NamespaceSelector = &metav1.LabelSelector{
+			MatchLabels: map[string]string{corev1.LabelMetadataName: metav1.NamespaceSystem},
+		}
+	}
+	udp, tcp := corev1.ProtocolUDP, corev1.ProtocolTCP
+	dnsPort := intstr.FromInt(53)
+
+	p := &networkingv1.NetworkPolicy{
+		TypeMeta: metav1.TypeMeta{Kind: "NetworkPolicy", APIVersion: networkingv1.SchemeGroupVersion.String()},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      PolicyName("Namespace", namespace),
+			Namespace: namespace,
+		},
+		Spec: networkingv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{},
+			Egress: []networkingv1.NetworkPolicyEgressRule{
+				{
+					To:    dnsPeers,
+					Ports: []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &dnsPort}, {Protocol: &tcp, Port: &dnsPort}},
+				},
+			},
+			PolicyTypes: []networkingv1.PolicyType{
+				networkingv1.PolicyTypeIngress,
+				networkingv1.PolicyTypeEgress,
+			},
+		},
+	}
+	SetOwner("Namespace", namespace, p)
+	return p
+}
+
+/*
+MergePolicy adds the rules of src to the policy, so that it lets through the traffic of both. The general rules get the peers of
+src, the port restricted egress rules of src are added next to the existing ones, and the ingress ports are combined - if either of
+them can be reached on every port, the merged one can too. The same goes for the egress: if either of them leaves it unrestricted,
+the merged one does too.
+*/
+func MergePolicy(src *networkingv1.NetworkPolicy, p *networkingv1.NetworkPolicy) {
+	if len(src.Spec.Ingress) > 0 && len(p.Spec.Ingress) > 0 {
+		p.Spec.Ingress[0].From = appendUniquePeers(p.Spec.Ingress[0].From, src.Spec.Ingress[0].From)
+		if len(src.Spec.Ingress[0].Ports) == 0 || len(p.Spec.Ingress[0].Ports) == 0 {
+			p.Spec.Ingress[0].Ports = nil
+		} else {
+			for _, port := range src.Spec.Ingress[0].Ports {
+				if !containsPort(p.Spec.Ingress[0].Ports, port) {
+					p.Spec.Ingress[0].Ports = append(p.Spec.Ingress[0].Ports, port)
+				}
+			}
+		}
+	}
+
+	if !restrictsEgress(src) {
+		p.Spec.Egress = nil
+		p.Spec.PolicyTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}
+	}
+	if len(src.Spec.Egress) > 0 && len(p.Spec.Egress) > 0 {
+		p.Spec.Egress[0].To = appendUniquePeers(p.Spec.Egress[0].To, src.Spec.Egress[0].To)
+		for _, rule := range src.Spec.Egress[1:] {
+			if !containsEgressRule(p.Spec.Egress[1:], rule) {
+				p.Spec.Egress = append(p.Spec.Egress, rule)
+			}
+		}
+	}
+
+	SetPending(appendUniqueRefs(Pending(p), Pending(src)), p)
+}
+
+// appendUniquePeers appends the peers which are not in dst yet. The peers are compared by value, since they come from different policies.
+func appendUniquePeers(dst []networkingv1.NetworkPolicyPeer, peers []networkingv1.NetworkPolicyPeer) []networkingv1.NetworkPolicyPeer {
+	for _, peer := range peers {
+		found := false
+		for _, d := range dst {
+			if equality.Semantic.DeepEqual(d, peer) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst = append(dst, peer)
+		}
+	}
+	return dst
+}
+
+// containsPort reports whether the port is one of the ports
+func containsPort(ports []networkingv1.NetworkPolicyPort, port networkingv1.NetworkPolicyPort) bool {
+	for _, p := range ports {
+		if equality.Semantic.DeepEqual(p, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsEgressRule reports whether the rule is one of the rules
+func containsEgressRule(rules []networkingv1.NetworkPolicyEgressRule, rule networkingv1.NetworkPolicyEgressRule) bool {
+	for _, r := range rules {
+		if equality.Semantic.DeepEqual(r, rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUniqueRefs appends the refs which are not in dst yet
+func appendUniqueRefs(dst []string, refs []string) []string {
+	for _, ref := range refs {
+		if !attribute.Contains(dst, ref) {
+			dst = append(dst, ref)
+		}
+	}
+	return dst
+}
+
+/*
+SetIPBlocks replaces the ipBlock peers of the first egress rule of the policy with the given CIDRs. The ipBlocks of a policy always
+come from the current targets of the object, so the stale ones are dropped. The ports of ipBlock targets are not known, so they
+never end up in the port restricted rules.
+*/
+func SetIPBlocks(cidrs []string, p *networkingv1.NetworkPolicy) {
+	if len(p.Spec.Egress) == 0 {
+		return
+	}
+	peers := make([]networkingv1.NetworkPolicyPeer, 0, len(p.Spec.Egress[0].To)+len(cidrs))
+	for _, peer := range p.Spec.Egress[0].To {
+		if peer.IPBlock == nil {
+			peers = append(peers, peer)
+		}
+	}
+	for _, cidr := range cidrs {
+		peers = append(peers, networkingv1.NetworkPolicyPeer{IPBlock: &networkingv1.IPBlock{CIDR: cidr}})
+	}
+	p.Spec.Egress[0].To = peers
+}
+
+/*
+LabelPeers turns the labels into NetworkPolicyPeers, one podSelector with a LabelSelectorOpIn requirement per label key. A value
+is only added once to a key.
+*/
+func LabelPeers(podLabels map[string][]string) []networkingv1.NetworkPolicyPeer {
+	peers := make([]networkingv1.NetworkPolicyPeer, 0, len(podLabels))
+
+	for k, values := range podLabels {
 		// we only want to add a value once to a particular key in MatchExpressions.
 		uniqueValues := make(map[string]struct{})
 		for _, v := range values {
@@ -164,19 +489,7 @@ func (h *Handler) AppendLabelsToPeers(targetPodLabels map[string][]string) (ingr
 			finalValues = append(finalValues, v)
 		}
 
-		ingressPeers = append(ingressPeers, networkingv1.NetworkPolicyPeer{
-			PodSelector: &metav1.LabelSelector{
-				MatchExpressions: []metav1.LabelSelectorRequirement{
-					{
-						Key:      k,
-						Operator: metav1.LabelSelectorOpIn,
-						Values:   finalValues,
-					},
-				},
-			},
-		})
-
-		egressPeers = append(egressPeers, networkingv1.NetworkPolicyPeer{
+		peers = append(peers, networkingv1.NetworkPolicyPeer{
 			PodSelector: &metav1.LabelSelector{
 				MatchExpressions: []metav1.LabelSelectorRequirement{
 					{
@@ -188,33 +501,61 @@ func (h *Handler) AppendLabelsToPeers(targetPodLabels map[string][]string) (ingr
 			},
 		})
 	}
+	return peers
+}
 
-	return ingressPeers, egressPeers, nil
+/*
+SelectorPeers turns an object's selector with matchExpressions into a peer selecting the same Pods. The matchLabels and the
+matchExpressions are kept together in one podSelector: NotIn, Exists and DoesNotExist can't be split into LabelSelectorOpIn
+requirements per key, and on their own they'd select every Pod without the key too. Selectors without matchExpressions have no such
+peer, their labels are turned into peers by LabelPeers.
+*/
+func SelectorPeers(selector *metav1.LabelSelector) []networkingv1.NetworkPolicyPeer {
+	if selector == nil || len(selector.MatchExpressions) == 0 {
+		return nil
+	}
+	return []networkingv1.NetworkPolicyPeer{
+		{PodSelector: selector.DeepCopy()},
+	}
 }
 
 /*
-NewPolicy deploys a NetworkPolicy which only allows incoming/outgoing communication from pods with the same label,
-and to/from objects that have the labels located in the global variable DefaultLabels.
+NewPolicy creates a NetworkPolicy which allows incoming/outgoing communication between the pods of the object (peers.Self, or the
+whole podSelector if it has matchExpressions), lets the general peers of the profile (peers.Profile) and the object's dependents in, and lets
+traffic out to the general peers of the profile and the object's dependencies. The port restricted dependencies get their own egress
+rules after the general one, and the ingress rule is limited to peers.IngressPorts. The policies of the OpenEgress profiles have no
+egress rules at all, and leave the egress of the Pods unrestricted.
+
+If peers.Template is set, the policy built this way is only the input of the template, and the rendered policy is returned instead.
+The rendered policy always gets the name, namespace and podSelector of the built one, so that it stays the policy of the object.
 */
-func (h *Handler) NewPolicy(name string, namespace string, podSelectorLabels map[string]string, targetPodLabels map[string][]string) (*networkingv1.NetworkPolicy, error) {
-	if name == "" || namespace == "" || len(podSelectorLabels) == 0 {
+func (h *Handler) NewPolicy(name string, namespace string, podSelector *metav1.LabelSelector, peers Peers) (*networkingv1.NetworkPolicy, error) {
+	if name == "" || namespace == "" || podSelector == nil || (len(podSelector.MatchLabels) == 0 && len(podSelector.MatchExpressions) == 0) {
 		return nil, ErrEmptyParam
 	}
 
-	ingressPeers, egressPeers, err := h.AppendLabelsToPeers(targetPodLabels)
+	profileName, profile, err := h.LookupProfile(peers.Profile)
 	if err != nil {
 		return nil, err
 	}
 
+	// the two directions get their own copies, since the peers of a policy are modified in place
+	ingressPeers, egressPeers := profilePeers(profile)
+	if len(podSelector.MatchExpressions) > 0 {
+		ingressPeers = append(ingressPeers, SelectorPeers(podSelector)...)
+		egressPeers = append(egressPeers, SelectorPeers(podSelector)...)
+	} else {
+		ingressPeers = append(ingressPeers, LabelPeers(peers.Self)...)
+		egressPeers = append(egressPeers, LabelPeers(peers.Self)...)
+	}
+
 	policy := &networkingv1.NetworkPolicy{
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      name,
 			Namespace: namespace,
 		},
 		Spec: networkingv1.NetworkPolicySpec{
-			PodSelector: metav1.LabelSelector{
-				MatchLabels: podSelectorLabels,
-			},
+			PodSelector: *podSelector.DeepCopy(),
 			Ingress: []networkingv1.NetworkPolicyIngressRule{
 				{
 					From: ingressPeers,
@@ -231,49 +572,51 @@ func (h *Handler) NewPolicy(name string, namespace string, podSelectorLabels map
 			},
 		},
 	}
+	ExtendPeers(peers.Dependents, peers.Dependencies, policy)
+	SetPortRules(peers.PortRules, policy)
+	SetIngressPorts(peers.IngressPorts, policy)
+	SetIPBlocks(peers.IPBlocks, policy)
 
-	return policy, nil
-}
+	if profile.OpenEgress {
+		policy.Spec.Egress = nil
+		policy.Spec.PolicyTypes = []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}
+	}
+	if profileName != "" {
+		policy.Annotations = map[string]string{ProfileAnnotation: profileName}
+	}
 
-// GetPolicyByPodLabels returns the policy where podLabels match LabelSelectorRequirements with LabelSelectorOpIn
-func (h *Handler) GetPolicyByPodLabels(namespace string, podLabels map[string]string) (*networkingv1.NetworkPolicy, error) {
-	allPolicies, err := h.Client.NetworkingV1().NetworkPolicies(namespace).List(context.Background(), metav1.ListOptions{})
+	if peers.Template == "" {
+		return policy, nil
+	}
+	rendered, err := h.renderTemplate(peers.Template, newTemplateContext(policy, peers))
 	if err != nil {
-		return nil, fmt.Errorf("error retrieving policy list: %w", err)
+		return nil, err
+	}
+	rendered.TypeMeta, rendered.Name, rendered.Namespace = policy.TypeMeta, policy.Name, policy.Namespace
+	rendered.Spec.PodSelector = policy.Spec.PodSelector
+	if rendered.Annotations == nil {
+		rendered.Annotations = map[string]string{}
+	}
+	for k, v := range policy.Annotations {
+		rendered.Annotations[k] = v
 	}
+	rendered.Annotations[TemplateAnnotation] = peers.Template
 
-	if len(allPolicies.Items) == 0 {
-		return nil, ErrNotFound
+	return rendered, nil
+}
+
+// GetPolicyByOwner returns the policy the controller has created for the object of the kind and name, see SetOwner
+func (h *Handler) GetPolicyByOwner(namespace string, kind string, name string) (*networkingv1.NetworkPolicy, error) {
+	policies, err := h.Client.NetworkingV1().NetworkPolicies(namespace).List(context.Background(), metav1.ListOptions{
+		LabelSelector: ManagedByLabel + "=" + ManagedByValue,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving policy list: %w", err)
 	}
 
-	for _, policy := range allPolicies.Items {
-		for _, rule := range policy.Spec.Ingress {
-			for _, peer := range rule.From {
-				for _, req := range peer.PodSelector.MatchExpressions {
-					if req.Operator != metav1.LabelSelectorOpIn {
-						continue
-					}
-					for key, value := range podLabels {
-						if key == req.Key && attribute.Contains(req.Values, value) {
-							return &policy, nil
-						}
-					}
-				}
-			}
-		}
-		for _, rule := range policy.Spec.Egress {
-			for _, peer := range rule.To {
-				for _, req := range peer.PodSelector.MatchExpressions {
-					if req.Operator != metav1.LabelSelectorOpIn {
-						continue
-					}
-					for key, value := range podLabels {
-						if key == req.Key && attribute.Contains(req.Values, value) {
-							return &policy, nil
-						}
-					}
-				}
-			}
+	for i := range policies.Items {
+		if ownerKind, ownerName := Owner(&policies.Items[i]); ownerKind == kind && ownerName == name {
+			return &policies.Items[i], nil
 		}
 	}
 	return nil, ErrNotFound
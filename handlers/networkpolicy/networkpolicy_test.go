@@ -9,9 +9,12 @@ import (
 
 	"github.com/adykaaa/k8s-netpol-ctrl/handlers/attribute"
 	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	v1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/fake"
 )
 
@@ -73,219 +76,6 @@ func checkSelectors(t *testing.T, peers []networkingv1.NetworkPolicyPeer, target
 	return containsPodSelector
 }
 
-func TestIsInOldLabels(t *testing.T) {
-	tests := []struct {
-		name      string
-		req       metav1.LabelSelectorRequirement
-		oldLabels map[string][]string
-		want      bool
-	}{
-		{
-			name: "label in old labels",
-			req: metav1.LabelSelectorRequirement{
-				Key:    "app",
-				Values: []string{"web"},
-			},
-			oldLabels: map[string][]string{
-				"app": {"web", "db"},
-			},
-			want: true,
-		},
-		{
-			name: "label not in old labels",
-			req: metav1.LabelSelectorRequirement{
-				Key:    "app",
-				Values: []string{"api"},
-			},
-			oldLabels: map[string][]string{
-				"app": {"web", "db"},
-			},
-			want: false,
-		},
-		{
-			name: "old labels are empty",
-			req: metav1.LabelSelectorRequirement{
-				Key:    "app",
-				Values: []string{"web"},
-			},
-			oldLabels: map[string][]string{},
-			want:      false,
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := isInOldLabels(tt.req, tt.oldLabels); got != tt.want {
-				t.Errorf("isInOldLabels() = %v, want %v", got, tt.want)
-			}
-		})
-	}
-}
-
-func TestUpdateIngressRules(t *testing.T) {
-	tests := []struct {
-		name        string
-		oldLabels   map[string][]string
-		ingressRule networkingv1.NetworkPolicyIngressRule
-		want        []metav1.LabelSelectorRequirement
-	}{
-		{
-			name: "OK - removes matching labels",
-			oldLabels: map[string][]string{
-				"app": {"web"},
-			},
-			ingressRule: networkingv1.NetworkPolicyIngressRule{
-				From: []networkingv1.NetworkPolicyPeer{
-					{
-						PodSelector: &metav1.LabelSelector{
-							MatchExpressions: []metav1.LabelSelectorRequirement{
-								{
-									Key:    "app",
-									Values: []string{"web"},
-								},
-								{
-									Key:    "tier",
-									Values: []string{"frontend"},
-								},
-							},
-						},
-					},
-				},
-			},
-			want: []metav1.LabelSelectorRequirement{
-				{
-					Key:    "tier",
-					Values: []string{"frontend"},
-				},
-			},
-		},
-		{
-			name:      "no old labels",
-			oldLabels: map[string][]string{},
-			ingressRule: networkingv1.NetworkPolicyIngressRule{
-				From: []networkingv1.NetworkPolicyPeer{
-					{
-						PodSelector: &metav1.LabelSelector{
-							MatchExpressions: []metav1.LabelSelectorRequirement{
-								{
-									Key:    "app",
-									Values: []string{"web"},
-								},
-								{
-									Key:    "tier",
-									Values: []string{"frontend"},
-								},
-							},
-						},
-					},
-				},
-			},
-			want: []metav1.LabelSelectorRequirement{
-				{
-					Key:    "app",
-					Values: []string{"web"},
-				},
-				{
-					Key:    "tier",
-					Values: []string{"frontend"},
-				},
-			},
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			ingressRules := []networkingv1.NetworkPolicyIngressRule{tt.ingressRule}
-			updateIngressRules(tt.oldLabels, ingressRules)
-			if !reflect.DeepEqual(ingressRules[0].From[0].PodSelector.MatchExpressions, tt.want) {
-				t.Errorf("updateIngressRules() = %v, want %v", ingressRules[0].From[0].PodSelector.MatchExpressions, tt.want)
-			}
-		})
-	}
-}
-
-func TestUpdateEgressRules(t *testing.T) {
-	tests := []struct {
-		name       string
-		oldLabels  map[string][]string
-		egressRule networkingv1.NetworkPolicyEgressRule
-		want       []metav1.LabelSelectorRequirement
-	}{
-		{
-			name: "remove matching labels",
-			oldLabels: map[string][]string{
-				"app": {"web"},
-			},
-			egressRule: networkingv1.NetworkPolicyEgressRule{
-				To: []networkingv1.NetworkPolicyPeer{
-					{
-						PodSelector: &metav1.LabelSelector{
-							MatchExpressions: []metav1.LabelSelectorRequirement{
-								{
-									Key:    "app",
-									Values: []string{"web"},
-								},
-								{
-									Key:    "tier",
-									Values: []string{"frontend"},
-								},
-							},
-						},
-					},
-				},
-			},
-			want: []metav1.LabelSelectorRequirement{
-				{
-					Key:    "tier",
-					Values: []string{"frontend"},
-				},
-			},
-		},
-		{
-			name:      "no old labels",
-			oldLabels: map[string][]string{},
-			egressRule: networkingv1.NetworkPolicyEgressRule{
-				To: []networkingv1.NetworkPolicyPeer{
-					{
-						PodSelector: &metav1.LabelSelector{
-							MatchExpressions: []metav1.LabelSelectorRequirement{
-								{
-									Key:    "app",
-									Values: []string{"web"},
-								},
-								{
-									Key:    "tier",
-									Values: []string{"frontend"},
-								},
-							},
-						},
-					},
-				},
-			},
-			want: []metav1.LabelSelectorRequirement{
-				{
-					Key:    "app",
-					Values: []string{"web"},
-				},
-				{
-					Key:    "tier",
-					Values: []string{"frontend"},
-				},
-			},
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			egressRules := []networkingv1.NetworkPolicyEgressRule{tt.egressRule}
-			updateEgressRules(tt.oldLabels, egressRules)
-			if !reflect.DeepEqual(egressRules[0].To[0].PodSelector.MatchExpressions, tt.want) {
-				t.Errorf("updateEgressRules() = %v, want %v", egressRules[0].To[0].PodSelector.MatchExpressions, tt.want)
-			}
-		})
-	}
-}
-
 func TestGetDefaultSupportedPeers(t *testing.T) {
 	tests := []struct {
 		name           string
@@ -365,54 +155,281 @@ func TestGetDefaultSupportedPeers(t *testing.T) {
 	}
 }
 
-func TestAppendLabelsToPeers(t *testing.T) {
+func TestNewPolicyDirections(t *testing.T) {
+	h := &Handler{}
+	dependency := networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}}
+	dependent := networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "frontend"}}}
+
+	p, err := h.NewPolicy("testpolicy", "default", &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}}, Peers{
+		Self:         map[string][]string{"app": {"test"}},
+		Dependencies: []networkingv1.NetworkPolicyPeer{dependency},
+		Dependents:   []networkingv1.NetworkPolicyPeer{dependent},
+	})
+	assert.NoError(t, err)
+
+	self := LabelPeers(map[string][]string{"app": {"test"}})[0]
+	ingressControllers := getDefaultSupportedPeers(_IngressControllerLabels)[0]
+	dns := getDefaultSupportedPeers(_DNSLabels)[0]
+
+	assert.Contains(t, p.Spec.Ingress[0].From, self)
+	assert.Contains(t, p.Spec.Egress[0].To, self)
+
+	assert.Contains(t, p.Spec.Ingress[0].From, ingressControllers)
+	assert.NotContains(t, p.Spec.Egress[0].To, ingressControllers)
+
+	assert.Contains(t, p.Spec.Egress[0].To, dns)
+	assert.NotContains(t, p.Spec.Ingress[0].From, dns)
+
+	assert.Contains(t, p.Spec.Egress[0].To, dependency)
+	assert.NotContains(t, p.Spec.Ingress[0].From, dependency)
+
+	assert.Contains(t, p.Spec.Ingress[0].From, dependent)
+	assert.NotContains(t, p.Spec.Egress[0].To, dependent)
+}
+
+func TestNewDeclaredPeers(t *testing.T) {
+	peers := NewDeclaredPeers("default", []attribute.DeclaredTarget{
+		{Namespace: "default", Labels: map[string]string{"app": "api"}},
+		{Namespace: "edge", Labels: map[string]string{"app": "gateway"}},
+		{Namespace: "monitoring", Labels: map[string]string{}},
+		{Namespace: "default", Expressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: metav1.LabelSelectorOpExists}}},
+	})
+
+	assert.Equal(t, []networkingv1.NetworkPolicyPeer{
+		{
+			PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}},
+		},
+		{
+			PodSelector:       &metav1.LabelSelector{MatchLabels: map[string]string{"app": "gateway"}},
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/metadata.name": "edge"}},
+		},
+		{
+			NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"kubernetes.io/metadata.name": "monitoring"}},
+		},
+		{
+			PodSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: metav1.LabelSelectorOpExists}}},
+		},
+	}, peers)
+}
+
+func TestSetIPBlocks(t *testing.T) {
+	selectorPeer := networkingv1.NetworkPolicyPeer{
+		PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}},
+	}
+	p := &networkingv1.NetworkPolicy{
+		Spec: networkingv1.NetworkPolicySpec{
+			Egress: []networkingv1.NetworkPolicyEgressRule{
+				{
+					To: []networkingv1.NetworkPolicyPeer{
+						selectorPeer,
+						{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.1/32"}},
+					},
+				},
+			},
+		},
+	}
+
+	SetIPBlocks([]string{"10.0.0.2/32"}, p)
+	assert.Equal(t, []networkingv1.NetworkPolicyPeer{
+		selectorPeer,
+		{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.2/32"}},
+	}, p.Spec.Egress[0].To)
+
+	SetIPBlocks(nil, p)
+	assert.Equal(t, []networkingv1.NetworkPolicyPeer{selectorPeer}, p.Spec.Egress[0].To)
+}
+
+func TestNewPortRules(t *testing.T) {
+	tcp := corev1.ProtocolTCP
+	port5432 := intstr.FromInt(5432)
+
+	unrestricted, rules := NewPortRules("testnamespace", []attribute.Target{
+		{Namespace: "testnamespace", Labels: map[string][]string{"app": {"cache"}}},
+		{Namespace: "testnamespace", Labels: map[string][]string{"app": {"db"}}, Ports: []attribute.TargetPort{{Port: 5432, Protocol: corev1.ProtocolTCP}}},
+		{Namespace: "testnamespace", Labels: map[string][]string{"app": {"replica"}}, Ports: []attribute.TargetPort{{Port: 5432, Protocol: corev1.ProtocolTCP}}},
+	})
+
+	assert.Equal(t, LabelPeers(map[string][]string{"app": {"cache"}}), unrestricted)
+	assert.Len(t, rules, 1)
+	assert.Equal(t, []networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &port5432}}, rules[0].Ports)
+	assert.Len(t, rules[0].To, 1)
+	assert.Nil(t, rules[0].To[0].NamespaceSelector)
+	assert.ElementsMatch(t, []string{"db", "replica"}, rules[0].To[0].PodSelector.MatchExpressions[0].Values)
+}
+
+func TestNewPortRulesOtherNamespace(t *testing.T) {
+	dataNamespace := &metav1.LabelSelector{MatchLabels: map[string]string{corev1.LabelMetadataName: "data"}}
+
+	unrestricted, rules := NewPortRules("testnamespace", []attribute.Target{
+		{Namespace: "data", Labels: map[string][]string{"app": {"cache"}}},
+		{Namespace: "data", Labels: map[string][]string{"app": {"db"}}, Ports: []attribute.TargetPort{{Port: 5432, Protocol: corev1.ProtocolTCP}}},
+		{Namespace: "testnamespace", Labels: map[string][]string{"app": {"replica"}}, Ports: []attribute.TargetPort{{Port: 5432, Protocol: corev1.ProtocolTCP}}},
+	})
+
+	// the targets of another namespace are only selected in their namespace, and never merged with the ones of the policy's namespace
+	assert.Len(t, unrestricted, 1)
+	assert.Equal(t, dataNamespace, unrestricted[0].NamespaceSelector)
+	assert.Equal(t, []string{"cache"}, unrestricted[0].PodSelector.MatchExpressions[0].Values)
+
+	assert.Len(t, rules, 1)
+	assert.Len(t, rules[0].To, 2)
+	assert.Equal(t, dataNamespace, rules[0].To[0].NamespaceSelector)
+	assert.Equal(t, []string{"db"}, rules[0].To[0].PodSelector.MatchExpressions[0].Values)
+	assert.Nil(t, rules[0].To[1].NamespaceSelector)
+	assert.Equal(t, []string{"replica"}, rules[0].To[1].PodSelector.MatchExpressions[0].Values)
+}
+
+func TestSetPortRules(t *testing.T) {
+	general := networkingv1.NetworkPolicyEgressRule{
+		To: []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}}}},
+	}
+	port := intstr.FromInt(5432)
+	portRule := networkingv1.NetworkPolicyEgressRule{
+		To:    []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}}},
+		Ports: []networkingv1.NetworkPolicyPort{{Port: &port}},
+	}
+	p := &networkingv1.NetworkPolicy{Spec: networkingv1.NetworkPolicySpec{Egress: []networkingv1.NetworkPolicyEgressRule{general}}}
+
+	SetPortRules([]networkingv1.NetworkPolicyEgressRule{portRule}, p)
+	assert.Equal(t, []networkingv1.NetworkPolicyEgressRule{general, portRule}, p.Spec.Egress)
+
+	// the general rule is the only one ipBlocks and new peers end up in
+	SetIPBlocks([]string{"10.0.0.2/32"}, p)
+	ExtendPeers(nil, []networkingv1.NetworkPolicyPeer{{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "new"}}}}, p)
+	assert.Len(t, p.Spec.Egress[0].To, 3)
+	assert.Equal(t, portRule, p.Spec.Egress[1])
+
+	SetPortRules(nil, p)
+	assert.Len(t, p.Spec.Egress, 1)
+}
+
+func TestSetIngressPorts(t *testing.T) {
+	udp := corev1.ProtocolUDP
+	port := intstr.FromInt(5353)
+	p := &networkingv1.NetworkPolicy{Spec: networkingv1.NetworkPolicySpec{Ingress: []networkingv1.NetworkPolicyIngressRule{{}}}}
+
+	SetIngressPorts([]attribute.TargetPort{{Port: 5353, Protocol: corev1.ProtocolUDP}}, p)
+	assert.Equal(t, []networkingv1.NetworkPolicyPort{{Protocol: &udp, Port: &port}}, p.Spec.Ingress[0].Ports)
+
+	SetIngressPorts(nil, p)
+	assert.Empty(t, p.Spec.Ingress[0].Ports)
+}
+
+func TestSetPending(t *testing.T) {
+	p := &networkingv1.NetworkPolicy{}
+
+	SetPending([]string{"api.default.svc.cluster.local", "db-0.data.pod.cluster.local"}, p)
+	assert.Equal(t, "api.default.svc.cluster.local,db-0.data.pod.cluster.local", p.Annotations[PendingAnnotation])
+	assert.Equal(t, []string{"api.default.svc.cluster.local", "db-0.data.pod.cluster.local"}, Pending(p))
+
+	SetPending(nil, p)
+	assert.NotContains(t, p.Annotations, PendingAnnotation)
+	assert.Empty(t, Pending(p))
+}
+
+func TestMergePolicy(t *testing.T) {
+	peer := func(app string) networkingv1.NetworkPolicyPeer {
+		return networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": app}}}
+	}
+	http, grpc := intstr.FromInt(8080), intstr.FromInt(9090)
+	dbPort := intstr.FromInt(5432)
+	dbRule := networkingv1.NetworkPolicyEgressRule{To: []networkingv1.NetworkPolicyPeer{peer("db")}, Ports: []networkingv1.NetworkPolicyPort{{Port: &dbPort}}}
+
+	p := &networkingv1.NetworkPolicy{Spec: networkingv1.NetworkPolicySpec{
+		Ingress: []networkingv1.NetworkPolicyIngressRule{{From: []networkingv1.NetworkPolicyPeer{peer("api"), peer("web")}, Ports: []networkingv1.NetworkPolicyPort{{Port: &http}}}},
+		Egress:  []networkingv1.NetworkPolicyEgressRule{{To: []networkingv1.NetworkPolicyPeer{peer("api")}}},
+	}}
+	SetPending([]string{"cache.default.svc.cluster.local"}, p)
+
+	src := &networkingv1.NetworkPolicy{Spec: networkingv1.NetworkPolicySpec{
+		Ingress: []networkingv1.NetworkPolicyIngressRule{{From: []networkingv1.NetworkPolicyPeer{peer("api"), peer("worker")}, Ports: []networkingv1.NetworkPolicyPort{{Port: &grpc}}}},
+		Egress:  []networkingv1.NetworkPolicyEgressRule{{To: []networkingv1.NetworkPolicyPeer{peer("api"), peer("queue")}}, dbRule},
+	}}
+	SetPending([]string{"cache.default.svc.cluster.local", "search.default.svc.cluster.local"}, src)
+
+	MergePolicy(src, p)
+	assert.Equal(t, []networkingv1.NetworkPolicyPeer{peer("api"), peer("web"), peer("worker")}, p.Spec.Ingress[0].From)
+	assert.Equal(t, []networkingv1.NetworkPolicyPort{{Port: &http}, {Port: &grpc}}, p.Spec.Ingress[0].Ports)
+	assert.Equal(t, []networkingv1.NetworkPolicyEgressRule{{To: []networkingv1.NetworkPolicyPeer{peer("api"), peer("queue")}}, dbRule}, p.Spec.Egress)
+	assert.Equal(t, []string{"cache.default.svc.cluster.local", "search.default.svc.cluster.local"}, Pending(p))
+
+	// merging again changes nothing, and a source reachable on every port lifts the port limit
+	MergePolicy(src, p)
+	assert.Len(t, p.Spec.Egress, 2)
+	src.Spec.Ingress[0].Ports = nil
+	MergePolicy(src, p)
+	assert.Empty(t, p.Spec.Ingress[0].Ports)
+}
+
+func TestPolicyName(t *testing.T) {
 	testCases := []struct {
-		name            string
-		targetPodLabels map[string][]string
-		testErr         func(t *testing.T, err error)
+		name     string
+		kind     string
+		objName  string
+		expected string
 	}{
 		{
-			name:            "OK",
-			targetPodLabels: map[string][]string{"app": {"test"}},
-			testErr: func(t *testing.T, err error) {
-				assert.NoError(t, err)
-			},
+			name:     "kind and name",
+			kind:     "Deployment",
+			objName:  "api",
+			expected: "deployment-api-netpol",
 		},
 		{
-			name:            "returns ErrEmptyParam",
-			targetPodLabels: map[string][]string{},
-			testErr: func(t *testing.T, err error) {
-				assert.ErrorIs(t, err, ErrEmptyParam)
-			},
+			name:     "objects of different kinds don't collide",
+			kind:     "Pod",
+			objName:  "api",
+			expected: "pod-api-netpol",
 		},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			h := &Handler{}
-			ingressPeers, egressPeers, err := h.AppendLabelsToPeers(tc.targetPodLabels)
-			tc.testErr(t, err)
-			if err == nil {
-				containsPodSelector := checkSelectors(t, ingressPeers, tc.targetPodLabels)
-				for k, values := range tc.targetPodLabels {
-					for _, v := range values {
-						if !containsPodSelector[k][v] {
-							t.Errorf("expected PodSelector in ingressPeers to contain label %s with value %s", k, v)
-						}
-					}
-				}
-
-				containsPodSelector = checkSelectors(t, egressPeers, tc.targetPodLabels)
-				for k, values := range tc.targetPodLabels {
-					for _, v := range values {
-						if !containsPodSelector[k][v] {
-							t.Errorf("expected PodSelector in egressPeers to contain label %s with value %s", k, v)
-						}
-					}
-				}
-			}
+			assert.Equal(t, tc.expected, PolicyName(tc.kind, tc.objName))
 		})
 	}
+
+	// long names are truncated, and names that only differ after the cut still get different hashes
+	long := strings.Repeat("a", 250)
+	name := PolicyName("StatefulSet", long)
+	assert.Len(t, name, 253)
+	assert.Regexp(t, "^statefulset-a+-[0-9a-f]{10}-netpol$", name)
+	assert.Equal(t, name, PolicyName("StatefulSet", long))
+	assert.NotEqual(t, name, PolicyName("StatefulSet", long+"b"))
+}
+
+func TestSetOwner(t *testing.T) {
+	p := &networkingv1.NetworkPolicy{}
+	SetOwner("Deployment", "api", p)
+
+	kind, name := Owner(p)
+	assert.Equal(t, "Deployment", kind)
+	assert.Equal(t, "api", name)
+	assert.Equal(t, ManagedByValue, p.Labels[ManagedByLabel])
+}
+
+func TestNewBaselinePolicy(t *testing.T) {
+	p := NewBaselinePolicy("shop")
+
+	assert.Equal(t, "namespace-shop-netpol", p.Name)
+	assert.Equal(t, "shop", p.Namespace)
+	assert.Empty(t, p.Spec.PodSelector.MatchLabels)
+	assert.Empty(t, p.Spec.Ingress)
+	assert.Equal(t, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress, networkingv1.PolicyTypeEgress}, p.Spec.PolicyTypes)
+
+	// the only egress is DNS to kube-system
+	assert.Len(t, p.Spec.Egress, 1)
+	assert.Len(t, p.Spec.Egress[0].Ports, 2)
+	for _, port := range p.Spec.Egress[0].Ports {
+		assert.Equal(t, int32(53), port.Port.IntVal)
+	}
+	assert.NotEmpty(t, p.Spec.Egress[0].To)
+	for _, peer := range p.Spec.Egress[0].To {
+		assert.Equal(t, map[string]string{corev1.LabelMetadataName: "kube-system"}, peer.NamespaceSelector.MatchLabels)
+	}
+
+	kind, name := Owner(p)
+	assert.Equal(t, "Namespace", kind)
+	assert.Equal(t, "shop", name)
 }
 
 func TestNewPolicy(t *testing.T) {
@@ -453,7 +470,7 @@ func TestNewPolicy(t *testing.T) {
 			h := &Handler{
 				Client: fake.NewSimpleClientset(),
 			}
-			p, err := h.NewPolicy(tc.policyName, tc.namespace, tc.podSelectorLabels, tc.targetPodLabels)
+			p, err := h.NewPolicy(tc.policyName, tc.namespace, &metav1.LabelSelector{MatchLabels: tc.podSelectorLabels}, Peers{Self: tc.targetPodLabels})
 			isErr := tc.testErr(t, err)
 
 			if !isErr {
@@ -498,170 +515,82 @@ func TestNewPolicy(t *testing.T) {
 	}
 }
 
-func TestGetPolicyByPodLabels(t *testing.T) {
-	testCases := []struct {
-		name      string
-		namespace string
-		podLabels map[string]string
-		policies  []*networkingv1.NetworkPolicy
-		expected  *networkingv1.NetworkPolicy
-		testErr   func(t *testing.T, err error)
-	}{
-		{
-			name:      "OK",
-			namespace: "default",
-			podLabels: map[string]string{"app": "test"},
-			policies: []*networkingv1.NetworkPolicy{
-				{
-					ObjectMeta: metav1.ObjectMeta{Name: "right", Namespace: "default"},
-					Spec: networkingv1.NetworkPolicySpec{
-						Ingress: []networkingv1.NetworkPolicyIngressRule{
-							{
-								From: []networkingv1.NetworkPolicyPeer{
-									{
-										PodSelector: &metav1.LabelSelector{
-											MatchExpressions: []metav1.LabelSelectorRequirement{
-												{
-													Key:      "app",
-													Operator: metav1.LabelSelectorOpIn,
-													Values:   []string{"test"},
-												},
-											},
-										},
-									},
-								},
-							},
-						},
-						Egress: []networkingv1.NetworkPolicyEgressRule{
-							{
-								To: []networkingv1.NetworkPolicyPeer{
-									{
-										PodSelector: &metav1.LabelSelector{
-											MatchExpressions: []metav1.LabelSelectorRequirement{
-												{
-													Key:      "app",
-													Operator: metav1.LabelSelectorOpIn,
-													Values:   []string{"test"},
-												},
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-				{
-					ObjectMeta: metav1.ObjectMeta{Name: "wrong"},
-					Spec: networkingv1.NetworkPolicySpec{
-						Ingress: []networkingv1.NetworkPolicyIngressRule{
-							{
-								From: []networkingv1.NetworkPolicyPeer{
-									{
-										PodSelector: &metav1.LabelSelector{
-											MatchExpressions: []metav1.LabelSelectorRequirement{
-												{
-													Key:      "app",
-													Operator: metav1.LabelSelectorOpIn,
-													Values:   []string{"other"},
-												},
-											},
-										},
-									},
-								},
-							},
-						},
-						Egress: []networkingv1.NetworkPolicyEgressRule{
-							{
-								To: []networkingv1.NetworkPolicyPeer{
-									{
-										PodSelector: &metav1.LabelSelector{
-											MatchExpressions: []metav1.LabelSelectorRequirement{
-												{
-													Key:      "app",
-													Operator: metav1.LabelSelectorOpIn,
-													Values:   []string{"other"},
-												},
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-			expected: &networkingv1.NetworkPolicy{
-				ObjectMeta: metav1.ObjectMeta{Name: "right", Namespace: "default"},
-				Spec: networkingv1.NetworkPolicySpec{
-					Ingress: []networkingv1.NetworkPolicyIngressRule{
-						{
-							From: []networkingv1.NetworkPolicyPeer{
-								{
-									PodSelector: &metav1.LabelSelector{
-										MatchExpressions: []metav1.LabelSelectorRequirement{
-											{
-												Key:      "app",
-												Operator: metav1.LabelSelectorOpIn,
-												Values:   []string{"test"},
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-					Egress: []networkingv1.NetworkPolicyEgressRule{
-						{
-							To: []networkingv1.NetworkPolicyPeer{
-								{
-									PodSelector: &metav1.LabelSelector{
-										MatchExpressions: []metav1.LabelSelectorRequirement{
-											{
-												Key:      "app",
-												Operator: metav1.LabelSelectorOpIn,
-												Values:   []string{"test"},
-											},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
-			},
-			testErr: func(t *testing.T, err error) {
-				assert.NoError(t, err)
-			},
-		},
-		{
-			name:      "no policy in namespace",
-			namespace: "default",
-			podLabels: map[string]string{"app": "test"},
-			policies:  []*networkingv1.NetworkPolicy{},
-			expected:  nil,
-			testErr: func(t *testing.T, err error) {
-				assert.ErrorIs(t, err, ErrNotFound)
-			},
-		},
+func TestNewPolicyExpressions(t *testing.T) {
+	h := &Handler{}
+	expressions := []metav1.LabelSelectorRequirement{
+		{Key: "tier", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"cache"}},
+		{Key: "app", Operator: metav1.LabelSelectorOpExists},
 	}
 
-	for _, tc := range testCases {
-		t.Run(tc.name, func(t *testing.T) {
-			h := &Handler{
-				Client: fake.NewSimpleClientset(),
-			}
+	t.Run("OK - selected by matchExpressions only", func(t *testing.T) {
+		selector := &metav1.LabelSelector{MatchExpressions: expressions}
+		p, err := h.NewPolicy("testpolicy", "default", selector, Peers{})
+		assert.NoError(t, err)
+		assert.Equal(t, *selector, p.Spec.PodSelector)
 
-			for _, policy := range tc.policies {
-				_, err := h.Client.NetworkingV1().NetworkPolicies(tc.namespace).Create(context.Background(), policy, metav1.CreateOptions{})
-				if err != nil {
-					t.Fatalf("Failed to create test policy: %v", err)
-				}
+		self := networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchExpressions: expressions}}
+		assert.Contains(t, p.Spec.Ingress[0].From, self)
+		assert.Contains(t, p.Spec.Egress[0].To, self)
+		assert.Contains(t, p.Spec.Ingress[0].From, getDefaultSupportedPeers(_IngressControllerLabels)[0])
+		assert.Contains(t, p.Spec.Egress[0].To, getDefaultSupportedPeers(_DNSLabels)[0])
+	})
+
+	t.Run("OK - matchLabels and matchExpressions", func(t *testing.T) {
+		selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}, MatchExpressions: expressions}
+		p, err := h.NewPolicy("testpolicy", "default", selector, Peers{Self: map[string][]string{"app": {"test"}}})
+		assert.NoError(t, err)
+		assert.Equal(t, *selector, p.Spec.PodSelector)
+		assert.Contains(t, p.Spec.Ingress[0].From, SelectorPeers(selector)[0])
+		assert.NotContains(t, p.Spec.Ingress[0].From, LabelPeers(map[string][]string{"app": {"test"}})[0])
+	})
+
+	t.Run("OK - NotIn doesn't let in the Pods without the matchLabels", func(t *testing.T) {
+		selector := &metav1.LabelSelector{
+			MatchLabels:      map[string]string{"app": "test"},
+			MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "tier", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"canary"}}},
+		}
+		p, err := h.NewPolicy("testpolicy", "default", selector, Peers{Self: map[string][]string{"app": {"test"}}})
+		assert.NoError(t, err)
+
+		// a Pod of another app without a tier label is only let in by a peer which ignores the matchLabels
+		other := labels.Set{"app": "other"}
+		self := labels.Set{"app": "test", "tier": "web"}
+		for _, peers := range [][]networkingv1.NetworkPolicyPeer{p.Spec.Ingress[0].From, p.Spec.Egress[0].To} {
+			selectsSelf := false
+			for _, peer := range peers {
+				s, err := metav1.LabelSelectorAsSelector(peer.PodSelector)
+				assert.NoError(t, err)
+				assert.False(t, s.Matches(other), "peer %v selects the Pods of another app", peer.PodSelector)
+				selectsSelf = selectsSelf || s.Matches(self)
 			}
+			assert.True(t, selectsSelf)
+		}
+	})
 
-			result, err := h.GetPolicyByPodLabels(tc.namespace, tc.podLabels)
-			tc.testErr(t, err)
-			assert.Equal(t, tc.expected, result)
-		})
-	}
+	t.Run("returns ErrEmptyParam - empty selector", func(t *testing.T) {
+		_, err := h.NewPolicy("testpolicy", "default", &metav1.LabelSelector{}, Peers{})
+		assert.ErrorIs(t, err, ErrEmptyParam)
+	})
+}
+
+func TestGetPolicyByOwner(t *testing.T) {
+	owned := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Name: "deployment-api-netpol", Namespace: "default"}}
+	SetOwner("Deployment", "api", owned)
+	// the same annotations without the managed-by label don't make a policy the controller's
+	foreign := &networkingv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{
+		Name:        "pod-api-netpol",
+		Namespace:   "default",
+		Annotations: map[string]string{OwnerKindAnnotation: "Pod", OwnerNameAnnotation: "api"},
+	}}
+	h := &Handler{Client: fake.NewSimpleClientset(owned, foreign)}
+
+	p, err := h.GetPolicyByOwner("default", "Deployment", "api")
+	assert.NoError(t, err)
+	assert.Equal(t, "deployment-api-netpol", p.Name)
+
+	_, err = h.GetPolicyByOwner("default", "Pod", "api")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	_, err = h.GetPolicyByOwner("other", "Deployment", "api")
+	assert.ErrorIs(t, err, ErrNotFound)
 }
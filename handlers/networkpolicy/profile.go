@@ -0,0 +1,95 @@
+package networkpolicy
+
+import (
+	"errors"
+	"fmt"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ProfileAnnotation picks the profile of a workload's policy, or of the policies in a namespace. The policies record their profile with it too.
+const ProfileAnnotation = "netpol-ctrl.io/profile"
+
+var ErrUnknownProfile = errors.New("unknown policy profile")
+
+/*
+Profile decides which general peers a policy lets through next to the object's own Pods, its dependencies and its dependents.
+Every profile allows the traffic between the object's own Pods.
+*/
+type Profile struct {
+	// IngressControllers lets the supported ingress controllers in
+	IngressControllers bool
+	// DNS lets traffic out to the supported DNS Pods
+	DNS bool
+	// SameNamespace lets every Pod of the policy's namespace in and out
+	SameNamespace bool
+	// OpenEgress leaves the egress of the Pods unrestricted, only their ingress is limited
+	OpenEgress bool
+}
+
+// DefaultProfile is the shape of the policies without a profile: the ingress controllers are let in, and DNS is let out
+var DefaultProfile = Profile{IngressControllers: true, DNS: true}
+
+// _builtinProfiles are the profiles which can be picked without configuring them. The configured profiles replace them by name.
+var _builtinProfiles = map[string]Profile{
+	"strict":      {DNS: true},
+	"baseline":    {IngressControllers: true, DNS: true, SameNamespace: true},
+	"open-egress": {IngressControllers: true, OpenEgress: true},
+}
+
+/*
+LookupProfile returns the profile with the given name, a configured one or a built-in one, together with its name. An empty name
+means the configured default profile, and DefaultProfile (with an empty name) if there is none.
+*/
+func (h *Handler) LookupProfile(name string) (string, Profile, error) {
+	if name == "" {
+		name = h.DefaultProfile
+	}
+	if name == "" {
+		return "", DefaultProfile, nil
+	}
+
+	if profile, ok := h.Profiles[name]; ok {
+		return name, profile, nil
+	}
+	if profile, ok := _builtinProfiles[name]; ok {
+		return name, profile, nil
+	}
+	return "", Profile{}, fmt.Errorf("%w: %q", ErrUnknownProfile, name)
+}
+
+// profilePeers returns the general peers the profile lets in and out, the ingress controllers and the DNS Pods come first
+func profilePeers(profile Profile) (ingressPeers []networkingv1.NetworkPolicyPeer, egressPeers []networkingv1.NetworkPolicyPeer) {
+	if profile.IngressControllers {
+		ingressPeers = getDefaultSupportedPeers(_IngressControllerLabels)
+	}
+	if profile.DNS {
+		egressPeers = getDefaultSupportedPeers(_DNSLabels)
+	}
+	if profile.SameNamespace {
+		// an empty podSelector selects every Pod in the namespace of the policy
+		ingressPeers = append(ingressPeers, networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{}})
+		egressPeers = append(egressPeers, networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{}})
+	}
+	return ingressPeers, egressPeers
+}
+
+// AppliedProfile returns the name of the profile the policy was built from, it's empty for the policies without a profile
+func AppliedProfile(p *networkingv1.NetworkPolicy) string {
+	return p.Annotations[ProfileAnnotation]
+}
+
+// restrictsEgress reports whether the policy limits the egress of its Pods, the policies of the OpenEgress profiles don't
+func restrictsEgress(p *networkingv1.NetworkPolicy) bool {
+	// like the API server does, the policies without policyTypes limit the egress if they have egress rules
+	if len(p.Spec.PolicyTypes) == 0 {
+		return len(p.Spec.Egress) > 0
+	}
+	for _, t := range p.Spec.PolicyTypes {
+		if t == networkingv1.PolicyTypeEgress {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package networkpolicy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLookupProfile(t *testing.T) {
+	testCases := []struct {
+		name            string
+		handler         *Handler
+		profile         string
+		expectedName    string
+		expectedProfile Profile
+		testErr         func(t *testing.T, err error)
+	}{
+		{
+			name:            "OK - default profile without a name",
+			handler:         &Handler{},
+			expectedProfile: DefaultProfile,
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:            "OK - built-in profile",
+			handler:         &Handler{},
+			profile:         "strict",
+			expectedName:    "strict",
+			expectedProfile: Profile{DNS: true},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:            "OK - configured profile replaces the built-in one",
+			handler:         &Handler{Profiles: map[string]Profile{"strict": {}}},
+			profile:         "strict",
+			expectedName:    "strict",
+			expectedProfile: Profile{},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:            "OK - configured default profile",
+			handler:         &Handler{DefaultProfile: "open-egress"},
+			expectedName:    "open-egress",
+			expectedProfile: Profile{IngressControllers: true, OpenEgress: true},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:    "fails - unknown profile",
+			handler: &Handler{},
+			profile: "lenient",
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrUnknownProfile)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			name, profile, err := tc.handler.LookupProfile(tc.profile)
+			tc.testErr(t, err)
+			assert.Equal(t, tc.expectedName, name)
+			assert.Equal(t, tc.expectedProfile, profile)
+		})
+	}
+}
+
+func TestNewPolicyProfiles(t *testing.T) {
+	h := &Handler{}
+	dependency := networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}}
+	self := LabelPeers(map[string][]string{"app": {"test"}})[0]
+	ingressControllers := getDefaultSupportedPeers(_IngressControllerLabels)[0]
+	dns := getDefaultSupportedPeers(_DNSLabels)[0]
+	sameNamespace := networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{}}
+
+	newPolicy := func(profile string) *networkingv1.NetworkPolicy {
+		p, err := h.NewPolicy("testpolicy", "default", &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}}, Peers{
+			Self:         map[string][]string{"app": {"test"}},
+			Dependencies: []networkingv1.NetworkPolicyPeer{dependency},
+			Profile:      profile,
+		})
+		assert.NoError(t, err)
+		return p
+	}
+
+	t.Run("strict", func(t *testing.T) {
+		p := newPolicy("strict")
+		assert.Equal(t, "strict", AppliedProfile(p))
+		assert.Equal(t, []networkingv1.NetworkPolicyPeer{self}, p.Spec.Ingress[0].From)
+		assert.Equal(t, []networkingv1.NetworkPolicyPeer{dns, self, dependency}, p.Spec.Egress[0].To)
+	})
+
+	t.Run("baseline", func(t *testing.T) {
+		p := newPolicy("baseline")
+		assert.Equal(t, []networkingv1.NetworkPolicyPeer{ingressControllers, sameNamespace, self}, p.Spec.Ingress[0].From)
+		assert.Equal(t, []networkingv1.NetworkPolicyPeer{dns, sameNamespace, self, dependency}, p.Spec.Egress[0].To)
+	})
+
+	t.Run("open-egress", func(t *testing.T) {
+		p := newPolicy("open-egress")
+		assert.Equal(t, []networkingv1.NetworkPolicyPeer{ingressControllers, self}, p.Spec.Ingress[0].From)
+		assert.Empty(t, p.Spec.Egress)
+		assert.Equal(t, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}, p.Spec.PolicyTypes)
+	})
+
+	t.Run("no profile", func(t *testing.T) {
+		p := newPolicy("")
+		assert.Empty(t, AppliedProfile(p))
+		assert.Equal(t, []networkingv1.NetworkPolicyPeer{ingressControllers, self}, p.Spec.Ingress[0].From)
+	})
+
+	t.Run("unknown profile", func(t *testing.T) {
+		_, err := h.NewPolicy("testpolicy", "default", &metav1.LabelSelector{MatchLabels: map[string]string{"app": "test"}}, Peers{Profile: "lenient"})
+		assert.ErrorIs(t, err, ErrUnknownProfile)
+	})
+}
+
+func TestMergePolicyOpenEgress(t *testing.T) {
+	h := &Handler{}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}}
+
+	p, err := h.NewPolicy("testpolicy", "default", selector, Peers{Profile: "strict"})
+	assert.NoError(t, err)
+	src, err := h.NewPolicy("testpolicy", "default", selector, Peers{Profile: "open-egress"})
+	assert.NoError(t, err)
+
+	// the egress of the shared policy is as open as the most open one
+	MergePolicy(src, p)
+	assert.Empty(t, p.Spec.Egress)
+	assert.Equal(t, []networkingv1.PolicyType{networkingv1.PolicyTypeIngress}, p.Spec.PolicyTypes)
+}
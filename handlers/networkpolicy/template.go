@@ -0,0 +1,278 @@
+package networkpolicy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"text/template"
+
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/attribute"
+	"github.com/adykaaa/k8s-netpol-ctrl/handlers/object"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// TemplateLabel picks the template a workload's policy is rendered from, by its key in the template ConfigMap
+	TemplateLabel = "netpol-ctrl.io/template"
+	// TemplateAnnotation records the template the policy was rendered from
+	TemplateAnnotation = "netpol-ctrl.io/template"
+)
+
+var (
+	ErrTemplateNotFound = errors.New("policy template not found")
+	ErrInvalidTemplate  = errors.New("invalid policy template")
+	ErrInvalidPolicy    = errors.New("invalid NetworkPolicy")
+)
+
+// _templateFuncs are the functions the templates can use on top of the built-in ones of text/template
+var _templateFuncs = template.FuncMap{
+	// toJSON renders a value as JSON, which is valid YAML too, e.g ingress: {{ toJSON .Policy.Spec.Ingress }}
+	"toJSON": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// TemplateWorkload is the object a policy template is rendered for
+type TemplateWorkload struct {
+	Kind        string
+	Name        string
+	Labels      map[string]string
+	Annotations map[string]string
+}
+
+// TemplateContext is what the policy templates are rendered with
+type TemplateContext struct {
+	Workload  TemplateWorkload
+	Namespace string
+	// Policy is the policy built from the profile of the workload, its rules can be reused by the template
+	Policy *networkingv1.NetworkPolicy
+	// Dependencies are the resolved dependencies of the workload, PortRules are the ones which can only be reached on some ports
+	Dependencies []networkingv1.NetworkPolicyPeer
+	PortRules    []networkingv1.NetworkPolicyEgressRule
+	Dependents   []networkingv1.NetworkPolicyPeer
+	IPBlocks     []string
+	// IngressPorts are the ports the workload serves on, every port can be reached if it's empty
+	IngressPorts []attribute.TargetPort
+}
+
+// newTemplateContext returns the context of the policy template rendered for the policy built from the peers
+func newTemplateContext(p *networkingv1.NetworkPolicy, peers Peers) TemplateContext {
+	ctx := TemplateContext{
+		Namespace:    p.Namespace,
+		Policy:       p.DeepCopy(),
+		Dependencies: peers.Dependencies,
+		PortRules:    peers.PortRules,
+		Dependents:   peers.Dependents,
+		IPBlocks:     peers.IPBlocks,
+		IngressPorts: peers.IngressPorts,
+	}
+	if peers.Owner != nil {
+		ctx.Workload = TemplateWorkload{
+			Kind:        object.Kind(peers.Owner),
+			Name:        peers.Owner.GetName(),
+			Labels:      peers.Owner.GetLabels(),
+			Annotations: peers.Owner.GetAnnotations(),
+		}
+	}
+	return ctx
+}
+
+/*
+templateConfigMap returns the template ConfigMap from the ConfigMapIndexer if there is one, otherwise it fetches it through the API.
+It returns ErrTemplateNotFound if the ConfigMap doesn't exist.
+*/
+func (h *Handler) templateConfigMap(name string) (*corev1.ConfigMap, error) {
+	notFound := fmt.Errorf("%w: %q, ConfigMap %s/%s does not exist", ErrTemplateNotFound, name, h.TemplateNamespace, h.TemplateConfigMap)
+
+	if h.ConfigMapIndexer != nil {
+		obj, exists, err := h.ConfigMapIndexer.GetByKey(h.TemplateNamespace + "/" + h.TemplateConfigMap)
+		if err != nil {
+			return nil, fmt.Errorf("could not look up the template ConfigMap %s/%s. %w", h.TemplateNamespace, h.TemplateConfigMap, err)
+		}
+		cm, ok := obj.(*corev1.ConfigMap)
+		if !exists || !ok {
+			return nil, notFound
+		}
+		return cm, nil
+	}
+
+	cm, err := h.Client.CoreV1().ConfigMaps(h.TemplateNamespace).Get(context.Background(), h.TemplateConfigMap, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return nil, notFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch the template ConfigMap %s/%s. %w", h.TemplateNamespace, h.TemplateConfigMap, err)
+	}
+	return cm, nil
+}
+
+// renderTemplate renders the named template of the template ConfigMap, and parses and validates the result as a NetworkPolicy
+func (h *Handler) renderTemplate(name string, tc TemplateContext) (*networkingv1.NetworkPolicy, error) {
+	if h.TemplateConfigMap == "" {
+		return nil, fmt.Errorf("%w: %q, there is no template ConfigMap", ErrTemplateNotFound, name)
+	}
+
+	cm, err := h.templateConfigMap(name)
+	if err != nil {
+		return nil, err
+	}
+	text, ok := cm.Data[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q is not in ConfigMap %s/%s", ErrTemplateNotFound, name, h.TemplateNamespace, h.TemplateConfigMap)
+	}
+
+	tmpl, err := template.New(name).Funcs(_templateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTemplate, err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, tc); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidTemplate, err)
+	}
+
+	p := &networkingv1.NetworkPolicy{}
+	if err := yaml.UnmarshalStrict(out.Bytes(), p); err != nil {
+		return nil, fmt.Errorf("%w: template %q doesn't render a NetworkPolicy: %v", ErrInvalidTemplate, name, err)
+	}
+	if err := ValidatePolicy(p); err != nil {
+		return nil, fmt.Errorf("template %q: %w", name, err)
+	}
+	return p, nil
+}
+
+// AppliedTemplate returns the name of the template the policy was rendered from, it's empty for the policies without a template
+func AppliedTemplate(p *networkingv1.NetworkPolicy) string {
+	return p.Annotations[TemplateAnnotation]
+}
+
+/*
+ValidatePolicy checks the NetworkPolicy the way the API server would: the selectors have to be valid, a peer is either an ipBlock
+or selectors, the ipBlocks and their exceptions have to be CIDRs within each other, and the ports have to be valid ports of the
+supported protocols.
+*/
+func ValidatePolicy(p *networkingv1.NetworkPolicy) error {
+	if p.Kind != "" && p.Kind != "NetworkPolicy" {
+		return fmt.Errorf("%w: kind %q", ErrInvalidPolicy, p.Kind)
+	}
+	if p.APIVersion != "" && p.APIVersion != networkingv1.SchemeGroupVersion.String() {
+		return fmt.Errorf("%w: apiVersion %q", ErrInvalidPolicy, p.APIVersion)
+	}
+	if _, err := metav1.LabelSelectorAsSelector(&p.Spec.PodSelector); err != nil {
+		return fmt.Errorf("%w: spec.podSelector: %v", ErrInvalidPolicy, err)
+	}
+
+	for i, rule := range p.Spec.Ingress {
+		if err := validatePeers(rule.From, fmt.Sprintf("spec.ingress[%d].from", i)); err != nil {
+			return err
+		}
+		if err := validatePorts(rule.Ports, fmt.Sprintf("spec.ingress[%d].ports", i)); err != nil {
+			return err
+		}
+	}
+	for i, rule := range p.Spec.Egress {
+		if err := validatePeers(rule.To, fmt.Sprintf("spec.egress[%d].to", i)); err != nil {
+			return err
+		}
+		if err := validatePorts(rule.Ports, fmt.Sprintf("spec.egress[%d].ports", i)); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range p.Spec.PolicyTypes {
+		if t != networkingv1.PolicyTypeIngress && t != networkingv1.PolicyTypeEgress {
+			return fmt.Errorf("%w: spec.policyTypes: unknown type %q", ErrInvalidPolicy, t)
+		}
+	}
+	return nil
+}
+
+// validatePeers checks the peers of a rule, path is where the peers are in the policy
+func validatePeers(peers []networkingv1.NetworkPolicyPeer, path string) error {
+	for i, peer := range peers {
+		field := fmt.Sprintf("%s[%d]", path, i)
+		hasSelectors := peer.PodSelector != nil || peer.NamespaceSelector != nil
+
+		switch {
+		case peer.IPBlock != nil && hasSelectors:
+			return fmt.Errorf("%w: %s: an ipBlock can't be combined with selectors", ErrInvalidPolicy, field)
+		case peer.IPBlock == nil && !hasSelectors:
+			return fmt.Errorf("%w: %s: the peer is empty", ErrInvalidPolicy, field)
+		case peer.IPBlock != nil:
+			if err := validateIPBlock(peer.IPBlock); err != nil {
+				return fmt.Errorf("%w: %s.ipBlock: %v", ErrInvalidPolicy, field, err)
+			}
+		}
+
+		for _, selector := range []*metav1.LabelSelector{peer.PodSelector, peer.NamespaceSelector} {
+			if _, err := metav1.LabelSelectorAsSelector(selector); err != nil {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidPolicy, field, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateIPBlock checks that the ipBlock is a CIDR, and its exceptions are CIDRs within it
+func validateIPBlock(block *networkingv1.IPBlock) error {
+	_, network, err := net.ParseCIDR(block.CIDR)
+	if err != nil {
+		return err
+	}
+	ones, _ := network.Mask.Size()
+
+	for _, except := range block.Except {
+		exceptIP, exceptNetwork, err := net.ParseCIDR(except)
+		if err != nil {
+			return err
+		}
+		exceptOnes, _ := exceptNetwork.Mask.Size()
+		if !network.Contains(exceptIP) || exceptOnes <= ones {
+			return fmt.Errorf("%s is not within %s", except, block.CIDR)
+		}
+	}
+	return nil
+}
+
+// validatePorts checks the ports of a rule, path is where the ports are in the policy
+func validatePorts(ports []networkingv1.NetworkPolicyPort, path string) error {
+	for i, port := range ports {
+		field := fmt.Sprintf("%s[%d]", path, i)
+
+		if port.Protocol != nil {
+			switch *port.Protocol {
+			case corev1.ProtocolTCP, corev1.ProtocolUDP, corev1.ProtocolSCTP:
+			default:
+				return fmt.Errorf("%w: %s: unsupported protocol %q", ErrInvalidPolicy, field, *port.Protocol)
+			}
+		}
+
+		if port.Port != nil {
+			var errs []string
+			if port.Port.Type == intstr.Int {
+				errs = validation.IsValidPortNum(int(port.Port.IntVal))
+			} else {
+				errs = validation.IsValidPortName(port.Port.StrVal)
+			}
+			if len(errs) > 0 {
+				return fmt.Errorf("%w: %s: %v", ErrInvalidPolicy, field, errs)
+			}
+		}
+
+		if port.EndPort != nil {
+			if port.Port == nil || port.Port.Type != intstr.Int || *port.EndPort < port.Port.IntVal {
+				return fmt.Errorf("%w: %s: endPort needs a numeric port which is not above it", ErrInvalidPolicy, field)
+			}
+		}
+	}
+	return nil
+}
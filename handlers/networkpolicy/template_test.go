@@ -0,0 +1,242 @@
+package networkpolicy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// _loggingTemplate lets the logging agent in next to the rules of the profile, and keeps the Pods away from the metadata endpoint
+const _loggingTemplate = `
+metadata:
+  labels:
+    team: {{ .Workload.Labels.team }}
+spec:
+  ingress: {{ toJSON .Policy.Spec.Ingress }}
+  egress:
+  - to:
+    - ipBlock:
+        cidr: 0.0.0.0/0
+        except: ["169.254.169.254/32"]
+  - to:
+    - namespaceSelector:
+        matchLabels:
+          kubernetes.io/metadata.name: logging
+      podSelector:
+        matchLabels:
+          app: fluent-bit
+  policyTypes: ["Ingress", "Egress"]
+`
+
+func TestNewPolicyTemplate(t *testing.T) {
+	c := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "netpol-ctrl-templates", Namespace: "kube-system"},
+		Data: map[string]string{
+			"logging":     _loggingTemplate,
+			"broken":      "spec: {{ .Missing }",
+			"missing-key": "spec: {{ .Workload.Labels.missing.key }}",
+			"not-policy":  "spec:\n  unknown: true\n",
+			"bad-cidr":    "spec:\n  egress:\n  - to:\n    - ipBlock:\n        cidr: 10.0.0.0/33\n",
+		},
+	})
+	h := &Handler{Client: c, TemplateNamespace: "kube-system", TemplateConfigMap: "netpol-ctrl-templates"}
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "api"}}
+	owner := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "default", Labels: map[string]string{"team": "payments"}}}
+
+	testCases := []struct {
+		name     string
+		template string
+		testErr  func(t *testing.T, err error)
+	}{
+		{
+			name:     "fails - template not in the ConfigMap",
+			template: "unknown",
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrTemplateNotFound)
+			},
+		},
+		{
+			name:     "fails - template can't be parsed",
+			template: "broken",
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidTemplate)
+			},
+		},
+		{
+			name:     "fails - template can't be rendered",
+			template: "missing-key",
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidTemplate)
+			},
+		},
+		{
+			name:     "fails - template doesn't render a NetworkPolicy",
+			template: "not-policy",
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidTemplate)
+			},
+		},
+		{
+			name:     "fails - rendered policy is invalid",
+			template: "bad-cidr",
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidPolicy)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := h.NewPolicy("deployment-api-netpol", "default", selector, Peers{Template: tc.template, Owner: owner})
+			tc.testErr(t, err)
+		})
+	}
+
+	t.Run("OK - rendered policy", func(t *testing.T) {
+		built, err := h.NewPolicy("deployment-api-netpol", "default", selector, Peers{Profile: "strict", Owner: owner})
+		assert.NoError(t, err)
+
+		p, err := h.NewPolicy("deployment-api-netpol", "default", selector, Peers{Profile: "strict", Template: "logging", Owner: owner})
+		assert.NoError(t, err)
+
+		// the name, namespace and podSelector always come from the built policy
+		assert.Equal(t, "deployment-api-netpol", p.Name)
+		assert.Equal(t, "default", p.Namespace)
+		assert.Equal(t, *selector, p.Spec.PodSelector)
+		assert.Equal(t, "payments", p.Labels["team"])
+		assert.Equal(t, "logging", AppliedTemplate(p))
+		assert.Equal(t, "strict", AppliedProfile(p))
+
+		assert.Equal(t, built.Spec.Ingress, p.Spec.Ingress)
+		assert.Len(t, p.Spec.Egress, 2)
+		assert.Equal(t, []string{"169.254.169.254/32"}, p.Spec.Egress[0].To[0].IPBlock.Except)
+	})
+
+	t.Run("OK - the template ConfigMap is read from the indexer", func(t *testing.T) {
+		indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		assert.NoError(t, indexer.Add(&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: "netpol-ctrl-templates", Namespace: "kube-system"},
+			Data:       map[string]string{"logging": _loggingTemplate},
+		}))
+		cached := &Handler{
+			Client:            fake.NewSimpleClientset(),
+			TemplateNamespace: "kube-system",
+			TemplateConfigMap: "netpol-ctrl-templates",
+			ConfigMapIndexer:  indexer,
+		}
+
+		p, err := cached.NewPolicy("deployment-api-netpol", "default", selector, Peers{Template: "logging", Owner: owner})
+		assert.NoError(t, err)
+		assert.Equal(t, "logging", AppliedTemplate(p))
+
+		// the ConfigMap is never fetched through the API, even if it's missing from the indexer
+		assert.NoError(t, indexer.Delete(&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "netpol-ctrl-templates", Namespace: "kube-system"}}))
+		cached.Client = c
+		_, err = cached.NewPolicy("deployment-api-netpol", "default", selector, Peers{Template: "logging", Owner: owner})
+		assert.ErrorIs(t, err, ErrTemplateNotFound)
+	})
+
+	t.Run("fails - no template ConfigMap", func(t *testing.T) {
+		_, err := (&Handler{Client: c}).NewPolicy("deployment-api-netpol", "default", selector, Peers{Template: "logging"})
+		assert.ErrorIs(t, err, ErrTemplateNotFound)
+	})
+}
+
+func TestValidatePolicy(t *testing.T) {
+	tcp, icmp := corev1.ProtocolTCP, corev1.Protocol("ICMP")
+	http, named, badName := intstr.FromInt(8080), intstr.FromString("http"), intstr.FromString("not_a_port")
+	endPort, lowEndPort := int32(8090), int32(80)
+	podPeer := networkingv1.NetworkPolicyPeer{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}}}
+
+	egress := func(peers []networkingv1.NetworkPolicyPeer, ports []networkingv1.NetworkPolicyPort) *networkingv1.NetworkPolicy {
+		return &networkingv1.NetworkPolicy{Spec: networkingv1.NetworkPolicySpec{
+			Egress: []networkingv1.NetworkPolicyEgressRule{{To: peers, Ports: ports}},
+		}}
+	}
+
+	testCases := []struct {
+		name    string
+		policy  *networkingv1.NetworkPolicy
+		testErr func(t *testing.T, err error)
+	}{
+		{
+			name: "OK - selectors, ipBlocks and ports",
+			policy: egress([]networkingv1.NetworkPolicyPeer{podPeer, {IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8", Except: []string{"10.1.0.0/16"}}}},
+				[]networkingv1.NetworkPolicyPort{{Protocol: &tcp, Port: &http, EndPort: &endPort}, {Port: &named}}),
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:   "fails - wrong kind",
+			policy: &networkingv1.NetworkPolicy{TypeMeta: metav1.TypeMeta{Kind: "Service"}},
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidPolicy)
+			},
+		},
+		{
+			name: "fails - invalid selector",
+			policy: &networkingv1.NetworkPolicy{Spec: networkingv1.NetworkPolicySpec{PodSelector: metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "app", Operator: "Maybe"}},
+			}}},
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidPolicy)
+			},
+		},
+		{
+			name:   "fails - ipBlock with selectors",
+			policy: egress([]networkingv1.NetworkPolicyPeer{{PodSelector: podPeer.PodSelector, IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/8"}}}, nil),
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidPolicy)
+			},
+		},
+		{
+			name:   "fails - empty peer",
+			policy: egress([]networkingv1.NetworkPolicyPeer{{}}, nil),
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidPolicy)
+			},
+		},
+		{
+			name:   "fails - exception outside the CIDR",
+			policy: egress([]networkingv1.NetworkPolicyPeer{{IPBlock: &networkingv1.IPBlock{CIDR: "10.0.0.0/16", Except: []string{"192.168.0.0/24"}}}}, nil),
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidPolicy)
+			},
+		},
+		{
+			name:   "fails - unsupported protocol",
+			policy: egress([]networkingv1.NetworkPolicyPeer{podPeer}, []networkingv1.NetworkPolicyPort{{Protocol: &icmp}}),
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidPolicy)
+			},
+		},
+		{
+			name:   "fails - invalid port name",
+			policy: egress([]networkingv1.NetworkPolicyPeer{podPeer}, []networkingv1.NetworkPolicyPort{{Port: &badName}}),
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidPolicy)
+			},
+		},
+		{
+			name:   "fails - endPort below the port",
+			policy: egress([]networkingv1.NetworkPolicyPeer{podPeer}, []networkingv1.NetworkPolicyPort{{Port: &http, EndPort: &lowEndPort}}),
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidPolicy)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.testErr(t, ValidatePolicy(tc.policy))
+		})
+	}
+}
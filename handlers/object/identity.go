@@ -0,0 +1,114 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var ErrInvalidLabelPattern = errors.New("invalid identity label pattern")
+
+/*
+IdentityLabelPolicy decides which label keys identify the Pods of an object. Only these keys end up in the podSelector of the
+policies and in the peers pointing at the Pods, so that volatile keys like version, pod-template-hash or helm.sh/chart don't cause
+policy churn. A pattern is either a full key, or a prefix ending with "*", e.g "app.kubernetes.io/*". The zero value keeps every key.
+*/
+type IdentityLabelPolicy struct {
+	// Allow lists the keys to keep. If it's empty, every key is kept unless it's denied.
+	Allow []string
+	// Deny lists the keys to drop, even if they are allowed
+	Deny []string
+}
+
+// validatePatterns checks that the "*" of the patterns only ever shows up at their end
+func validatePatterns(patterns []string) error {
+	for _, p := range patterns {
+		if p == "" || strings.Contains(strings.TrimSuffix(p, "*"), "*") {
+			return fmt.Errorf("%w: %q", ErrInvalidLabelPattern, p)
+		}
+	}
+	return nil
+}
+
+// matchesAny reports whether the key matches any of the patterns
+func matchesAny(key string, patterns []string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+			continue
+		}
+		if key == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the patterns of the policy
+func (p IdentityLabelPolicy) Validate() error {
+	if err := validatePatterns(p.Allow); err != nil {
+		return err
+	}
+	return validatePatterns(p.Deny)
+}
+
+// IsIdentityLabel reports whether the label key identifies the Pods. The ManagedLabel always does, since it's there to select the Pods.
+func (p IdentityLabelPolicy) IsIdentityLabel(key string) bool {
+	if key == ManagedLabel {
+		return true
+	}
+	if matchesAny(key, p.Deny) {
+		return false
+	}
+	return len(p.Allow) == 0 || matchesAny(key, p.Allow)
+}
+
+/*
+Labels returns the identity labels of the labels. If none of the keys identify the Pods, the labels are kept as they are, so that
+neither the podSelector of a policy nor a peer ever widens to every Pod.
+*/
+func (p IdentityLabelPolicy) Labels(labels map[string]string) map[string]string {
+	identity := make(map[string]string, len(labels))
+	for k, v := range labels {
+		if p.IsIdentityLabel(k) {
+			identity[k] = v
+		}
+	}
+	if len(identity) == 0 {
+		return labels
+	}
+	return identity
+}
+
+/*
+Selector returns a copy of the selector with only the matchLabels and matchExpressions of the identity label keys. Like Labels, the
+selector is kept as it is if none of its keys identify the Pods.
+*/
+func (p IdentityLabelPolicy) Selector(selector *metav1.LabelSelector) *metav1.LabelSelector {
+	if selector == nil {
+		return nil
+	}
+
+	identity := &metav1.LabelSelector{}
+	for k, v := range selector.MatchLabels {
+		if p.IsIdentityLabel(k) {
+			if identity.MatchLabels == nil {
+				identity.MatchLabels = map[string]string{}
+			}
+			identity.MatchLabels[k] = v
+		}
+	}
+	for _, expr := range selector.MatchExpressions {
+		if p.IsIdentityLabel(expr.Key) {
+			identity.MatchExpressions = append(identity.MatchExpressions, *expr.DeepCopy())
+		}
+	}
+	if len(identity.MatchLabels) == 0 && len(identity.MatchExpressions) == 0 {
+		return selector.DeepCopy()
+	}
+	return identity
+}
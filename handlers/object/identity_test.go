@@ -0,0 +1,171 @@
+package object
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIdentityLabelPolicyValidate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		policy  IdentityLabelPolicy
+		testErr func(t *testing.T, err error)
+	}{
+		{
+			name:   "OK - keys and prefixes",
+			policy: IdentityLabelPolicy{Allow: []string{"app", "app.kubernetes.io/*"}, Deny: []string{"helm.sh/*"}},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:   "fails - wildcard in the middle",
+			policy: IdentityLabelPolicy{Deny: []string{"app.*/version"}},
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidLabelPattern)
+			},
+		},
+		{
+			name:   "fails - empty pattern",
+			policy: IdentityLabelPolicy{Allow: []string{""}},
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidLabelPattern)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.testErr(t, tc.policy.Validate())
+		})
+	}
+}
+
+func TestIsIdentityLabel(t *testing.T) {
+	testCases := []struct {
+		name     string
+		policy   IdentityLabelPolicy
+		key      string
+		expected bool
+	}{
+		{
+			name:     "every key is kept without a policy",
+			key:      "version",
+			expected: true,
+		},
+		{
+			name:     "denied key",
+			policy:   IdentityLabelPolicy{Deny: []string{"version"}},
+			key:      "version",
+			expected: false,
+		},
+		{
+			name:     "denied prefix",
+			policy:   IdentityLabelPolicy{Deny: []string{"helm.sh/*"}},
+			key:      "helm.sh/chart",
+			expected: false,
+		},
+		{
+			name:     "allowed prefix",
+			policy:   IdentityLabelPolicy{Allow: []string{"app.kubernetes.io/*"}},
+			key:      "app.kubernetes.io/name",
+			expected: true,
+		},
+		{
+			name:     "not allowed",
+			policy:   IdentityLabelPolicy{Allow: []string{"app.kubernetes.io/*"}},
+			key:      "team",
+			expected: false,
+		},
+		{
+			name:     "deny wins over allow",
+			policy:   IdentityLabelPolicy{Allow: []string{"app.kubernetes.io/*"}, Deny: []string{"app.kubernetes.io/version"}},
+			key:      "app.kubernetes.io/version",
+			expected: false,
+		},
+		{
+			name:     "the managed label is always kept",
+			policy:   IdentityLabelPolicy{Allow: []string{"app"}, Deny: []string{"*"}},
+			key:      ManagedLabel,
+			expected: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, tc.policy.IsIdentityLabel(tc.key))
+		})
+	}
+}
+
+func TestIdentityLabelPolicySelector(t *testing.T) {
+	policy := IdentityLabelPolicy{Deny: []string{"version", "helm.sh/*"}}
+
+	testCases := []struct {
+		name     string
+		obj      interface{}
+		expected *metav1.LabelSelector
+	}{
+		{
+			name: "Pod without its volatile labels",
+			obj: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+				Labels: map[string]string{"app": "web", "version": "1.2.0", "helm.sh/chart": "web-0.1.0"},
+			}},
+			expected: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		},
+		{
+			name:     "Pod with only volatile labels keeps them",
+			obj:      &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"version": "1.2.0"}}},
+			expected: &metav1.LabelSelector{MatchLabels: map[string]string{"version": "1.2.0"}},
+		},
+		{
+			name: "Deployment selector without the volatile keys",
+			obj: &appsv1.Deployment{Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{
+					MatchLabels: map[string]string{"app": "web", "version": "1.2.0"},
+					MatchExpressions: []metav1.LabelSelectorRequirement{
+						{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"frontend"}},
+						{Key: "helm.sh/chart", Operator: metav1.LabelSelectorOpExists},
+					},
+				},
+			}},
+			expected: &metav1.LabelSelector{
+				MatchLabels:      map[string]string{"app": "web"},
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"frontend"}}},
+			},
+		},
+		{
+			name: "Deployment with only volatile keys keeps them",
+			obj: &appsv1.Deployment{Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"version": "1.2.0"}},
+				Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{"version": "1.2.0", ManagedLabel: "web-default"},
+				}},
+			}},
+			expected: &metav1.LabelSelector{MatchLabels: map[string]string{"version": "1.2.0"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			selector, _, err := ConvertToMeta(tc.obj)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, policy.Selector(selector))
+		})
+	}
+}
+
+func TestIdentityLabelPolicyLabels(t *testing.T) {
+	policy := IdentityLabelPolicy{Deny: []string{"version", "helm.sh/*"}}
+
+	// the volatile keys are dropped
+	assert.Equal(t, map[string]string{"app": "web"}, policy.Labels(map[string]string{"app": "web", "version": "1.2.0"}))
+	// unless they are the only keys, the same way as in the selectors
+	assert.Equal(t, map[string]string{"version": "1.2.0"}, policy.Labels(map[string]string{"version": "1.2.0"}))
+	assert.Equal(t, &metav1.LabelSelector{MatchLabels: map[string]string{"version": "1.2.0"}},
+		policy.Selector(&metav1.LabelSelector{MatchLabels: map[string]string{"version": "1.2.0"}}))
+}
@@ -0,0 +1,117 @@
+package object
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// ManagedLabel is added to the Pods of the objects which have no labels to select their Pods by
+	ManagedLabel = "netpol-ctrl"
+	// OptOutAnnotation keeps the controller away from the object, e.g "true". The policy and the ManagedLabel of the object are removed.
+	OptOutAnnotation = "netpol-ctrl.io/opt-out"
+)
+
+// ManagedLabelValue returns the value of the ManagedLabel for the object, "<obj_name>-<obj_namespace>"
+func ManagedLabelValue(obj metav1.Object) string {
+	return fmt.Sprintf("%s-%s", obj.GetName(), obj.GetNamespace())
+}
+
+// OptedOut reports whether the object has opted out of getting a policy
+func OptedOut(obj metav1.Object) bool {
+	return obj.GetAnnotations()[OptOutAnnotation] == "true"
+}
+
+/*
+podLabelsPath returns the path of the labels that end up on the Pods of the object: the labels of standalone Pods, and the labels of
+the Pod template of the workloads, custom ones included. The Pod template of a Job can't be changed, so only CronJobs are labeled,
+through their job template.
+*/
+func podLabelsPath(obj metav1.Object) ([]string, map[string]string, error) {
+	switch obj := obj.(type) {
+	case *corev1.Pod:
+		return []string{"metadata", "labels"}, obj.Labels, nil
+	case *appsv1.Deployment:
+		return []string{"spec", "template", "metadata", "labels"}, obj.Spec.Template.Labels, nil
+	case *appsv1.StatefulSet:
+		return []string{"spec", "template", "metadata", "labels"}, obj.Spec.Template.Labels, nil
+	case *appsv1.DaemonSet:
+		return []string{"spec", "template", "metadata", "labels"}, obj.Spec.Template.Labels, nil
+	case *batchv1.CronJob:
+		return []string{"spec", "jobTemplate", "spec", "template", "metadata", "labels"}, obj.Spec.JobTemplate.Spec.Template.Labels, nil
+	case *unstructured.Unstructured:
+		return podTemplateLabelsPath(obj)
+	}
+	return nil, nil, ErrTypeNotSupported
+}
+
+// HasManagedLabel reports whether the Pods of the object have been labeled by the controller
+func HasManagedLabel(obj metav1.Object) bool {
+	_, podLabels, err := podLabelsPath(obj)
+	if err != nil {
+		return false
+	}
+	_, ok := podLabels[ManagedLabel]
+	return ok
+}
+
+// labelPatch returns a JSON merge patch that sets the ManagedLabel at the path to value. A nil value removes the label.
+func labelPatch(path []string, value interface{}) ([]byte, error) {
+	var patch interface{} = map[string]interface{}{ManagedLabel: value}
+	for i := len(path) - 1; i >= 0; i-- {
+		patch = map[string]interface{}{path[i]: patch}
+	}
+	return json.Marshal(patch)
+}
+
+// patchLabel sends the ManagedLabel patch of the object. Patching leaves the other labels, and the rest of the object alone.
+func (h *Handler) patchLabel(value interface{}) error {
+	path, _, err := podLabelsPath(h.Obj)
+	if err != nil {
+		return err
+	}
+	gvr, err := h.getGVR()
+	if err != nil {
+		return fmt.Errorf("error during resource gvr retrieval. %v", err)
+	}
+
+	patch, err := labelPatch(path, value)
+	if err != nil {
+		return err
+	}
+	_, err = h.Client.Resource(gvr).Namespace(h.Obj.GetNamespace()).Patch(context.Background(), h.Obj.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+/*
+AddLabel adds the "netpol-ctrl":"<obj_name>-<obj_namespace>" label to the Pods of the object, next to their existing labels. Standalone
+Pods are labeled directly, and workloads through their Pod template, which rolls their Pods out the way the workload's strategy says.
+*/
+func (h *Handler) AddLabel() error {
+	if err := h.patchLabel(ManagedLabelValue(h.Obj)); err != nil {
+		return fmt.Errorf("could not apply label to %s: %w", h.Obj.GetName(), err)
+	}
+	log.Printf("'%s' labeled! \n", h.Obj.GetName())
+	return nil
+}
+
+// RemoveLabel removes the label added by AddLabel from the Pods of the object, if it has one
+func (h *Handler) RemoveLabel() error {
+	if !HasManagedLabel(h.Obj) {
+		return nil
+	}
+	if err := h.patchLabel(nil); err != nil {
+		return fmt.Errorf("could not remove label from %s: %w", h.Obj.GetName(), err)
+	}
+	log.Printf("'%s' unlabeled! \n", h.Obj.GetName())
+	return nil
+}
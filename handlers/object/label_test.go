@@ -0,0 +1,129 @@
+package object
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestManagedLabel(t *testing.T) {
+	template := corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}}}
+	testCases := []struct {
+		name    string
+		obj     metav1.Object
+		path    []string
+		testErr func(t *testing.T, err error)
+	}{
+		{
+			name: "OK - standalone Pod keeps its labels",
+			obj: &corev1.Pod{
+				TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Labels: map[string]string{"app": "web"}},
+			},
+			path: []string{"metadata", "labels"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "OK - Deployment is labeled through its Pod template",
+			obj: &appsv1.Deployment{
+				TypeMeta:   metav1.TypeMeta{Kind: "Deployment", APIVersion: "apps/v1"},
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Labels: map[string]string{"team": "core"}},
+				Spec:       appsv1.DeploymentSpec{Template: template},
+			},
+			path: []string{"spec", "template", "metadata", "labels"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "OK - CronJob is labeled through its job template",
+			obj: &batchv1.CronJob{
+				TypeMeta:   metav1.TypeMeta{Kind: "CronJob", APIVersion: "batch/v1"},
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+				Spec: batchv1.CronJobSpec{
+					JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: template}},
+				},
+			},
+			path: []string{"spec", "jobTemplate", "spec", "template", "metadata", "labels"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "returns ErrTypeNotSupported - the Pod template of a Job can't change",
+			obj: &batchv1.Job{
+				TypeMeta:   metav1.TypeMeta{Kind: "Job", APIVersion: "batch/v1"},
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+				Spec:       batchv1.JobSpec{Template: template},
+			},
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrTypeNotSupported)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(tc.obj)
+			if err != nil {
+				t.Fatalf("error during unstructured conversion in test. %v", err)
+			}
+			h := NewHandler(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), &unstructured.Unstructured{Object: content}), tc.obj)
+			gvr, err := h.getGVR()
+			if err != nil {
+				t.Fatalf("could not get gvr. %v", err)
+			}
+
+			err = h.AddLabel()
+			tc.testErr(t, err)
+			if err != nil {
+				return
+			}
+
+			labeled, err := h.Client.Resource(gvr).Namespace("default").Get(context.Background(), "web", metav1.GetOptions{})
+			assert.NoError(t, err)
+			podLabels, _, _ := unstructured.NestedStringMap(labeled.Object, tc.path...)
+			assert.Equal(t, "web-default", podLabels[ManagedLabel])
+			// the existing labels are kept, and the metadata of workloads is left alone
+			assert.Equal(t, "web", podLabels["app"])
+			if len(tc.path) > 2 {
+				assert.Equal(t, tc.obj.GetLabels(), labeled.GetLabels())
+			}
+
+			// the labeled object comes back with the next event
+			if err := runtime.DefaultUnstructuredConverter.FromUnstructured(labeled.Object, tc.obj); err != nil {
+				t.Fatalf("error during conversion in test. %v", err)
+			}
+			assert.True(t, HasManagedLabel(tc.obj))
+
+			assert.NoError(t, h.RemoveLabel())
+			unlabeled, err := h.Client.Resource(gvr).Namespace("default").Get(context.Background(), "web", metav1.GetOptions{})
+			assert.NoError(t, err)
+			podLabels, _, _ = unstructured.NestedStringMap(unlabeled.Object, tc.path...)
+			assert.Equal(t, map[string]string{"app": "web"}, podLabels)
+		})
+	}
+}
+
+func TestConvertToMetaManagedLabel(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		Spec: appsv1.DeploymentSpec{
+			Selector: &metav1.LabelSelector{},
+			Template: corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{ManagedLabel: "web-default", "app": "web"}}},
+		},
+	}
+
+	selector, _, err := ConvertToMeta(deployment)
+	assert.NoError(t, err)
+	assert.Equal(t, &metav1.LabelSelector{MatchLabels: map[string]string{ManagedLabel: "web-default"}}, selector)
+}
@@ -4,9 +4,10 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"log"
+	"reflect"
 
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -27,6 +28,19 @@ const (
 var (
 	ErrTypeNotSupported = errors.New("this type is not supported")
 	ErrNotFound         = errors.New("this resource does not exist")
+
+	// _kindGVRs are the resources of the built-in kinds of the objects of interest
+	_kindGVRs = map[string]schema.GroupVersionResource{
+		"Pod":         corev1.SchemeGroupVersion.WithResource("pods"),
+		"Deployment":  appsv1.SchemeGroupVersion.WithResource("deployments"),
+		"StatefulSet": appsv1.SchemeGroupVersion.WithResource("statefulsets"),
+		"DaemonSet":   appsv1.SchemeGroupVersion.WithResource("daemonsets"),
+		"Job":         batchv1.SchemeGroupVersion.WithResource("jobs"),
+		"CronJob":     batchv1.SchemeGroupVersion.WithResource("cronjobs"),
+	}
+
+	// _jobControllerLabels are set by the Job controller on the Pod template of every Job, and are different for each run
+	_jobControllerLabels = []string{"controller-uid", "batch.kubernetes.io/controller-uid"}
 )
 
 type Handler struct {
@@ -38,44 +52,137 @@ func NewHandler(c dynamic.Interface, obj metav1.Object) *Handler {
 	return &Handler{Client: c, Obj: obj}
 }
 
+// jobLabels returns the labels of a Job's Pod template without the ones that change with every run of the Job
+func jobLabels(templateLabels map[string]string) map[string]string {
+	labels := make(map[string]string, len(templateLabels))
+	for k, v := range templateLabels {
+		labels[k] = v
+	}
+	for _, k := range _jobControllerLabels {
+		delete(labels, k)
+	}
+	return labels
+}
+
+// labelSelector returns a selector matching the labels
+func labelSelector(labels map[string]string) *metav1.LabelSelector {
+	return &metav1.LabelSelector{MatchLabels: labels}
+}
+
 /*
-ConvertToMeta checks whether the object is of type Pod, Deployment, StatefulSet or DaemonSet, and converts it to metav1.Object,
-and returns its labels
+workloadLabelSelector returns a copy of the selector of a workload. If the selector is empty, the Pods are selected by the ManagedLabel
+of the Pod template, if the controller has labeled it.
 */
-func ConvertToMeta(obj interface{}) (map[string]string, metav1.Object, error) {
+func workloadLabelSelector(selector *metav1.LabelSelector, templateLabels map[string]string) *metav1.LabelSelector {
+	if selector == nil || (len(selector.MatchLabels) == 0 && len(selector.MatchExpressions) == 0) {
+		if v, ok := templateLabels[ManagedLabel]; ok {
+			return labelSelector(map[string]string{ManagedLabel: v})
+		}
+		return &metav1.LabelSelector{}
+	}
+	return selector.DeepCopy()
+}
+
+/*
+ConvertToMeta checks whether the object is of type Pod, Deployment, StatefulSet, DaemonSet, Job, CronJob or a custom workload, and converts it to
+metav1.Object, and returns the selector of its Pods. Both the matchLabels and the matchExpressions of the workloads are kept. Pods are
+selected by their labels. Jobs and CronJobs are selected by the labels of their Pod template, since the selector of a
+Job is generated for every run. Jobs created by a CronJob are skipped, so that the CronJob has one policy across its runs. Owned Pods
+are skipped too, unless they are grouped into an OwnedPod, which is selected by the labels shared by the Pods of its owner. Unstructured
+objects are supported if they are registered custom workloads, and their whole LabelSelector is read from the registered path. The selectors
+have every label key, IdentityLabelPolicy.Selector picks the identity keys out of them.
+*/
+func ConvertToMeta(obj interface{}) (*metav1.LabelSelector, metav1.Object, error) {
 	if obj == nil {
 		return nil, nil, errors.New("object cannot be nil")
 	}
 
 	switch obj := obj.(type) {
 	case *corev1.Pod:
-		for _, or := range obj.ObjectMeta.OwnerReferences {
-			if or.Kind == "ReplicaSet" || or.Kind == "Deployment" || or.Kind == "StatefulSet" || or.Kind == "DaemonSet" {
-				return nil, nil, fmt.Errorf("POD %s is part of a %s so skipping", obj.GetName(), or.Kind)
-			}
+		// owned Pods either belong to a managed workload, or are grouped under their top owner by an OwnerResolver
+		if or := controllerOf(obj); or != nil {
+			return nil, nil, fmt.Errorf("POD %s is part of a %s so skipping", obj.GetName(), or.Kind)
 		}
-		return obj.Labels, obj, nil
+		return labelSelector(obj.Labels), obj, nil
+	case *OwnedPod:
+		return labelSelector(ownedPodLabels(obj.Labels)), obj, nil
 	case *appsv1.Deployment:
-		return obj.Spec.Selector.MatchLabels, obj, nil
+		return workloadLabelSelector(obj.Spec.Selector, obj.Spec.Template.Labels), obj, nil
 	case *appsv1.StatefulSet:
-		return obj.Spec.Selector.MatchLabels, obj, nil
+		return workloadLabelSelector(obj.Spec.Selector, obj.Spec.Template.Labels), obj, nil
 	case *appsv1.DaemonSet:
-		return obj.Spec.Selector.MatchLabels, obj, nil
+		return workloadLabelSelector(obj.Spec.Selector, obj.Spec.Template.Labels), obj, nil
+	case *batchv1.Job:
+		for _, or := range obj.ObjectMeta.OwnerReferences {
+			if or.Kind == "CronJob" {
+				return nil, nil, fmt.Errorf("JOB %s is part of a %s so skipping", obj.GetName(), or.Kind)
+			}
+		}
+		return labelSelector(jobLabels(obj.Spec.Template.Labels)), obj, nil
+	case *batchv1.CronJob:
+		return labelSelector(jobLabels(obj.Spec.JobTemplate.Spec.Template.Labels)), obj, nil
+	case *unstructured.Unstructured:
+		selector, err := workloadSelector(obj)
+		if err != nil {
+			return nil, nil, err
+		}
+		var templateLabels map[string]string
+		if template, err := PodTemplate(obj); err == nil {
+			templateLabels = template.Labels
+		}
+		return workloadLabelSelector(selector, templateLabels), obj, nil
 	}
 	return nil, nil, ErrTypeNotSupported
 }
 
-// AddLabel applies the "netpol-ctrl":"<obj_name>-<obj_namespace>" label to a metav1.Object if it does not yet have a label
-func (h *Handler) AddLabel() error {
-	label := map[string]string{"netpol-ctrl": fmt.Sprintf("%s-%s", h.Obj.GetName(), h.Obj.GetNamespace())}
+// Kind returns the kind of the object, e.g Deployment. OwnedPods are of the kind of their top-level owner.
+func Kind(obj metav1.Object) string {
+	switch obj := obj.(type) {
+	case *OwnedPod:
+		return obj.Owner.Kind
+	case *unstructured.Unstructured:
+		return obj.GetKind()
+	}
 
-	h.Obj.SetLabels(label)
-	err := h.Mutate(Update)
-	if err != nil {
-		return fmt.Errorf("could not apply label to pod %s: %w", h.Obj.GetName(), err)
+	// the objects coming from the informers don't have their TypeMeta set
+	t := reflect.TypeOf(obj)
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
 	}
-	log.Printf("pod '%s' labeled! \n", h.Obj.GetName())
-	return nil
+	return t.Name()
+}
+
+/*
+GroupKind returns the group and kind of the object, e.g Deployment.apps, so that the custom kinds with the same name in different
+groups are told apart. OwnedPods are of the group and kind of their top-level owner.
+*/
+func GroupKind(obj metav1.Object) schema.GroupKind {
+	switch obj := obj.(type) {
+	case *OwnedPod:
+		gv, _ := schema.ParseGroupVersion(obj.Owner.APIVersion)
+		return schema.GroupKind{Group: gv.Group, Kind: obj.Owner.Kind}
+	case *unstructured.Unstructured:
+		return obj.GroupVersionKind().GroupKind()
+	}
+
+	kind := Kind(obj)
+	return schema.GroupKind{Group: _kindGVRs[kind].Group, Kind: kind}
+}
+
+// GVRForKind returns the resource of the objects of interest of the kind, which is either a built-in kind or a registered custom workload
+func GVRForKind(kind string) (schema.GroupVersionResource, bool) {
+	if gvr, ok := _kindGVRs[kind]; ok {
+		return gvr, true
+	}
+
+	_workloadsMu.RLock()
+	defer _workloadsMu.RUnlock()
+	for gk, w := range _workloads {
+		if gk.Kind == kind {
+			return w.GVR, true
+		}
+	}
+	return schema.GroupVersionResource{}, false
 }
 
 /*
@@ -83,7 +190,7 @@ getResourceGVR takes in the MetaObject and returns the GVR of it, so that the dy
 on what object to call the Update() or Create() functions on
 */
 func (h *Handler) getGVR() (schema.GroupVersionResource, error) {
-	switch h.Obj.(type) {
+	switch obj := h.Obj.(type) {
 	case *corev1.Pod:
 		return corev1.SchemeGroupVersion.WithResource("pods"), nil
 	case *appsv1.Deployment:
@@ -92,8 +199,18 @@ func (h *Handler) getGVR() (schema.GroupVersionResource, error) {
 		return appsv1.SchemeGroupVersion.WithResource("statefulsets"), nil
 	case *appsv1.DaemonSet:
 		return appsv1.SchemeGroupVersion.WithResource("daemonsets"), nil
+	case *batchv1.Job:
+		return batchv1.SchemeGroupVersion.WithResource("jobs"), nil
+	case *batchv1.CronJob:
+		return batchv1.SchemeGroupVersion.WithResource("cronjobs"), nil
 	case *networkingv1.NetworkPolicy:
 		return networkingv1.SchemeGroupVersion.WithResource("networkpolicies"), nil
+	case *unstructured.Unstructured:
+		w, err := workloadFor(obj)
+		if err != nil {
+			return schema.GroupVersionResource{}, fmt.Errorf("unsupported object kind: %s", obj.GetKind())
+		}
+		return w.GVR, nil
 	default:
 		return schema.GroupVersionResource{}, fmt.Errorf("unsupported object type: %T", h.Obj)
 	}
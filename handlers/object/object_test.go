@@ -7,6 +7,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	networkingv1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -144,8 +145,121 @@ func TestConvertToMetaObj(t *testing.T) {
 	}
 }
 
+func TestConvertToMetaSelector(t *testing.T) {
+	expressions := []metav1.LabelSelectorRequirement{
+		{Key: "tier", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"cache"}},
+		{Key: "app", Operator: metav1.LabelSelectorOpExists},
+	}
+
+	testCases := []struct {
+		name     string
+		input    interface{}
+		expected *metav1.LabelSelector
+	}{
+		{
+			name: "Deployment selected by matchExpressions only",
+			input: &appsv1.Deployment{Spec: appsv1.DeploymentSpec{
+				Selector: &metav1.LabelSelector{MatchExpressions: expressions},
+			}},
+			expected: &metav1.LabelSelector{MatchExpressions: expressions},
+		},
+		{
+			name: "StatefulSet keeps both matchLabels and matchExpressions",
+			input: &appsv1.StatefulSet{Spec: appsv1.StatefulSetSpec{
+				Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}, MatchExpressions: expressions},
+			}},
+			expected: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "db"}, MatchExpressions: expressions},
+		},
+		{
+			name:     "DaemonSet without a selector",
+			input:    &appsv1.DaemonSet{},
+			expected: &metav1.LabelSelector{},
+		},
+		{
+			name:     "Pod is selected by its labels",
+			input:    &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}}},
+			expected: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			selector, _, err := ConvertToMeta(tc.input)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, selector)
+		})
+	}
+}
+
+func TestConvertToMetaJobs(t *testing.T) {
+	jobTemplate := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{"app": "report", "controller-uid": "1234", "batch.kubernetes.io/controller-uid": "1234"},
+		},
+	}
+
+	testCases := []struct {
+		name           string
+		input          interface{}
+		expectedLabels map[string]string
+		testErr        func(t *testing.T, err error)
+	}{
+		{
+			name:           "Job labels come from the Pod template without the per run ones",
+			input:          &batchv1.Job{Spec: batchv1.JobSpec{Template: jobTemplate}},
+			expectedLabels: map[string]string{"app": "report"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "CronJob labels come from the job template",
+			input: &batchv1.CronJob{Spec: batchv1.CronJobSpec{
+				JobTemplate: batchv1.JobTemplateSpec{Spec: batchv1.JobSpec{Template: jobTemplate}},
+			}},
+			expectedLabels: map[string]string{"app": "report"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "Job owned by CronJob",
+			input: &batchv1.Job{
+				ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{Kind: "CronJob"}}},
+				Spec:       batchv1.JobSpec{Template: jobTemplate},
+			},
+			testErr: func(t *testing.T, err error) {
+				assert.Error(t, err)
+			},
+		},
+		{
+			name:  "Pod owned by Job",
+			input: &corev1.Pod{ObjectMeta: metav1.ObjectMeta{OwnerReferences: []metav1.OwnerReference{{Kind: "Job"}}}},
+			testErr: func(t *testing.T, err error) {
+				assert.Error(t, err)
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			selector, _, err := ConvertToMeta(tc.input)
+			tc.testErr(t, err)
+			if tc.expectedLabels == nil {
+				assert.Nil(t, selector)
+				return
+			}
+			assert.Equal(t, &metav1.LabelSelector{MatchLabels: tc.expectedLabels}, selector)
+		})
+	}
+	// the template labels of the object itself are left alone
+	assert.Equal(t, "1234", jobTemplate.Labels["controller-uid"])
+}
+
 func TestAddLabel(t *testing.T) {
 	obj := &corev1.Pod{
+		// the fake client needs the kind of the stored object to patch it
+		TypeMeta: metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
 		ObjectMeta: metav1.ObjectMeta{
 			Name:      "test-pod",
 			Namespace: "default",
@@ -175,6 +289,37 @@ func TestAddLabel(t *testing.T) {
 	}
 }
 
+func TestKind(t *testing.T) {
+	assert.Equal(t, "Deployment", Kind(&appsv1.Deployment{}))
+	assert.Equal(t, "Pod", Kind(&corev1.Pod{}))
+	assert.Equal(t, "ReplicationController", Kind(&OwnedPod{Pod: &corev1.Pod{}, Owner: metav1.OwnerReference{Kind: "ReplicationController", Name: "legacy"}}))
+
+	rollout := &unstructured.Unstructured{}
+	rollout.SetKind("Rollout")
+	assert.Equal(t, "Rollout", Kind(rollout))
+}
+
+func TestGroupKind(t *testing.T) {
+	assert.Equal(t, schema.GroupKind{Group: "apps", Kind: "Deployment"}, GroupKind(&appsv1.Deployment{}))
+	assert.Equal(t, schema.GroupKind{Kind: "Pod"}, GroupKind(&corev1.Pod{}))
+	assert.Equal(t, schema.GroupKind{Group: "argoproj.io", Kind: "Rollout"},
+		GroupKind(&OwnedPod{Pod: &corev1.Pod{}, Owner: metav1.OwnerReference{APIVersion: "argoproj.io/v1alpha1", Kind: "Rollout", Name: "web"}}))
+
+	rollout := &unstructured.Unstructured{}
+	rollout.SetAPIVersion("argoproj.io/v1alpha1")
+	rollout.SetKind("Rollout")
+	assert.Equal(t, schema.GroupKind{Group: "argoproj.io", Kind: "Rollout"}, GroupKind(rollout))
+}
+
+func TestGVRForKind(t *testing.T) {
+	gvr, ok := GVRForKind("Deployment")
+	assert.True(t, ok)
+	assert.Equal(t, appsv1.SchemeGroupVersion.WithResource("deployments"), gvr)
+
+	_, ok = GVRForKind("ReplicationController")
+	assert.False(t, ok)
+}
+
 func TestGetResourceGVR(t *testing.T) {
 	handlerPod := &Handler{Obj: &corev1.Pod{}}
 	handlerDeployment := &Handler{Obj: &appsv1.Deployment{}}
@@ -182,6 +327,8 @@ func TestGetResourceGVR(t *testing.T) {
 	handlerStatefulSet := &Handler{Obj: &appsv1.StatefulSet{}}
 	handlerDaemonSet := &Handler{Obj: &appsv1.DaemonSet{}}
 	handlerNetworkPolicy := &Handler{Obj: &networkingv1.NetworkPolicy{}}
+	handlerJob := &Handler{Obj: &batchv1.Job{}}
+	handlerCronJob := &Handler{Obj: &batchv1.CronJob{}}
 
 	testCases := []struct {
 		name    string
@@ -221,6 +368,22 @@ func TestGetResourceGVR(t *testing.T) {
 				assert.NoError(t, err)
 			},
 		},
+		{
+			name:    "OK - Job",
+			handler: handlerJob,
+			want:    batchv1.SchemeGroupVersion.WithResource("jobs"),
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:    "OK - CronJob",
+			handler: handlerCronJob,
+			want:    batchv1.SchemeGroupVersion.WithResource("cronjobs"),
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
 		{
 			name:    "OK - NetworkPolicy",
 			handler: handlerNetworkPolicy,
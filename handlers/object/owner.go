@@ -0,0 +1,220 @@
+package object
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// the longest owner chain that is followed, e.g Pod -> ReplicaSet -> Deployment is 2 long
+	maxOwnerDepth = 10
+	// the most owners whose top-level owner is cached, the cache starts over once it's full
+	maxCachedOwners = 10000
+)
+
+var (
+	ErrManagedOwner  = errors.New("the object belongs to a workload that has its own policy")
+	ErrOwnerNotFound = errors.New("the owner of the object does not exist")
+
+	// _managedKinds are the workloads which get their own policies, so the Pods they own are skipped
+	_managedKinds = map[schema.GroupKind]bool{
+		{Group: "apps", Kind: "Deployment"}:  true,
+		{Group: "apps", Kind: "StatefulSet"}: true,
+		{Group: "apps", Kind: "DaemonSet"}:   true,
+		{Group: "batch", Kind: "Job"}:        true,
+		{Group: "batch", Kind: "CronJob"}:    true,
+	}
+
+	// _perPodLabels are set by controllers on the Pods of a workload, and differ between the Pods or revisions of the same owner
+	_perPodLabels = []string{
+		"pod-template-hash",
+		"controller-revision-hash",
+		"statefulset.kubernetes.io/pod-name",
+		"apps.kubernetes.io/pod-index",
+		"rollouts-pod-template-hash",
+	}
+)
+
+// OwnedPod is a Pod standing in for every Pod of its top-level owner, so that they share one policy named after the owner
+type OwnedPod struct {
+	*corev1.Pod
+	// Owner is the top-level controller of the Pod
+	Owner metav1.OwnerReference
+}
+
+// GetName returns the name of the Pod's top-level owner
+func (p *OwnedPod) GetName() string {
+	return p.Owner.Name
+}
+
+// SharedLabels returns the labels of the Pod which are shared by every Pod of its owner
+func (p *OwnedPod) SharedLabels() map[string]string {
+	return ownedPodLabels(p.Labels)
+}
+
+// ownedPodLabels returns the labels of the Pod which are shared by every Pod of its owner
+func ownedPodLabels(podLabels map[string]string) map[string]string {
+	labels := make(map[string]string, len(podLabels))
+	for k, v := range podLabels {
+		labels[k] = v
+	}
+	for _, k := range _perPodLabels {
+		delete(labels, k)
+	}
+	return labels
+}
+
+// controllerOf returns the controller owner reference of the object, or its first owner reference if none is marked as controller
+func controllerOf(obj metav1.Object) *metav1.OwnerReference {
+	if ref := metav1.GetControllerOf(obj); ref != nil {
+		return ref
+	}
+	if refs := obj.GetOwnerReferences(); len(refs) > 0 {
+		return &refs[0]
+	}
+	return nil
+}
+
+// IsManagedKind reports whether the owner is a workload that gets its own policy
+func IsManagedKind(ref metav1.OwnerReference) bool {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return false
+	}
+	gk := schema.GroupKind{Group: gv.Group, Kind: ref.Kind}
+	return _managedKinds[gk] || isRegisteredKind(gk)
+}
+
+// OwnerResolver follows the controller owner references of objects up to their top-level owner
+type OwnerResolver struct {
+	Client dynamic.Interface
+	Mapper meta.RESTMapper
+
+	mu sync.Mutex
+	// tops caches the top-level owner of the owners seen so far, since owner references don't change. The owners of deleted Pods are
+	// dropped, so that e.g the old ReplicaSets of a Rollout don't pile up.
+	tops map[types.UID]metav1.OwnerReference
+}
+
+func NewOwnerResolver(c dynamic.Interface, mapper meta.RESTMapper) *OwnerResolver {
+	return &OwnerResolver{Client: c, Mapper: mapper, tops: make(map[types.UID]metav1.OwnerReference)}
+}
+
+func (r *OwnerResolver) cached(uid types.UID) (metav1.OwnerReference, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	top, ok := r.tops[uid]
+	return top, ok
+}
+
+func (r *OwnerResolver) cache(uids []types.UID, top metav1.OwnerReference) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.tops == nil || len(r.tops)+len(uids) > maxCachedOwners {
+		r.tops = make(map[types.UID]metav1.OwnerReference)
+	}
+	for _, uid := range uids {
+		r.tops[uid] = top
+	}
+}
+
+// Forget drops the cached top-level owner of the Pod's owner, once the Pod is deleted. Its remaining Pods look it up again.
+func (r *OwnerResolver) Forget(pod *corev1.Pod) {
+	ref := controllerOf(pod)
+	if ref == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.tops, ref.UID)
+}
+
+// getOwner fetches the object an owner reference points at
+func (r *OwnerResolver) getOwner(namespace string, ref metav1.OwnerReference) (metav1.Object, error) {
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return nil, fmt.Errorf("invalid owner apiVersion %q. %w", ref.APIVersion, err)
+	}
+	mapping, err := r.Mapper.RESTMapping(schema.GroupKind{Group: gv.Group, Kind: ref.Kind}, gv.Version)
+	if err != nil {
+		return nil, fmt.Errorf("could not map owner kind %s. %w", ref.Kind, err)
+	}
+
+	owner, err := r.Client.Resource(mapping.Resource).Namespace(namespace).Get(context.Background(), ref.Name, metav1.GetOptions{})
+	if err != nil {
+		if k8serrors.IsNotFound(err) {
+			return nil, fmt.Errorf("%w: %s %s", ErrOwnerNotFound, ref.Kind, ref.Name)
+		}
+		return nil, fmt.Errorf("could not fetch owner %s %s. %w", ref.Kind, ref.Name, err)
+	}
+	return owner, nil
+}
+
+/*
+TopOwner follows the controller owner references of the object, and returns the reference to the last one, e.g the Deployment of
+a Pod owned by a ReplicaSet. It stops at the first managed workload, since that has its own policy even if something else owns
+it, and at the first owner the controller is forbidden to read, e.g a custom resource. It returns nil if the object has no controller. Owners that can't be found fail the resolution, so
+that Pods being garbage collected together with their owners are not mistaken for Pods of another owner.
+*/
+func (r *OwnerResolver) TopOwner(obj metav1.Object) (*metav1.OwnerReference, error) {
+	ref := controllerOf(obj)
+	if ref == nil {
+		return nil, nil
+	}
+
+	var seen []types.UID
+	current := *ref
+	for i := 0; i < maxOwnerDepth && !IsManagedKind(current); i++ {
+		if top, ok := r.cached(current.UID); ok {
+			r.cache(seen, top)
+			return &top, nil
+		}
+		seen = append(seen, current.UID)
+
+		owner, err := r.getOwner(obj.GetNamespace(), current)
+		// the controller can only read the owner kinds it's granted (see deploy.yaml), the reference names the owner anyway
+		if k8serrors.IsForbidden(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		next := controllerOf(owner)
+		if next == nil {
+			break
+		}
+		current = *next
+	}
+
+	r.cache(seen, current)
+	return &current, nil
+}
+
+/*
+GroupPod returns the object the Pod's policy belongs to. Standalone Pods belong to themselves, and the Pods of an owner which is not
+a managed workload (e.g a ReplicationController, an Argo Rollout or an operator's custom resource) are grouped into an OwnedPod of
+their top-level owner. Pods of managed workloads return ErrManagedOwner, since the workload has its own policy.
+*/
+func (r *OwnerResolver) GroupPod(pod *corev1.Pod) (metav1.Object, error) {
+	top, err := r.TopOwner(pod)
+	if err != nil {
+		return nil, err
+	}
+	if top == nil {
+		return pod, nil
+	}
+	if IsManagedKind(*top) {
+		return nil, fmt.Errorf("%w: POD %s is part of %s %s", ErrManagedOwner, pod.GetName(), top.Kind, top.Name)
+	}
+	return &OwnedPod{Pod: pod, Owner: *top}, nil
+}
@@ -0,0 +1,191 @@
+package object
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newOwner(apiVersion, kind, name string, uid types.UID, owner *metav1.OwnerReference) *unstructured.Unstructured {
+	u := &unstructured.Unstructured{}
+	u.SetAPIVersion(apiVersion)
+	u.SetKind(kind)
+	u.SetName(name)
+	u.SetNamespace("default")
+	u.SetUID(uid)
+	if owner != nil {
+		u.SetOwnerReferences([]metav1.OwnerReference{*owner})
+	}
+	return u
+}
+
+func ownerRef(apiVersion, kind, name string, uid types.UID) *metav1.OwnerReference {
+	controller := true
+	return &metav1.OwnerReference{APIVersion: apiVersion, Kind: kind, Name: name, UID: uid, Controller: &controller}
+}
+
+func TestGroupPod(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	for _, gvk := range []schema.GroupVersionKind{
+		{Group: "apps", Version: "v1", Kind: "ReplicaSet"},
+		{Group: "apps", Version: "v1", Kind: "Deployment"},
+		{Group: "", Version: "v1", Kind: "ReplicationController"},
+		{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"},
+	} {
+		mapper.Add(gvk, meta.RESTScopeNamespace)
+	}
+
+	rollout := ownerRef("argoproj.io/v1alpha1", "Rollout", "web", "rollout-uid")
+	deployment := ownerRef("apps/v1", "Deployment", "api", "deploy-uid")
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}: "RolloutList",
+	},
+		newOwner("apps/v1", "ReplicaSet", "web-abc", "rs-web-uid", rollout),
+		newOwner("apps/v1", "ReplicaSet", "api-abc", "rs-api-uid", deployment),
+		newOwner("argoproj.io/v1alpha1", "Rollout", "web", "rollout-uid", nil),
+		newOwner("v1", "ReplicationController", "legacy", "rc-uid", nil),
+	)
+	// the controller is not granted to read every kind of owner
+	client.PrependReactor("get", "rollouts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.(k8stesting.GetAction).GetName() != "locked" {
+			return false, nil, nil
+		}
+		return true, nil, k8serrors.NewForbidden(schema.GroupResource{Group: "argoproj.io", Resource: "rollouts"}, "locked", errors.New("no RBAC"))
+	})
+
+	newPod := func(owner *metav1.OwnerReference) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default", Labels: map[string]string{"app": "x", "pod-template-hash": "abc"}}}
+		if owner != nil {
+			pod.OwnerReferences = []metav1.OwnerReference{*owner}
+		}
+		return pod
+	}
+
+	testCases := []struct {
+		name          string
+		pod           *corev1.Pod
+		expectedOwner string
+		testErr       func(t *testing.T, err error)
+	}{
+		{
+			name: "standalone Pod",
+			pod:  newPod(nil),
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:          "Pod of a Rollout through its ReplicaSet",
+			pod:           newPod(ownerRef("apps/v1", "ReplicaSet", "web-abc", "rs-web-uid")),
+			expectedOwner: "web",
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:          "Pod of a ReplicationController",
+			pod:           newPod(ownerRef("v1", "ReplicationController", "legacy", "rc-uid")),
+			expectedOwner: "legacy",
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:          "Pod of a Rollout the controller can't read",
+			pod:           newPod(ownerRef("argoproj.io/v1alpha1", "Rollout", "locked", "locked-uid")),
+			expectedOwner: "locked",
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name: "Pod of a Deployment through its ReplicaSet",
+			pod:  newPod(ownerRef("apps/v1", "ReplicaSet", "api-abc", "rs-api-uid")),
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrManagedOwner)
+			},
+		},
+		{
+			name: "Pod of a StatefulSet is skipped without looking it up",
+			pod:  newPod(ownerRef("apps/v1", "StatefulSet", "db", "sts-uid")),
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrManagedOwner)
+			},
+		},
+		{
+			name: "Pod of an owner that's gone",
+			pod:  newPod(ownerRef("v1", "ReplicationController", "gone", "gone-uid")),
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrOwnerNotFound)
+			},
+		},
+	}
+
+	r := NewOwnerResolver(client, mapper)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			group, err := r.GroupPod(tc.pod)
+			tc.testErr(t, err)
+			if err != nil {
+				return
+			}
+
+			if tc.expectedOwner == "" {
+				assert.Equal(t, tc.pod, group)
+				return
+			}
+			owned, ok := group.(*OwnedPod)
+			assert.True(t, ok)
+			assert.Equal(t, tc.expectedOwner, owned.GetName())
+
+			selector, _, err := ConvertToMeta(owned)
+			assert.NoError(t, err)
+			assert.Equal(t, map[string]string{"app": "x"}, selector.MatchLabels)
+		})
+	}
+}
+
+func TestOwnerResolverForget(t *testing.T) {
+	mapper := meta.NewDefaultRESTMapper(nil)
+	mapper.Add(schema.GroupVersionKind{Group: "apps", Version: "v1", Kind: "ReplicaSet"}, meta.RESTScopeNamespace)
+	mapper.Add(schema.GroupVersionKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout"}, meta.RESTScopeNamespace)
+
+	rollout := ownerRef("argoproj.io/v1alpha1", "Rollout", "web", "rollout-uid")
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"}: "RolloutList",
+	},
+		newOwner("apps/v1", "ReplicaSet", "web-abc", "rs-web-uid", rollout),
+		newOwner("argoproj.io/v1alpha1", "Rollout", "web", "rollout-uid", nil),
+	)
+	r := NewOwnerResolver(client, mapper)
+
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "pod", Namespace: "default"}}
+	pod.OwnerReferences = []metav1.OwnerReference{*ownerRef("apps/v1", "ReplicaSet", "web-abc", "rs-web-uid")}
+
+	// the top-level owner of the ReplicaSet is cached, until its Pod is deleted
+	for i := 0; i < 2; i++ {
+		top, err := r.TopOwner(pod)
+		assert.NoError(t, err)
+		assert.Equal(t, "web", top.Name)
+	}
+	assert.Len(t, client.Actions(), 2)
+
+	// only the ReplicaSet is dropped, the Rollout stays cached for its other ReplicaSets
+	r.Forget(pod)
+	assert.NotContains(t, r.tops, types.UID("rs-web-uid"))
+	assert.Contains(t, r.tops, types.UID("rollout-uid"))
+	_, err := r.TopOwner(pod)
+	assert.NoError(t, err)
+	assert.Len(t, client.Actions(), 3)
+}
@@ -0,0 +1,185 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/util/jsonpath"
+)
+
+var (
+	ErrInvalidWorkload = errors.New("invalid custom workload")
+	ErrPathNotFound    = errors.New("the path does not exist in the object")
+
+	_workloadsMu sync.RWMutex
+	// _workloads holds the registered custom workloads by their group and kind
+	_workloads = map[schema.GroupKind]*Workload{}
+)
+
+// Workload is a custom resource which runs Pods, e.g an Argo Rollout or an OpenKruise CloneSet
+type Workload struct {
+	GVR  schema.GroupVersionResource
+	Kind string
+	// SelectorPath is the JSONPath of the LabelSelector selecting the Pods, e.g {.spec.selector}
+	SelectorPath string
+	// PodTemplatePath is the JSONPath of the Pod template, e.g {.spec.template}
+	PodTemplatePath string
+}
+
+// parsePath parses a JSONPath, with or without the surrounding braces
+func parsePath(name string, path string) (*jsonpath.JSONPath, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w: %s is empty", ErrInvalidWorkload, name)
+	}
+	if !strings.HasPrefix(path, "{") {
+		path = "{" + path + "}"
+	}
+
+	jp := jsonpath.New(name)
+	if err := jp.Parse(path); err != nil {
+		return nil, fmt.Errorf("%w: %s %q. %v", ErrInvalidWorkload, name, path, err)
+	}
+	return jp, nil
+}
+
+/*
+RegisterWorkload makes the custom resource an object of interest: ConvertToMeta, the Mutate actions and the Pod template lookups
+work on its Unstructured objects from then on, and the Pods it owns are skipped like the Pods of the built-in workloads.
+*/
+func RegisterWorkload(w Workload) error {
+	if w.GVR.Version == "" || w.GVR.Resource == "" || w.Kind == "" {
+		return fmt.Errorf("%w: the version, resource and kind are required", ErrInvalidWorkload)
+	}
+
+	if _, err := parsePath("selectorPath", w.SelectorPath); err != nil {
+		return err
+	}
+	if _, err := parsePath("podTemplatePath", w.PodTemplatePath); err != nil {
+		return err
+	}
+
+	_workloadsMu.Lock()
+	defer _workloadsMu.Unlock()
+	_workloads[schema.GroupKind{Group: w.GVR.Group, Kind: w.Kind}] = &w
+	return nil
+}
+
+// workloadFor returns the registered custom workload of the object's kind
+func workloadFor(obj *unstructured.Unstructured) (*Workload, error) {
+	_workloadsMu.RLock()
+	defer _workloadsMu.RUnlock()
+
+	w, ok := _workloads[obj.GroupVersionKind().GroupKind()]
+	if !ok {
+		return nil, ErrTypeNotSupported
+	}
+	return w, nil
+}
+
+// isRegisteredKind reports whether the group and kind belong to a registered custom workload
+func isRegisteredKind(gk schema.GroupKind) bool {
+	_workloadsMu.RLock()
+	defer _workloadsMu.RUnlock()
+
+	_, ok := _workloads[gk]
+	return ok
+}
+
+// find returns the value at the JSONPath of the object. The path is parsed for every lookup, since a parsed JSONPath is not safe for concurrent use.
+func find(name string, path string, obj *unstructured.Unstructured) (interface{}, error) {
+	jp, err := parsePath(name, path)
+	if err != nil {
+		return nil, err
+	}
+
+	results, err := jp.FindResults(obj.Object)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s of %s. %v", ErrPathNotFound, name, obj.GetName(), err)
+	}
+	if len(results) == 0 || len(results[0]) == 0 {
+		return nil, fmt.Errorf("%w: %s of %s", ErrPathNotFound, name, obj.GetName())
+	}
+	return results[0][0].Interface(), nil
+}
+
+// workloadSelector returns the LabelSelector of a custom workload, both its matchLabels and its matchExpressions
+func workloadSelector(obj *unstructured.Unstructured) (*metav1.LabelSelector, error) {
+	w, err := workloadFor(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := find("selectorPath", w.SelectorPath, obj)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: the selector of %s is not an object", ErrInvalidWorkload, obj.GetName())
+	}
+
+	selector := &metav1.LabelSelector{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, selector); err != nil {
+		return nil, fmt.Errorf("%w: the selector of %s. %v", ErrInvalidWorkload, obj.GetName(), err)
+	}
+	return selector, nil
+}
+
+// fieldPath splits a JSONPath of plain fields, e.g {.spec.template}, into its fields
+func fieldPath(path string) ([]string, error) {
+	fields := strings.TrimPrefix(strings.TrimSuffix(strings.TrimPrefix(path, "{"), "}"), ".")
+	if fields == "" || strings.ContainsAny(fields, "[]*@$?()'\" ") {
+		return nil, fmt.Errorf("%w: %q is not a path of plain fields", ErrInvalidWorkload, path)
+	}
+	return strings.Split(fields, "."), nil
+}
+
+/*
+podTemplateLabelsPath returns the path and the value of the Pod template labels of a custom workload. They can only be patched if the
+PodTemplatePath is a path of plain fields.
+*/
+func podTemplateLabelsPath(obj *unstructured.Unstructured) ([]string, map[string]string, error) {
+	w, err := workloadFor(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	path, err := fieldPath(w.PodTemplatePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	template, err := PodTemplate(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(path, "metadata", "labels"), template.Labels, nil
+}
+
+// PodTemplate returns the Pod template of a custom workload
+func PodTemplate(obj *unstructured.Unstructured) (*corev1.PodTemplateSpec, error) {
+	w, err := workloadFor(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := find("podTemplatePath", w.PodTemplatePath, obj)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%w: the pod template of %s is not an object", ErrInvalidWorkload, obj.GetName())
+	}
+
+	template := &corev1.PodTemplateSpec{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(raw, template); err != nil {
+		return nil, fmt.Errorf("%w: the pod template of %s. %v", ErrInvalidWorkload, obj.GetName(), err)
+	}
+	return template, nil
+}
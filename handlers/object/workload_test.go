@@ -0,0 +1,155 @@
+package object
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// the CloneSet is registered here, and the Rollout is left to TestGroupPod as an unregistered owner
+var _cloneSets = schema.GroupVersionResource{Group: "apps.kruise.io", Version: "v1alpha1", Resource: "clonesets"}
+
+func newCloneSet(name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps.kruise.io/v1alpha1",
+		"kind":       "CloneSet",
+		"metadata":   map[string]interface{}{"name": name, "namespace": "default"},
+		"spec":       spec,
+	}}
+}
+
+func TestRegisterWorkload(t *testing.T) {
+	tests := []struct {
+		name     string
+		workload Workload
+		testErr  func(t *testing.T, err error)
+	}{
+		{
+			name:     "OK - paths with and without braces",
+			workload: Workload{GVR: _cloneSets, Kind: "CloneSet", SelectorPath: ".spec.selector", PodTemplatePath: "{.spec.template}"},
+			testErr: func(t *testing.T, err error) {
+				assert.NoError(t, err)
+			},
+		},
+		{
+			name:     "fails - missing kind",
+			workload: Workload{GVR: _cloneSets, SelectorPath: ".spec.selector", PodTemplatePath: ".spec.template"},
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidWorkload)
+			},
+		},
+		{
+			name:     "fails - missing pod template path",
+			workload: Workload{GVR: _cloneSets, Kind: "CloneSet", SelectorPath: ".spec.selector"},
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidWorkload)
+			},
+		},
+		{
+			name:     "fails - malformed selector path",
+			workload: Workload{GVR: _cloneSets, Kind: "CloneSet", SelectorPath: "{.spec.selector[", PodTemplatePath: ".spec.template"},
+			testErr: func(t *testing.T, err error) {
+				assert.ErrorIs(t, err, ErrInvalidWorkload)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.testErr(t, RegisterWorkload(tt.workload))
+		})
+	}
+}
+
+func TestCustomWorkload(t *testing.T) {
+	err := RegisterWorkload(Workload{
+		GVR:             _cloneSets,
+		Kind:            "CloneSet",
+		SelectorPath:    "{.spec.selector}",
+		PodTemplatePath: "{.spec.template}",
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	cloneSet := newCloneSet("web", map[string]interface{}{
+		"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "web"}},
+		"template": map[string]interface{}{
+			"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "web"}},
+			"spec": map[string]interface{}{"containers": []interface{}{
+				map[string]interface{}{"name": "web", "env": []interface{}{map[string]interface{}{"name": "DB_HOST", "value": "db"}}},
+			}},
+		},
+	})
+
+	t.Run("OK - ConvertToMeta uses the selector path", func(t *testing.T) {
+		selector, obj, err := ConvertToMeta(cloneSet)
+		assert.NoError(t, err)
+		assert.Equal(t, &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}, selector)
+		assert.Equal(t, cloneSet, obj)
+	})
+
+	t.Run("OK - ConvertToMeta keeps the matchExpressions of the selector", func(t *testing.T) {
+		canary := newCloneSet("canary", map[string]interface{}{
+			"selector": map[string]interface{}{
+				"matchLabels": map[string]interface{}{"app": "web"},
+				"matchExpressions": []interface{}{
+					map[string]interface{}{"key": "track", "operator": "NotIn", "values": []interface{}{"stable"}},
+				},
+			},
+		})
+		selector, _, err := ConvertToMeta(canary)
+		assert.NoError(t, err)
+		assert.Equal(t, &metav1.LabelSelector{
+			MatchLabels: map[string]string{"app": "web"},
+			MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "track", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"stable"}},
+			},
+		}, selector)
+	})
+
+	t.Run("OK - getGVR returns the registered resource", func(t *testing.T) {
+		gvr, err := NewHandler(nil, cloneSet).getGVR()
+		assert.NoError(t, err)
+		assert.Equal(t, _cloneSets, gvr)
+	})
+
+	t.Run("OK - PodTemplate uses the pod template path", func(t *testing.T) {
+		template, err := PodTemplate(cloneSet)
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]string{"app": "web"}, template.Labels)
+		assert.Equal(t, []corev1.EnvVar{{Name: "DB_HOST", Value: "db"}}, template.Spec.Containers[0].Env)
+	})
+
+	t.Run("OK - the Pod template is labeled through the pod template path", func(t *testing.T) {
+		path, labels, err := podLabelsPath(cloneSet)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"spec", "template", "metadata", "labels"}, path)
+		assert.Equal(t, map[string]string{"app": "web"}, labels)
+	})
+
+	t.Run("OK - registered kinds are managed owners", func(t *testing.T) {
+		assert.True(t, IsManagedKind(metav1.OwnerReference{APIVersion: "apps.kruise.io/v1alpha1", Kind: "CloneSet", Name: "web"}))
+	})
+
+	t.Run("fails - selector path missing from the object", func(t *testing.T) {
+		_, _, err := ConvertToMeta(newCloneSet("broken", map[string]interface{}{}))
+		assert.ErrorIs(t, err, ErrPathNotFound)
+	})
+
+	t.Run("fails - pod template path with a filter can't be patched", func(t *testing.T) {
+		_, err := fieldPath("{.spec.templates[?(@.name==\"web\")]}")
+		assert.ErrorIs(t, err, ErrInvalidWorkload)
+	})
+
+	t.Run("fails - unregistered kind", func(t *testing.T) {
+		other := newCloneSet("other", nil)
+		other.SetKind("Unknown")
+		_, _, err := ConvertToMeta(other)
+		assert.ErrorIs(t, err, ErrTypeNotSupported)
+	})
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"log"
+	"os"
 
 	"github.com/adykaaa/k8s-netpol-ctrl/app"
 )
@@ -12,5 +13,13 @@ func main() {
 		log.Fatalf("could not initialize app %v", err)
 	}
 
+	// the cleanup command removes what the controller has added to the workloads, before it's uninstalled
+	if len(os.Args) > 1 && os.Args[1] == "cleanup" {
+		if err := app.Cleanup(); err != nil {
+			log.Fatalf("could not clean up %v", err)
+		}
+		return
+	}
+
 	app.Run()
 }
@@ -38,6 +38,9 @@ func (rw *ResourceWatcher) NewDefaultGroupVersionResources() []schema.GroupVersi
 		{Group: "", Version: "v1", Resource: "services"},
 		{Group: "apps", Version: "v1", Resource: "statefulsets"},
 		{Group: "apps", Version: "v1", Resource: "deployments"},
+		{Group: "batch", Version: "v1", Resource: "jobs"},
+		{Group: "batch", Version: "v1", Resource: "cronjobs"},
+		{Group: "discovery.k8s.io", Version: "v1", Resource: "endpointslices"},
 	}
 }
 